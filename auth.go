@@ -0,0 +1,279 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Authorization schemes
+	asBearer = "Bearer"
+	asBasic  = "Basic"
+
+	// Common HTTP Header Names
+	hnWWWAuthenticate = "WWW-Authenticate"
+
+	// htpasswd hash prefixes
+	hpSHA = "{SHA}"
+
+	authRealm = "trickster"
+)
+
+// ProxyAuthenticator authenticates client requests to the proxy listener. A request is authenticated when it
+// presents any one of the configured credentials: a bearer token, a basic auth user, or an allowed client certificate.
+type ProxyAuthenticator struct {
+	bearerTokens       []string
+	users              map[string]string
+	clientCertSubjects map[string]bool
+
+	// verified caches the hashes of basic auth credentials that have passed a (slow) bcrypt check
+	verifiedMtx sync.Mutex
+	verified    map[[sha256.Size]byte]bool
+}
+
+// newProxyAuthenticator returns a ProxyAuthenticator for the provided configuration, or nil if no authentication is configured
+func newProxyAuthenticator(c ProxyAuthConfig, logger log.Logger) (*ProxyAuthenticator, error) {
+	if len(c.BearerTokens) == 0 && c.HtpasswdFile == "" && len(c.ClientCertSubjects) == 0 {
+		return nil, nil
+	}
+
+	a := &ProxyAuthenticator{
+		bearerTokens:       c.BearerTokens,
+		clientCertSubjects: make(map[string]bool, len(c.ClientCertSubjects)),
+		verified:           make(map[[sha256.Size]byte]bool),
+	}
+
+	for _, s := range c.ClientCertSubjects {
+		a.clientCertSubjects[s] = true
+	}
+
+	if c.HtpasswdFile != "" {
+		users, err := loadHtpasswdFile(c.HtpasswdFile, logger)
+		if err != nil {
+			return nil, err
+		}
+		a.users = users
+	}
+
+	return a, nil
+}
+
+// loadHtpasswdFile reads the users and password hashes from an htpasswd file. Only bcrypt and {SHA} hashes are supported
+func loadHtpasswdFile(path string, logger log.Logger) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open htpasswd file: %v", err)
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		if !strings.HasPrefix(parts[1], "$2") && !strings.HasPrefix(parts[1], hpSHA) {
+			level.Warn(logger).Log(lfEvent, "skipping htpasswd user with unsupported hash type", "user", parts[0])
+			continue
+		}
+
+		users[parts[0]] = parts[1]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read htpasswd file: %v", err)
+	}
+
+	return users, nil
+}
+
+// usesAuthorizationHeader returns true if clients authenticate to the proxy with the Authorization header,
+// in which case the header holds a Trickster credential and must not be forwarded to origins
+func (a *ProxyAuthenticator) usesAuthorizationHeader() bool {
+	return a != nil && (len(a.bearerTokens) > 0 || a.users != nil)
+}
+
+// authenticate returns true if the request presents a valid credential
+func (a *ProxyAuthenticator) authenticate(r *http.Request) bool {
+	if a == nil {
+		return true
+	}
+
+	if len(a.clientCertSubjects) > 0 && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+		if a.clientCertSubjects[cert.Subject.CommonName] || a.clientCertSubjects[cert.Subject.String()] {
+			return true
+		}
+	}
+
+	authorization := r.Header.Get(hnAuthorization)
+
+	if len(a.bearerTokens) > 0 && strings.HasPrefix(authorization, asBearer+" ") {
+		token := strings.TrimPrefix(authorization, asBearer+" ")
+		for _, t := range a.bearerTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				return true
+			}
+		}
+	}
+
+	if a.users != nil {
+		if user, password, ok := r.BasicAuth(); ok {
+			return a.checkPassword(user, password)
+		}
+	}
+
+	return false
+}
+
+// checkPassword verifies the password of a basic auth user against the user's htpasswd hash
+func (a *ProxyAuthenticator) checkPassword(user, password string) bool {
+	hash, ok := a.users[user]
+	if !ok {
+		return false
+	}
+
+	if strings.HasPrefix(hash, hpSHA) {
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hash[len(hpSHA):]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	}
+
+	key := sha256.Sum256([]byte(user + ":" + password + ":" + hash))
+
+	a.verifiedMtx.Lock()
+	verified := a.verified[key]
+	a.verifiedMtx.Unlock()
+	if verified {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+
+	a.verifiedMtx.Lock()
+	a.verified[key] = true
+	a.verifiedMtx.Unlock()
+
+	return true
+}
+
+// challenge returns the WWW-Authenticate header value for unauthenticated requests
+func (a *ProxyAuthenticator) challenge() string {
+	if a.users != nil {
+		return asBasic + ` realm="` + authRealm + `"`
+	}
+	return asBearer + ` realm="` + authRealm + `"`
+}
+
+// withAuthentication wraps the proxy router so that unauthenticated requests are rejected with a 401
+// before any cache lookup. /ping is exempt so that load balancers can check the health of Trickster.
+func (t *TricksterHandler) withAuthentication(next http.Handler) http.Handler {
+	if t.Authenticator == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ping" && !t.Authenticator.authenticate(r) {
+			level.Debug(t.Logger).Log(lfEvent, "rejecting unauthenticated request", "remoteAddr", r.RemoteAddr, "path", r.URL.Path)
+			w.Header().Set(hnWWWAuthenticate, t.Authenticator.challenge())
+			writePrometheusError(w, http.StatusUnauthorized, etUnauthorized, "authentication required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// originCredentials returns the Authorization header value for the credentials configured for the origin, if any
+func originCredentials(o PrometheusOriginConfig) string {
+	if o.OriginBearerToken != "" {
+		return asBearer + " " + o.OriginBearerToken
+	}
+	if o.OriginUsername != "" {
+		return asBasic + " " + base64.StdEncoding.EncodeToString([]byte(o.OriginUsername+":"+o.OriginPassword))
+	}
+	return ""
+}
+
+// originRequestHeaders returns the headers to send to the origin, including the origin's injected headers. The origin's
+// own credentials, when configured, replace any client Authorization header, and a client Authorization header used to
+// authenticate to Trickster is dropped
+func (t *TricksterHandler) originRequestHeaders(o PrometheusOriginConfig, headers http.Header) http.Header {
+	h := http.Header{}
+	for k, v := range headers {
+		h[k] = v
+	}
+	headers = h
+
+	for k, v := range o.InjectHeaders {
+		headers.Set(k, v)
+	}
+
+	if credentials := originCredentials(o); credentials != "" {
+		headers.Set(hnAuthorization, credentials)
+	} else if t.Authenticator.usesAuthorizationHeader() {
+		headers.Del(hnAuthorization)
+	}
+
+	return headers
+}
+
+// newProxyTLSConfig returns the TLS configuration for the proxy listener. When a client CA file is configured,
+// client certificates signed by it are verified so their subjects can be checked against the allow-list
+func newProxyTLSConfig(c ProxyServerConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if c.TLSClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read client CA file: %v", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %q", c.TLSClientCAFile)
+		}
+
+		tlsConfig.ClientCAs = pool
+		// Certificates are optional at the TLS layer so that /ping and the other authentication methods keep working
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,170 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestAuthServer(t *testing.T, c ProxyAuthConfig) http.Handler {
+	a, err := newProxyAuthenticator(c, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &TricksterHandler{Logger: log.NewNopLogger(), Authenticator: a}
+	return tr.withAuthentication(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func TestTricksterHandler_withAuthentication_bearer(t *testing.T) {
+	h := newTestAuthServer(t, ProxyAuthConfig{BearerTokens: []string{"s3cr3t"}})
+
+	tests := []struct {
+		path          string
+		authorization string
+		status        int
+	}{
+		{"/api/v1/query", "", http.StatusUnauthorized},
+		{"/api/v1/query", "Bearer wrong", http.StatusUnauthorized},
+		{"/api/v1/query", "Bearer s3cr3t", http.StatusOK},
+		{"/ping", "", http.StatusOK},
+	}
+
+	for i, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://trickster"+test.path, nil)
+		if test.authorization != "" {
+			r.Header.Set(hnAuthorization, test.authorization)
+		}
+		h.ServeHTTP(w, r)
+		if w.Result().StatusCode != test.status {
+			t.Errorf("test %d: wanted %d got %d.", i, test.status, w.Result().StatusCode)
+		}
+		if test.status == http.StatusUnauthorized && w.Result().Header.Get(hnWWWAuthenticate) == "" {
+			t.Errorf("test %d: expected %s header", i, hnWWWAuthenticate)
+		}
+	}
+}
+
+func TestTricksterHandler_withAuthentication_htpasswd(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("bcryptpass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	// shapass is {SHA} hashed, and the apr1 user is skipped as unsupported
+	f.WriteString("# users\nbcryptuser:" + string(hash) + "\nshauser:{SHA}z0jT3TdveclVlHs5WCpg5cPeIe8=\napr1user:$apr1$x$y\n")
+	f.Close()
+
+	h := newTestAuthServer(t, ProxyAuthConfig{HtpasswdFile: f.Name()})
+
+	tests := []struct {
+		user     string
+		password string
+		status   int
+	}{
+		{"bcryptuser", "bcryptpass", http.StatusOK},
+		{"bcryptuser", "bcryptpass", http.StatusOK},
+		{"bcryptuser", "wrong", http.StatusUnauthorized},
+		{"shauser", "shapass", http.StatusOK},
+		{"shauser", "wrong", http.StatusUnauthorized},
+		{"apr1user", "y", http.StatusUnauthorized},
+		{"nobody", "", http.StatusUnauthorized},
+	}
+
+	for i, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://trickster/api/v1/query", nil)
+		r.SetBasicAuth(test.user, test.password)
+		h.ServeHTTP(w, r)
+		if w.Result().StatusCode != test.status {
+			t.Errorf("test %d: wanted %d got %d.", i, test.status, w.Result().StatusCode)
+		}
+	}
+}
+
+func TestTricksterHandler_withAuthentication_clientCert(t *testing.T) {
+	h := newTestAuthServer(t, ProxyAuthConfig{ClientCertSubjects: []string{"grafana"}})
+
+	for _, cn := range []string{"grafana", "someone-else"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "https://trickster/api/v1/query", nil)
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}}
+		h.ServeHTTP(w, r)
+
+		want := http.StatusOK
+		if cn != "grafana" {
+			want = http.StatusUnauthorized
+		}
+		if w.Result().StatusCode != want {
+			t.Errorf("%s: wanted %d got %d.", cn, want, w.Result().StatusCode)
+		}
+	}
+}
+
+func TestTricksterHandler_getURL_originCredentials(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	var authorization string
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get(hnAuthorization)
+	}))
+	defer es.Close()
+
+	clientHeaders := http.Header{hnAuthorization: []string{"Bearer client"}}
+
+	tests := []struct {
+		origin        PrometheusOriginConfig
+		authenticator *ProxyAuthenticator
+		expected      string
+	}{
+		// client credentials are passed through by default
+		{PrometheusOriginConfig{OriginURL: es.URL}, nil, "Bearer client"},
+		// origin credentials replace them
+		{PrometheusOriginConfig{OriginURL: es.URL, OriginBearerToken: "origin"}, nil, "Bearer origin"},
+		{PrometheusOriginConfig{OriginURL: es.URL, OriginUsername: "user", OriginPassword: "pass"}, nil, "Basic dXNlcjpwYXNz"},
+		// client credentials for Trickster itself are not passed through
+		{PrometheusOriginConfig{OriginURL: es.URL}, &ProxyAuthenticator{bearerTokens: []string{"client"}}, ""},
+	}
+
+	for i, test := range tests {
+		tr.Authenticator = test.authenticator
+		if _, _, _, err := tr.getURL(context.Background(), test.origin, "GET", es.URL, url.Values{}, clientHeaders); err != nil {
+			t.Fatal(err)
+		}
+		if authorization != test.expected {
+			t.Errorf("test %d: wanted %q got %q.", i, test.expected, authorization)
+		}
+	}
+}
@@ -56,7 +56,7 @@ func (c *BoltDBCache) Connect() error {
 }
 
 // Store places an object in the cache using the specified key and ttl
-func (c *BoltDBCache) Store(cacheKey string, data string, ttl int64) error {
+func (c *BoltDBCache) Store(cacheKey string, data []byte, ttl int64) error {
 
 	expKey, dataKey := c.getKeyNames(cacheKey)
 	expiration := []byte(strconv.FormatInt(time.Now().Unix()+ttl, 10))
@@ -65,7 +65,7 @@ func (c *BoltDBCache) Store(cacheKey string, data string, ttl int64) error {
 
 		b := tx.Bucket([]byte(c.Config.Bucket))
 
-		err := b.Put([]byte(dataKey), []byte(data))
+		err := b.Put([]byte(dataKey), data)
 		if err != nil {
 			return err
 		}
@@ -82,7 +82,7 @@ func (c *BoltDBCache) Store(cacheKey string, data string, ttl int64) error {
 }
 
 // Retrieve looks for an object in cache and returns it (or an error if not found)
-func (c *BoltDBCache) Retrieve(cacheKey string) (string, error) {
+func (c *BoltDBCache) Retrieve(cacheKey string) ([]byte, error) {
 
 	level.Debug(c.T.Logger).Log("event", "boltdb cache retrieve", "key", cacheKey)
 
@@ -94,9 +94,9 @@ func (c *BoltDBCache) Retrieve(cacheKey string) (string, error) {
 }
 
 // retrieve looks for an object in cache and returns it (or an error if not found)
-func (c *BoltDBCache) retrieve(cacheKey string) (string, error) {
+func (c *BoltDBCache) retrieve(cacheKey string) ([]byte, error) {
 
-	content := ""
+	var content []byte
 
 	err := c.dbh.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(c.Config.Bucket))
@@ -105,11 +105,13 @@ func (c *BoltDBCache) retrieve(cacheKey string) (string, error) {
 			level.Debug(c.T.Logger).Log("event", "boltdb cache miss", "key", cacheKey)
 			return fmt.Errorf("Value for key [%s] not in cache", cacheKey)
 		}
-		content = string(v)
+		// v is only valid for the life of the transaction, so it must be copied
+		content = make([]byte, len(v))
+		copy(content, v)
 		return nil
 	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	return content, nil
@@ -46,7 +46,7 @@ func TestBoltDBCache_Store(t *testing.T) {
 	defer bc.Close()
 
 	// it should store a value
-	err = bc.Store("cacheKey", "data", 60000)
+	err = bc.Store("cacheKey", []byte("data"), 60000)
 	if err != nil {
 		t.Error(err)
 	}
@@ -64,7 +64,7 @@ func TestBoltDBCache_Delete(t *testing.T) {
 	defer bc.Close()
 
 	// it should store a value
-	err = bc.Store("cacheKey", "data", 60000)
+	err = bc.Store("cacheKey", []byte("data"), 60000)
 	if err != nil {
 		t.Error(err)
 	}
@@ -88,7 +88,7 @@ func TestBoltDBCache_Retrieve(t *testing.T) {
 	}
 	defer bc.Close()
 
-	err = bc.Store("cacheKey", "data", 60000)
+	err = bc.Store("cacheKey", []byte("data"), 60000)
 	if err != nil {
 		t.Error(err)
 	}
@@ -98,7 +98,18 @@ func TestBoltDBCache_Retrieve(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	if data != "data" {
+	if string(data) != "data" {
 		t.Errorf("wanted \"%s\". got \"%s\".", "data", data)
 	}
 }
+
+func BenchmarkBoltDBCache(b *testing.B) {
+	cfg := Config{Caching: CachingConfig{ReapSleepMS: 1000}}
+	tr := TricksterHandler{Logger: log.NewNopLogger(), Config: &cfg}
+	bc := BoltDBCache{T: &tr, Config: BoltDBCacheConfig{Filename: "/tmp/test.db", Bucket: "trickster_test"}}
+	if err := bc.Connect(); err != nil {
+		b.Fatal(err)
+	}
+	defer bc.Close()
+	benchmarkCache(b, &bc)
+}
@@ -26,11 +26,12 @@ const (
 )
 
 // Cache is the interface for the supported caching fabrics
-// When making new cache types, Retrieve() must return an error on cache miss
+// When making new cache types, Retrieve() must return an error on cache miss.
+// Callers must not modify the data passed to Store() or returned by Retrieve(), as it may be shared with the cache.
 type Cache interface {
 	Connect() error
-	Store(cacheKey string, data string, ttl int64) error
-	Retrieve(cacheKey string) (string, error)
+	Store(cacheKey string, data []byte, ttl int64) error
+	Retrieve(cacheKey string) ([]byte, error)
 	Reap()
 	Close() error
 }
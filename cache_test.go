@@ -0,0 +1,53 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// benchmarkPayload is the size of a large compressed matrix
+var benchmarkPayload = bytes.Repeat([]byte("trickster"), 4<<20/9)
+
+// benchmarkCache measures storing and retrieving a large payload, as done for each range request cache miss
+func benchmarkCache(b *testing.B, c Cache) {
+	b.SetBytes(int64(len(benchmarkPayload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := c.Store("benchmarkKey", benchmarkPayload, 60); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := c.Retrieve("benchmarkKey"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkCache_stringConversions measures the payload copies made by the call sites of the former
+// string-based Cache interface on each store and retrieve, for comparison with the cache benchmarks
+func BenchmarkCache_stringConversions(b *testing.B) {
+	b.SetBytes(int64(len(benchmarkPayload)))
+	b.ReportAllocs()
+
+	var s string
+	var body []byte
+	for i := 0; i < b.N; i++ {
+		s = string(benchmarkPayload)
+		body = []byte(s)
+	}
+	_ = body
+}
@@ -0,0 +1,166 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// chunkIndexMagic is the first byte of the chunk index, which is stored under the query's cache key when the origin
+// shards query_range results into chunks. It differs from the headers of matrix and cache records, so an index is
+// never mistaken for a single-blob record (or vice versa) when chunk_size_secs is changed
+const chunkIndexMagic = 0x02
+
+// chunkStart returns the start time of the chunk holding the timestamp ts, in milliseconds
+func chunkStart(ts int64, chunkMS int64) int64 {
+	return ts - ts%chunkMS
+}
+
+// chunkKey returns the cache key of the chunk beginning at start (in milliseconds) for a query's cache key
+func chunkKey(cacheKey string, start int64) string {
+	return cacheKey + "." + strconv.FormatInt(start/1000, 10)
+}
+
+// encodeChunkIndex serializes the start times of a query's chunks
+func encodeChunkIndex(starts []int64) []byte {
+	buf := make([]byte, 0, 1+len(starts)*4)
+	buf = append(buf, chunkIndexMagic)
+	buf = appendUvarint(buf, uint64(len(starts)))
+	for _, s := range starts {
+		buf = appendVarint(buf, s)
+	}
+	return buf
+}
+
+// decodeChunkIndex deserializes the start times of a query's chunks
+func decodeChunkIndex(data []byte) ([]int64, error) {
+	if len(data) == 0 || data[0] != chunkIndexMagic {
+		return nil, fmt.Errorf("not a chunk index")
+	}
+
+	r := &byteReader{buf: data[1:]}
+	starts := make([]int64, r.bound(r.uvarint()))
+	for i := range starts {
+		starts[i] = r.varint()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return starts, nil
+}
+
+// retrieveChunks loads the cached chunks overlapping the requested extents and merges them into a single matrix.
+// Chunks that are missing (e.g., evicted from the cache) leave gaps in the extents of the merged matrix, which are
+// filled from the origin like any other missing range
+func (t *TricksterHandler) retrieveChunks(ctx *ClientRequestContext) (PrometheusMatrixEnvelope, error) {
+	pe := PrometheusMatrixEnvelope{}
+
+	data, err := t.Cacher.Retrieve(ctx.CacheKey)
+	if err != nil {
+		return pe, err
+	}
+
+	starts, err := decodeChunkIndex(data)
+	if err != nil {
+		return pe, err
+	}
+
+	cached := make(map[int64]bool, len(starts))
+	for _, s := range starts {
+		cached[s] = true
+	}
+
+	chunkMS := ctx.Origin.ChunkSizeSecs * 1000
+	chunks := make([]PrometheusMatrixEnvelope, 0)
+	extents := ExtentList{}
+	for s := chunkStart(ctx.RequestExtents.Start, chunkMS); s <= ctx.RequestExtents.End; s += chunkMS {
+		if !cached[s] {
+			continue
+		}
+
+		chunk := PrometheusMatrixEnvelope{}
+		data, err := t.Cacher.Retrieve(chunkKey(ctx.CacheKey, s))
+		if err != nil || decodeCacheMatrix(data, &chunk) != nil {
+			level.Debug(t.Logger).Log(lfEvent, "missing cache chunk", lfCacheKey, ctx.CacheKey, "chunkStart", s)
+			continue
+		}
+
+		for _, e := range chunk.cachedExtents() {
+			extents = extents.add(e, ctx.StepMS)
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	if len(chunks) == 0 {
+		return pe, fmt.Errorf("no cached chunks for the requested extents")
+	}
+
+	pe = fillMatrix(defaultPrometheusMatrixEnvelope(), chunks, nil)
+	pe.Extents = extents
+
+	return pe, nil
+}
+
+// storeChunks writes the chunks of the matrix overlapping the extents that were fetched from the origin,
+// leaving the rest of the query's chunks untouched, and updates the query's chunk index
+func (t *TricksterHandler) storeChunks(ctx *ClientRequestContext, pe PrometheusMatrixEnvelope, fetched ExtentList) error {
+	chunkMS := ctx.Origin.ChunkSizeSecs * 1000
+	ttl := t.Config.Caching.RecordTTLSecs
+
+	index := make(map[int64]bool)
+	if data, err := t.Cacher.Retrieve(ctx.CacheKey); err == nil {
+		if starts, err := decodeChunkIndex(data); err == nil {
+			for _, s := range starts {
+				index[s] = true
+			}
+		}
+	}
+
+	for _, e := range fetched {
+		for s := chunkStart(e.Start, chunkMS); s <= e.End; s += chunkMS {
+			chunk := pe.copy()
+			chunk.cropToRange(s, s+chunkMS-1)
+			if len(chunk.Data.Result) == 0 && len(chunk.Extents) == 0 {
+				continue
+			}
+
+			body, err := t.encodeCacheMatrix(chunk)
+			if err != nil {
+				return err
+			}
+
+			key := chunkKey(ctx.CacheKey, s)
+			t.Cacher.Store(key, body, ttl)
+			level.Debug(t.Logger).Log(lfEvent, "setCacheChunk", lfCacheKey, key, "ttl", ttl)
+			index[s] = true
+		}
+	}
+
+	// Forget chunks whose data has all aged out of the cache
+	oldest := chunkStart((ctx.Time-ctx.Origin.MaxValueAgeSecs)*1000, chunkMS)
+	starts := make([]int64, 0, len(index))
+	for s := range index {
+		if s >= oldest {
+			starts = append(starts, s)
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	return t.Cacher.Store(ctx.CacheKey, encodeChunkIndex(starts), ttl)
+}
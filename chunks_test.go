@@ -0,0 +1,191 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestChunkIndex(t *testing.T) {
+	starts := []int64{1435781400000, 1435781430000, 1435781460000}
+
+	// it should round trip
+	got, err := decodeChunkIndex(encodeChunkIndex(starts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, starts) {
+		t.Errorf("wanted %v got %v.", starts, got)
+	}
+
+	// it should reject other records and truncated indexes
+	for _, data := range [][]byte{nil, []byte(exampleRangeResponse), encodeChunkIndex(starts)[:3]} {
+		if _, err := decodeChunkIndex(data); err == nil {
+			t.Errorf("expected error decoding %v", data)
+		}
+	}
+}
+
+func TestChunkStart(t *testing.T) {
+	if s := chunkStart(1435781445000, 30000); s != 1435781430000 {
+		t.Errorf("wanted 1435781430000 got %d.", s)
+	}
+	if s := chunkStart(1435781430000, 30000); s != 1435781430000 {
+		t.Errorf("wanted 1435781430000 got %d.", s)
+	}
+}
+
+func TestTricksterHandler_promQueryRangeHandler_chunked(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es := newTestServer(exampleRangeResponse)
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	// keep the 2015 example data from being aged out of the cache
+	o := tr.Config.Origins["default"]
+	o.MaxValueAgeSecs = time.Now().Unix()
+	o.FastForwardDisable = true
+	o.ChunkSizeSecs = 30
+	tr.Config.Origins["default"] = o
+
+	w := httptest.NewRecorder()
+	tr.promQueryRangeHandler(w, httptest.NewRequest("GET", es.URL+exampleRangeQuery, nil))
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("wanted 200 got %d.", w.Result().StatusCode)
+	}
+
+	ctx, err := tr.buildRequestContext(w, httptest.NewRequest("GET", es.URL+exampleRangeQuery, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// it should store an index of the chunks under the query's cache key
+	data, err := tr.Cacher.Retrieve(ctx.CacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	starts, err := decodeChunkIndex(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(starts, []int64{1435781430000, 1435781460000}) {
+		t.Errorf("wanted chunks [1435781430000 1435781460000] got %v.", starts)
+	}
+
+	// it should store each chunk's points under its own key
+	for start, count := range map[int64]int64{1435781430000: 4, 1435781460000: 2} {
+		data, err := tr.Cacher.Retrieve(chunkKey(ctx.CacheKey, start))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pe := PrometheusMatrixEnvelope{}
+		if err := decodeCacheMatrix(data, &pe); err != nil {
+			t.Fatal(err)
+		}
+		if pe.getValueCount() != count {
+			t.Errorf("wanted %d values in chunk %d got %d.", count, start, pe.getValueCount())
+		}
+	}
+
+	// it should serve the request from the chunks
+	if ctx.CacheLookupResult != crHit {
+		t.Errorf("wanted %s got %s.", crHit, ctx.CacheLookupResult)
+	}
+	if ctx.Matrix.getValueCount() != 6 {
+		t.Errorf("wanted 6 values got %d.", ctx.Matrix.getValueCount())
+	}
+}
+
+func TestTricksterHandler_retrieveChunks(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	ctx := &ClientRequestContext{
+		CacheKey:       "chunked",
+		Origin:         PrometheusOriginConfig{ChunkSizeSecs: 30},
+		RequestExtents: MatrixExtents{Start: 1435781400000, End: 1435781490000},
+		StepMS:         15000,
+	}
+
+	storeChunk := func(start int64, timestamps ...int64) {
+		values := make([]model.SamplePair, 0, len(timestamps))
+		for _, ts := range timestamps {
+			values = append(values, model.SamplePair{Timestamp: model.Time(ts), Value: 1})
+		}
+		pe := PrometheusMatrixEnvelope{
+			Status: rvSuccess,
+			Data: PrometheusMatrixData{
+				ResultType: rvMatrix,
+				Result:     model.Matrix{{Metric: model.Metric{"__name__": "up"}, Values: values}},
+			},
+		}
+		data, err := tr.encodeCacheMatrix(pe)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr.Cacher.Store(chunkKey(ctx.CacheKey, start), data, 60)
+	}
+
+	// it should miss without an index
+	if _, err := tr.retrieveChunks(ctx); err == nil {
+		t.Errorf("expected error without a chunk index")
+	}
+
+	storeChunk(1435781400000, 1435781400000, 1435781415000)
+	storeChunk(1435781430000, 1435781430000, 1435781445000)
+	storeChunk(1435781460000, 1435781460000, 1435781475000)
+	tr.Cacher.Store(ctx.CacheKey, encodeChunkIndex([]int64{1435781400000, 1435781430000, 1435781460000}), 60)
+
+	// it should merge contiguous chunks
+	pe, err := tr.retrieveChunks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := pe.getExtents(); e.Start != 1435781400000 || e.End != 1435781475000 {
+		t.Errorf("wanted extents 1435781400000-1435781475000 got %d-%d.", e.Start, e.End)
+	}
+	if pe.getValueCount() != 6 {
+		t.Errorf("wanted 6 values got %d.", pe.getValueCount())
+	}
+
+	// it should only load the chunks overlapping the request
+	ctx.RequestExtents.Start = 1435781460000
+	if pe, err = tr.retrieveChunks(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if pe.getValueCount() != 2 {
+		t.Errorf("wanted 2 values got %d.", pe.getValueCount())
+	}
+
+	// it should leave a gap in the extents where a chunk's data is missing, so that it is fetched from the origin
+	ctx.RequestExtents.Start = 1435781400000
+	storeChunk(1435781430000, 1435781430000)
+	if pe, err = tr.retrieveChunks(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := ExtentList{{Start: 1435781400000, End: 1435781430000}, {Start: 1435781460000, End: 1435781475000}}
+	if !reflect.DeepEqual(pe.Extents, want) {
+		t.Errorf("wanted extents %v got %v.", want, pe.Extents)
+	}
+	if pe.getValueCount() != 5 {
+		t.Errorf("wanted 5 values got %d.", pe.getValueCount())
+	}
+}
@@ -0,0 +1,206 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	// Circuit breaker states
+	cbClosed   = 0
+	cbOpen     = 1
+	cbHalfOpen = 2
+
+	defaultCircuitBreakerOpenSecs = 30
+)
+
+// errCircuitOpen is returned for origin requests that are not attempted because the origin's circuit breaker is open
+var errCircuitOpen = errors.New("origin circuit breaker is open")
+
+// CircuitBreaker stops requests from being sent to an origin after consecutive failures. Once open, the
+// breaker rejects requests until OpenDuration has passed, and then allows a single probe request through (half-open).
+// A successful probe closes the breaker, and a failed one opens it again.
+type CircuitBreaker struct {
+	Origin       string
+	MaxFailures  int
+	OpenDuration time.Duration
+
+	t        *TricksterHandler
+	mtx      sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+// getCircuitBreaker returns the CircuitBreaker for the provided origin, or nil if the origin has no circuit breaker configured
+func (t *TricksterHandler) getCircuitBreaker(o PrometheusOriginConfig) *CircuitBreaker {
+	if o.CircuitBreakerFailures <= 0 {
+		return nil
+	}
+
+	t.CircuitBreakersMtx.Lock()
+	defer t.CircuitBreakersMtx.Unlock()
+
+	if t.CircuitBreakers == nil {
+		t.CircuitBreakers = make(map[string]*CircuitBreaker)
+	}
+
+	if cb, ok := t.CircuitBreakers[o.OriginURL]; ok {
+		return cb
+	}
+
+	openSecs := o.CircuitBreakerOpenSecs
+	if openSecs <= 0 {
+		openSecs = defaultCircuitBreakerOpenSecs
+	}
+
+	cb := &CircuitBreaker{
+		Origin:       o.OriginURL,
+		MaxFailures:  o.CircuitBreakerFailures,
+		OpenDuration: time.Duration(openSecs) * time.Second,
+		t:            t,
+	}
+	t.CircuitBreakers[o.OriginURL] = cb
+	cb.setStateMetric()
+
+	return cb
+}
+
+// allow returns true if a request may be sent to the origin
+func (cb *CircuitBreaker) allow() bool {
+	if cb == nil {
+		return true
+	}
+
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+
+	switch cb.state {
+	case cbOpen:
+		if time.Since(cb.openedAt) < cb.OpenDuration {
+			return false
+		}
+		// let a single probe request through
+		cb.state = cbHalfOpen
+		cb.setStateMetric()
+		return true
+	case cbHalfOpen:
+		// a probe is already in flight
+		return false
+	default:
+		return true
+	}
+}
+
+// abandon ends an allowed request that has no outcome, such as one canceled by its client. A half-open breaker lets
+// the next request probe the origin
+func (cb *CircuitBreaker) abandon() {
+	if cb == nil {
+		return
+	}
+
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+
+	if cb.state == cbHalfOpen {
+		cb.state = cbOpen
+		cb.openedAt = time.Now().Add(-cb.OpenDuration)
+		cb.setStateMetric()
+	}
+}
+
+// record updates the breaker with the outcome of an allowed request
+func (cb *CircuitBreaker) record(ok bool) {
+	if cb == nil {
+		return
+	}
+
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+
+	if ok {
+		if cb.state != cbClosed {
+			level.Info(cb.t.Logger).Log(lfEvent, "closing origin circuit breaker", "origin", cb.Origin)
+		}
+		cb.state = cbClosed
+		cb.failures = 0
+		cb.setStateMetric()
+		return
+	}
+
+	cb.failures++
+	if cb.state == cbHalfOpen || cb.failures >= cb.MaxFailures {
+		if cb.state != cbOpen {
+			level.Warn(cb.t.Logger).Log(lfEvent, "opening origin circuit breaker", "origin", cb.Origin, "failures", cb.failures)
+		}
+		cb.state = cbOpen
+		cb.openedAt = time.Now()
+		cb.setStateMetric()
+	}
+}
+
+// setStateMetric reports the state of the breaker. It must be called with the breaker's mutex held.
+func (cb *CircuitBreaker) setStateMetric() {
+	if cb.t.Metrics == nil {
+		return
+	}
+	cb.t.Metrics.CircuitBreakerState.WithLabelValues(cb.Origin).Set(float64(cb.state))
+}
+
+// respondWithStaleData responds to the client request with the cached portion of the requested range when the
+// origin is unavailable, if the origin is configured to serve stale data and the cache has data for the query.
+// partial is true if part of the requested range was fetched from the origin. It returns false if nothing was written.
+func (t *TricksterHandler) respondWithStaleData(r *ClientRequestContext, ctx *ClientRequestContext, partial bool) bool {
+	if !ctx.Origin.ServeStaleOnError || ctx.Matrix.Status != rvSuccess {
+		return false
+	}
+
+	stale := ctx.Matrix.copy()
+	stale.cropToRange(ctx.RequestExtents.Start, ctx.RequestExtents.End+ctx.StepMS)
+	if len(stale.Data.Result) == 0 && len(stale.Data.Histograms) == 0 {
+		return false
+	}
+	stale.shiftTimestamps(ctx.ShiftMS)
+
+	level.Warn(t.Logger).Log(lfEvent, "origin unavailable, serving stale data from cache", lfCacheKey, ctx.CacheKey)
+	if partial {
+		markStale(r.Writer, &stale, twPartialStale)
+	} else {
+		markStale(r.Writer, &stale, twStale)
+	}
+
+	body, err := json.Marshal(stale)
+	if err != nil {
+		level.Error(t.Logger).Log(lfEvent, "prometheus matrix marshaling error", lfDetail, err.Error())
+		return false
+	}
+
+	t.Metrics.CacheRequestStatus.WithLabelValues(ctx.Origin.OriginURL, otPrometheus, mnQueryRange, crStale, "200").Inc()
+	writeResponse(r.Writer, body, &http.Response{StatusCode: http.StatusOK})
+
+	return true
+}
+
+// markStale flags the response to the client as possibly incomplete or stale, with both a header and a Prometheus warning
+func markStale(w http.ResponseWriter, pe *PrometheusMatrixEnvelope, warning string) {
+	w.Header().Set(hnStale, "true")
+	pe.Warnings = mergeWarnings(pe.Warnings, warning)
+}
@@ -0,0 +1,166 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	cb := tr.getCircuitBreaker(PrometheusOriginConfig{OriginURL: nonexistantOrigin, CircuitBreakerFailures: 2})
+
+	// it should stay closed until the failure threshold is reached
+	cb.record(false)
+	if !cb.allow() {
+		t.Fatal("expected breaker to be closed after 1 failure")
+	}
+	cb.record(false)
+	if cb.allow() {
+		t.Fatal("expected breaker to be open after 2 failures")
+	}
+
+	// it should let a single probe through once the open duration has passed
+	cb.openedAt = time.Now().Add(-cb.OpenDuration)
+	if !cb.allow() {
+		t.Fatal("expected breaker to allow a probe")
+	}
+	if cb.allow() {
+		t.Fatal("expected breaker to allow only one probe")
+	}
+
+	// it should close when the probe succeeds
+	cb.record(true)
+	if !cb.allow() || cb.state != cbClosed {
+		t.Fatal("expected breaker to be closed after a successful probe")
+	}
+}
+
+func TestCircuitBreaker_disabled(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	// it should not create a breaker when none is configured, and a nil breaker should allow everything
+	cb := tr.getCircuitBreaker(PrometheusOriginConfig{OriginURL: nonexistantOrigin})
+	if cb != nil {
+		t.Fatal("expected no breaker")
+	}
+	cb.record(false)
+	if !cb.allow() {
+		t.Fatal("expected nil breaker to allow requests")
+	}
+}
+
+func TestTricksterHandler_getURL_circuitOpen(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	o := PrometheusOriginConfig{OriginURL: nonexistantOrigin, CircuitBreakerFailures: 1}
+
+	if _, _, _, err := tr.getURL(context.Background(), o, "GET", nonexistantOrigin, url.Values{}, nil); err == nil || err == errCircuitOpen {
+		t.Fatalf("expected a download error, got %v", err)
+	}
+
+	// it should not attempt the request once the breaker has opened
+	if _, _, _, err := tr.getURL(context.Background(), o, "GET", nonexistantOrigin, url.Values{}, nil); err != errCircuitOpen {
+		t.Fatalf("expected %v, got %v", errCircuitOpen, err)
+	}
+}
+
+func TestTricksterHandler_getURL_halfOpenProbeCanceled(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es := newTestServer(exampleRangeResponse)
+	defer es.Close()
+
+	o := PrometheusOriginConfig{OriginURL: es.URL, CircuitBreakerFailures: 1, MaxConcurrentOriginRequests: 1}
+
+	// open the breaker, and let it probe the origin
+	cb := tr.getCircuitBreaker(o)
+	cb.record(false)
+	cb.openedAt = time.Now().Add(-cb.OpenDuration)
+
+	// a request that is canceled while waiting for a slot should not use up the probe
+	rl := tr.getRateLimiter(o)
+	if err := rl.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, _, err := tr.getURL(ctx, o, "GET", es.URL, url.Values{}, nil); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	rl.release()
+
+	if _, _, _, err := tr.getURL(context.Background(), o, "GET", es.URL, url.Values{}, nil); err != nil {
+		t.Fatalf("expected the probe to succeed, got %v", err)
+	}
+	if cb.state != cbClosed {
+		t.Errorf("wanted the breaker closed got state %d.", cb.state)
+	}
+}
+
+func TestTricksterHandler_promQueryRangeHandler_serveStaleOnError(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es := newTestServer(exampleRangeResponse)
+	tr.setTestOrigin(es.URL)
+
+	// keep the 2015 example data from being aged out of the cache
+	o := tr.Config.Origins["default"]
+	o.MaxValueAgeSecs = time.Now().Unix()
+	o.ServeStaleOnError = true
+	o.FastForwardDisable = true
+	tr.Config.Origins["default"] = o
+
+	// populate the cache
+	w := httptest.NewRecorder()
+	tr.promQueryRangeHandler(w, httptest.NewRequest("GET", es.URL+exampleRangeQuery, nil))
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("wanted 200 got %d.", w.Result().StatusCode)
+	}
+
+	// take the origin down, and request a range that is only partially cached
+	es.Close()
+
+	w = httptest.NewRecorder()
+	tr.promQueryRangeHandler(w, httptest.NewRequest("GET", es.URL+"/api/v1/query_range?query=up&start=2015-07-01T20:09:30.781Z&end=2015-07-01T20:11:00.781Z&step=15", nil))
+
+	// it should serve the cached data with a header and warning indicating it is stale
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("wanted 200 got %d.", w.Result().StatusCode)
+	}
+	if w.Result().Header.Get(hnStale) != "true" {
+		t.Errorf("expected %s header", hnStale)
+	}
+
+	pe := PrometheusMatrixEnvelope{}
+	if err := json.Unmarshal(w.Body.Bytes(), &pe); err != nil {
+		t.Fatal(err)
+	}
+	if pe.getValueCount() != 6 {
+		t.Errorf("wanted 6 values got %d.", pe.getValueCount())
+	}
+	if len(pe.Warnings) != 1 || pe.Warnings[0] != twStale {
+		t.Errorf("wanted the stale warning got %v.", pe.Warnings)
+	}
+}
@@ -0,0 +1,183 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// Cache compression codecs
+	ccNone   = "none"
+	ccSnappy = "snappy"
+	ccZstd   = "zstd"
+	ccGzip   = "gzip"
+
+	// cacheRecordMagic is the first byte of a cache record with a codec header. It is followed by a byte identifying the codec
+	cacheRecordMagic = 0x7f
+)
+
+// cacheCodecIDs are the header bytes identifying the codec of a cache record. They must never be changed or reused
+var cacheCodecIDs = map[string]byte{
+	ccNone:   0x00,
+	ccSnappy: 0x01,
+	ccZstd:   0x02,
+	ccGzip:   0x03,
+}
+
+// CompressionCodec is the codec used to compress cache records. In configuration files, it may also be set
+// to a boolean for compatibility with older configurations: true is snappy and false is none
+type CompressionCodec string
+
+// UnmarshalTOML parses the codec from either a string or a boolean
+func (c *CompressionCodec) UnmarshalTOML(v interface{}) error {
+	switch value := v.(type) {
+	case bool:
+		if value {
+			*c = ccSnappy
+		} else {
+			*c = ccNone
+		}
+	case string:
+		codec := strings.ToLower(value)
+		if _, ok := cacheCodecIDs[codec]; !ok {
+			return fmt.Errorf("invalid compression codec %q", value)
+		}
+		*c = CompressionCodec(codec)
+	default:
+		return fmt.Errorf("invalid compression value %v", v)
+	}
+	return nil
+}
+
+var (
+	zstdEncoder     *zstd.Encoder
+	zstdDecoder     *zstd.Decoder
+	zstdInit        sync.Once
+	errZstdNotReady error
+)
+
+// initZstd creates the shared zstd encoder and decoder, which are safe for concurrent use
+func initZstd() {
+	zstdInit.Do(func() {
+		var err error
+		if zstdEncoder, err = zstd.NewWriter(nil); err != nil {
+			errZstdNotReady = err
+			return
+		}
+		if zstdDecoder, err = zstd.NewReader(nil); err != nil {
+			errZstdNotReady = err
+		}
+	})
+}
+
+// compress compresses data with the provided codec
+func compress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case ccSnappy:
+		return snappy.Encode(nil, data), nil
+	case ccZstd:
+		if initZstd(); errZstdNotReady != nil {
+			return nil, errZstdNotReady
+		}
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case ccGzip:
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return data, nil
+	}
+}
+
+// decompress decompresses data compressed with the codec identified by the provided header byte
+func decompress(id byte, data []byte) ([]byte, error) {
+	switch id {
+	case cacheCodecIDs[ccNone]:
+		return data, nil
+	case cacheCodecIDs[ccSnappy]:
+		return snappy.Decode(nil, data)
+	case cacheCodecIDs[ccZstd]:
+		if initZstd(); errZstdNotReady != nil {
+			return nil, errZstdNotReady
+		}
+		return zstdDecoder.DecodeAll(data, nil)
+	case cacheCodecIDs[ccGzip]:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	default:
+		return nil, fmt.Errorf("unknown cache record codec %d", id)
+	}
+}
+
+// encodeCacheRecord compresses data with the configured codec and prepends the header identifying the codec
+func (t *TricksterHandler) encodeCacheRecord(data []byte) ([]byte, error) {
+	codec := string(t.Config.Caching.Compression)
+	if _, ok := cacheCodecIDs[codec]; !ok {
+		codec = ccNone
+	}
+
+	compressed, err := compress(codec, data)
+	if err != nil {
+		return nil, err
+	}
+
+	record := make([]byte, 0, len(compressed)+2)
+	record = append(record, cacheRecordMagic, cacheCodecIDs[codec])
+	record = append(record, compressed...)
+
+	if t.Metrics != nil {
+		t.Metrics.CacheRawBytes.WithLabelValues(codec).Add(float64(len(data)))
+		t.Metrics.CacheStoredBytes.WithLabelValues(codec).Add(float64(len(record)))
+	}
+
+	return record, nil
+}
+
+// decodeCacheRecord returns the decompressed payload of a cache record. Records written before codec headers were
+// introduced are returned as-is if they look like JSON or a binary matrix, and are otherwise assumed to be snappy
+func decodeCacheRecord(data []byte) []byte {
+	if len(data) >= 2 && data[0] == cacheRecordMagic {
+		if payload, err := decompress(data[1], data[2:]); err == nil {
+			return payload
+		}
+		// a legacy snappy record may begin with the magic byte, so fall through and try it as one
+	}
+
+	if len(data) > 0 && data[0] != '{' && data[0] != matrixCodecMagic {
+		if payload, err := snappy.Decode(nil, data); err == nil {
+			return payload
+		}
+	}
+
+	return data
+}
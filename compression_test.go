@@ -0,0 +1,94 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/golang/snappy"
+)
+
+func TestCompressionCodec_UnmarshalTOML(t *testing.T) {
+	tests := []struct {
+		config   string
+		expected CompressionCodec
+		err      bool
+	}{
+		{"compression = true", ccSnappy, false},
+		{"compression = false", ccNone, false},
+		{"compression = 'zstd'", ccZstd, false},
+		{"compression = 'GZIP'", ccGzip, false},
+		{"compression = 'none'", ccNone, false},
+		{"compression = 'lz4'", "", true},
+		{"compression = 1", "", true},
+	}
+
+	for _, test := range tests {
+		c := CachingConfig{}
+		_, err := toml.Decode(test.config, &c)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.config)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.config, err)
+		} else if c.Compression != test.expected {
+			t.Errorf("%s: wanted %q got %q", test.config, test.expected, c.Compression)
+		}
+	}
+}
+
+func TestTricksterHandler_encodeCacheRecord(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	data := bytes.Repeat([]byte(exampleRangeResponse), 10)
+
+	for codec := range cacheCodecIDs {
+		tr.Config.Caching.Compression = CompressionCodec(codec)
+
+		record, err := tr.encodeCacheRecord(data)
+		if err != nil {
+			t.Fatalf("%s: %v", codec, err)
+		}
+		if record[0] != cacheRecordMagic || record[1] != cacheCodecIDs[codec] {
+			t.Errorf("%s: unexpected header %v", codec, record[:2])
+		}
+		if codec != ccNone && len(record) >= len(data) {
+			t.Errorf("%s: expected record to be compressed", codec)
+		}
+
+		// it should decode records of any codec, regardless of the configured codec
+		tr.Config.Caching.Compression = ccNone
+		if !bytes.Equal(decodeCacheRecord(record), data) {
+			t.Errorf("%s: decoded record does not match", codec)
+		}
+	}
+}
+
+func TestDecodeCacheRecord_legacy(t *testing.T) {
+	data := []byte(exampleRangeResponse)
+
+	// it should read records written before codec headers were added
+	if !bytes.Equal(decodeCacheRecord(data), data) {
+		t.Error("uncompressed record does not match")
+	}
+	if !bytes.Equal(decodeCacheRecord(snappy.Encode(nil, data)), data) {
+		t.Error("snappy record does not match")
+	}
+}
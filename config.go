@@ -13,7 +13,12 @@
 
 package main
 
-import "github.com/BurntSushi/toml"
+import (
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
 
 // Config is the main configuration object
 type Config struct {
@@ -45,6 +50,25 @@ type ProxyServerConfig struct {
 	ListenAddress string `toml:"listen_address"`
 	// ListenPort is TCP Port for the main http listener for the application
 	ListenPort int `toml:"listen_port"`
+	// TLSCertFile is the path to the certificate served by the listener. When set with TLSKeyFile, the listener uses TLS
+	TLSCertFile string `toml:"tls_cert_file"`
+	// TLSKeyFile is the path to the private key of TLSCertFile
+	TLSKeyFile string `toml:"tls_key_file"`
+	// TLSClientCAFile is the path to the CA certificates used to verify client certificates for mTLS authentication
+	TLSClientCAFile string `toml:"tls_client_ca_file"`
+	// Auth is the authentication required of clients of the listener
+	Auth ProxyAuthConfig `toml:"auth"`
+}
+
+// ProxyAuthConfig is a collection of configurations for authenticating clients of the main http listener.
+// When any are set, clients must present at least one valid credential
+type ProxyAuthConfig struct {
+	// BearerTokens lists the static tokens accepted in an "Authorization: Bearer" header
+	BearerTokens []string `toml:"bearer_tokens"`
+	// HtpasswdFile is the path to an htpasswd file of the users accepted with HTTP basic auth. bcrypt and {SHA} hashes are supported
+	HtpasswdFile string `toml:"htpasswd_file"`
+	// ClientCertSubjects lists the common names or full subjects of the client certificates accepted with mTLS
+	ClientCertSubjects []string `toml:"client_cert_subjects"`
 }
 
 // CachingConfig is a collection of defining the Trickster Caching Behavior
@@ -55,8 +79,10 @@ type CachingConfig struct {
 	Redis         RedisCacheConfig      `toml:"redis"`
 	Filesystem    FilesystemCacheConfig `toml:"filesystem"`
 	ReapSleepMS   int64                 `toml:"reap_sleep_ms"`
-	Compression   bool                  `toml:"compression"`
+	Compression   CompressionCodec      `toml:"compression"`
 	BoltDB        BoltDBCacheConfig     `toml:"boltdb"`
+	// Serialization is the format cached query_range results are stored in: "binary" (default) or "json"
+	Serialization string `toml:"serialization"`
 }
 
 // RedisCacheConfig is a collection of Configurations for Connecting to Redis
@@ -93,6 +119,124 @@ type PrometheusOriginConfig struct {
 	FastForwardDisable  bool   `toml:"fast_forward_disable"`
 	NoCacheLastDataSecs int64  `toml:"no_cache_last_data_secs"`
 	TimeoutSecs         int64  `toml:"timeout_secs"`
+
+	// FastForward selects how the latest point is added to real-time query_range responses: "append-unaligned" (default, or
+	// "append") adds it at its own time, truncated to the second, "snap" adds it at the next step boundary, and "off" disables
+	// it, as does FastForwardDisable
+	FastForward string `toml:"fast_forward"`
+
+	// BackfillToleranceSecs is the window before now in which cached points may still change. Cached points within the window
+	// are served, but are re-fetched and overwritten by every request that touches them. 0 (default) disables the window
+	BackfillToleranceSecs int64 `toml:"backfill_tolerance_secs"`
+
+	// EnableAdminAPI allows requests to the Prometheus admin API (/api/v1/admin/) to be proxied to the origin
+	EnableAdminAPI bool `toml:"enable_admin_api"`
+
+	// ForwardHeaders lists the client request headers that are passed through to the origin. Default is Authorization
+	ForwardHeaders []string `toml:"forward_headers"`
+	// InjectHeaders are headers set to static values on every request to the origin, replacing any client values
+	InjectHeaders map[string]string `toml:"inject_headers"`
+
+	// CacheKeyHeaders lists the client request headers whose values are part of the cache key. Default is Authorization
+	CacheKeyHeaders []string `toml:"cache_key_headers"`
+	// CacheKeyParams lists URL parameters, in addition to the query, time and step, whose values are part of the cache key
+	CacheKeyParams []string `toml:"cache_key_params"`
+	// NormalizeQueries parses each query with the PromQL parser and uses its canonical form in the cache key,
+	// so that semantically identical queries written differently share cached data
+	NormalizeQueries bool `toml:"normalize_queries"`
+	// OffsetAwareCaching serves query_range queries whose selectors all share an offset from the cache of the query
+	// without the offset, shifting the timestamps of the results. It implies NormalizeQueries
+	OffsetAwareCaching bool `toml:"offset_aware_caching"`
+	// DownsampleSteps lists finer steps, in seconds, whose cached query_range results may answer requests for a
+	// coarser step that is a multiple of them, by picking the points on the coarser step's boundaries
+	DownsampleSteps []int64 `toml:"downsample_steps"`
+
+	// MaxOriginRangeSecs splits the ranges of a query_range request that are fetched from the origin into requests covering
+	// at most this many seconds, so that long cold queries don't time out. 0 (default) sends each range as a single request
+	MaxOriginRangeSecs int64 `toml:"max_origin_range_secs"`
+	// SplitConcurrency is the maximum number of split requests for a client request in flight to the origin at once. Default is 4
+	SplitConcurrency int `toml:"split_concurrency"`
+
+	// ChunkSizeSecs splits each query_range cache record into chunks of this many seconds, so that requests only
+	// read and rewrite the chunks they need. 0 (default) stores each query as a single record
+	ChunkSizeSecs int64 `toml:"chunk_size_secs"`
+
+	// InstantQueryPolicy configures how the time param of /query requests is rounded and how long their results are cached
+	InstantQueryPolicy InstantQueryPolicy `toml:"instant_query_policy"`
+
+	// MetadataTTLSecs is how long responses from the "labels", "label_values" and "series" endpoints are cached,
+	// keyed by endpoint. Default is 60 for each; 0 disables caching for the endpoint
+	MetadataTTLSecs map[string]int64 `toml:"metadata_ttl_secs"`
+	// MetadataGranularitySecs widens the start and end params of metadata requests to multiples of this many seconds,
+	// so that repeated requests share a cache key. Default is 60
+	MetadataGranularitySecs int64 `toml:"metadata_granularity_secs"`
+
+	// OriginURLs lists the upstream replicas serving this origin. When set, requests are
+	// distributed across the replicas according to LoadBalancing, and OriginURL (which
+	// defaults to the first replica) is used only to identify the origin in cache keys and metrics
+	OriginURLs []string `toml:"origin_urls"`
+	// LoadBalancing selects how requests are distributed across OriginURLs: "first_healthy" (default), "round_robin" or "hedged"
+	LoadBalancing string `toml:"load_balancing"`
+	// HealthCheckIntervalSecs is how often each upstream is actively probed. Default is 10
+	HealthCheckIntervalSecs int64 `toml:"health_check_interval_secs"`
+	// MaxUpstreamFailures is the number of consecutive failures after which an upstream is ejected until it passes a health check. Default is 3
+	MaxUpstreamFailures int `toml:"max_upstream_failures"`
+	// HedgeDelayMS is how long a hedged request waits on an upstream before also sending the request to the next one. Default is 250
+	HedgeDelayMS int64 `toml:"hedge_delay_ms"`
+
+	// OriginType is the type of origin: "prometheus" (default) or "fanout"
+	OriginType string `toml:"origin_type"`
+	// FanoutOrigins lists the names of the origins that a "fanout" origin sends each query to
+	FanoutOrigins []string `toml:"fanout_origins"`
+
+	// CircuitBreakerFailures is the number of consecutive failed origin requests that open the origin's circuit breaker. 0 disables the breaker
+	CircuitBreakerFailures int `toml:"circuit_breaker_failures"`
+	// CircuitBreakerOpenSecs is how long an open circuit breaker rejects requests before probing the origin again. Default is 30
+	CircuitBreakerOpenSecs int64 `toml:"circuit_breaker_open_secs"`
+	// ServeStaleOnError serves whatever cached data is available for a query_range request when the origin fails or its circuit breaker is open
+	ServeStaleOnError bool `toml:"serve_stale_on_error"`
+
+	// RateLimitRPS is the number of requests per second accepted for the origin from all clients combined. 0 disables the limit
+	RateLimitRPS float64 `toml:"rate_limit_rps"`
+	// RateLimitBurst is the number of requests accepted in a burst above RateLimitRPS. Default is RateLimitRPS, rounded up
+	RateLimitBurst int `toml:"rate_limit_burst"`
+	// ClientRateLimitRPS is the number of requests per second accepted for the origin from each client. 0 disables the limit
+	ClientRateLimitRPS float64 `toml:"client_rate_limit_rps"`
+	// ClientRateLimitBurst is the number of requests accepted from a client in a burst above ClientRateLimitRPS. Default is ClientRateLimitRPS, rounded up
+	ClientRateLimitBurst int `toml:"client_rate_limit_burst"`
+	// ClientRateLimitKey identifies clients for ClientRateLimitRPS: "ip" (default) or "authorization"
+	ClientRateLimitKey string `toml:"client_rate_limit_key"`
+	// MaxConcurrentOriginRequests is the maximum number of requests in flight to the origin at once; others wait for a free slot. 0 is unlimited
+	MaxConcurrentOriginRequests int `toml:"max_concurrent_origin_requests"`
+
+	// OriginBearerToken is sent as a bearer token with every request to the origin, in place of any client credentials
+	OriginBearerToken string `toml:"origin_bearer_token"`
+	// OriginUsername and OriginPassword are sent as HTTP basic auth with every request to the origin, in place of any client credentials
+	OriginUsername string `toml:"origin_username"`
+	OriginPassword string `toml:"origin_password"`
+}
+
+// InstantQueryPolicy is a collection of configurations for caching instantaneous query results
+type InstantQueryPolicy struct {
+	// RoundSecs rounds the time param down to a multiple of this many seconds, so that nearby requests share a cache key. Default is 15
+	RoundSecs int64 `toml:"round_secs"`
+	// DisableRounding caches each requested time separately, so that results are always evaluated at the exact time requested
+	DisableRounding bool `toml:"disable_rounding"`
+	// TTLSecs is how long results are cached when no age rule applies. Default is 15
+	TTLSecs int64 `toml:"ttl_secs"`
+	// AgeRules set the TTL of results by the age of the time param. The first matching rule applies. Default is a
+	// single rule caching times on a half-hour boundary that are at least 30 minutes old for 1800 seconds
+	AgeRules []InstantQueryAgeRule `toml:"age_rules"`
+}
+
+// InstantQueryAgeRule sets the TTL of instantaneous query results for times of a minimum age
+type InstantQueryAgeRule struct {
+	// MinAgeSecs is the minimum age of the time param, relative to now, for the rule to apply
+	MinAgeSecs int64 `toml:"min_age_secs"`
+	// AlignSecs limits the rule to times that are a multiple of this many seconds (e.g., 3600 for hourly rollups). 0 matches any time
+	AlignSecs int64 `toml:"align_secs"`
+	// TTLSecs is how long results are cached when the rule applies
+	TTLSecs int64 `toml:"ttl_secs"`
 }
 
 // MetricsConfig is a collection of Metrics Collection configurations
@@ -135,8 +279,9 @@ func NewConfig() *Config {
 			Filesystem: FilesystemCacheConfig{CachePath: defaultCachePath},
 			BoltDB:     BoltDBCacheConfig{Filename: defaultBoltDBFile, Bucket: "trickster"},
 
-			ReapSleepMS: 1000,
-			Compression: true,
+			ReapSleepMS:   1000,
+			Compression:   ccSnappy,
+			Serialization: csBinary,
 		},
 		Logging: LoggingConfig{
 			LogFile:  "",
@@ -174,6 +319,48 @@ func defaultOriginConfig() PrometheusOriginConfig {
 
 // LoadFile loads application configuration from a TOML-formatted file.
 func (c *Config) LoadFile(path string) error {
-	_, err := toml.DecodeFile(path, &c)
-	return err
+	if _, err := toml.DecodeFile(path, &c); err != nil {
+		return err
+	}
+	return c.validate()
+}
+
+// validate returns an error if a configuration value is not one of the values it accepts
+func (c *Config) validate() error {
+	if !oneOf(c.Caching.CacheType, ctMemory, ctFilesystem, ctBoltDB, ctRedis) {
+		return fmt.Errorf("unknown cache_type %q", c.Caching.CacheType)
+	}
+	if _, ok := cacheCodecIDs[string(c.Caching.Compression)]; !ok && c.Caching.Compression != "" {
+		return fmt.Errorf("unknown compression %q", c.Caching.Compression)
+	}
+	if !oneOf(c.Caching.Serialization, "", csBinary, csJSON) {
+		return fmt.Errorf("unknown serialization %q", c.Caching.Serialization)
+	}
+
+	for name, o := range c.Origins {
+		if _, ok := fastForwardModes[o.FastForward]; !ok {
+			return fmt.Errorf("origin %s: unknown fast_forward %q", name, o.FastForward)
+		}
+		if !oneOf(o.OriginType, "", otPrometheus, otFanout) {
+			return fmt.Errorf("origin %s: unknown origin_type %q", name, o.OriginType)
+		}
+		if !oneOf(o.LoadBalancing, "", lbFirstHealthy, lbRoundRobin, lbHedged) {
+			return fmt.Errorf("origin %s: unknown load_balancing %q", name, o.LoadBalancing)
+		}
+		// client_rate_limit_key is case-insensitive
+		if !oneOf(strings.ToLower(o.ClientRateLimitKey), "", rlkIP, rlkAuthorization) {
+			return fmt.Errorf("origin %s: unknown client_rate_limit_key %q", name, o.ClientRateLimitKey)
+		}
+	}
+	return nil
+}
+
+// oneOf returns true if the value is one of the provided options
+func oneOf(value string, options ...string) bool {
+	for _, option := range options {
+		if value == option {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,105 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"strconv"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
+)
+
+// downsampleFromCache answers a range request that isn't fully cached from the cached results of the same query
+// at one of the origin's downsample steps, when the finer step divides the request's step and its cached results
+// cover the whole request. It returns true if the request's matrix was filled from the finer step's results
+func (t *TricksterHandler) downsampleFromCache(ctx *ClientRequestContext) bool {
+	query, ok := ctx.RequestParams[upQuery]
+	if !ok || len(query) == 0 || !downsampleable(query[0]) {
+		return false
+	}
+
+	// Cached points within the backfill tolerance window are re-fetched, so they can't be served from another step
+	if ctx.Origin.BackfillToleranceSecs > 0 && ctx.RequestExtents.End >= (ctx.Time-ctx.Origin.BackfillToleranceSecs)*1000 {
+		return false
+	}
+
+	for _, secs := range ctx.Origin.DownsampleSteps {
+		stepMS := secs * 1000
+		if stepMS <= 0 || stepMS >= ctx.StepMS || ctx.StepMS%stepMS != 0 {
+			continue
+		}
+
+		fine := &ClientRequestContext{
+			Origin:         ctx.Origin,
+			RequestParams:  ctx.RequestParams,
+			RequestExtents: ctx.RequestExtents,
+			StepParam:      strconv.FormatInt(secs, 10),
+			StepMS:         stepMS,
+			Time:           ctx.Time,
+		}
+		fine.CacheKey = rangeCacheKey(ctx.Origin, stepMS, ctx.Request.Header, ctx.RequestParams)
+
+		pe, err := t.retrieveRangeMatrix(fine)
+		if err != nil || len(pe.cachedExtents().missing(ctx.RequestExtents, stepMS)) > 0 {
+			continue
+		}
+
+		level.Debug(t.Logger).Log(lfEvent, "downsampledCacheHit", lfCacheKey, ctx.CacheKey, "sourceCacheKey", fine.CacheKey, "sourceStep", secs)
+		ctx.Matrix = pe.downsample(ctx.StepMS)
+		ctx.Matrix.cropToRange(ctx.RequestExtents.Start, ctx.RequestExtents.End)
+		ctx.OriginExtents = ExtentList{}
+		ctx.CacheLookupResult = crDownsampleHit
+		return true
+	}
+
+	return false
+}
+
+// retrieveRangeMatrix loads the cached matrix for the request's cache key
+func (t *TricksterHandler) retrieveRangeMatrix(ctx *ClientRequestContext) (PrometheusMatrixEnvelope, error) {
+	if ctx.Origin.ChunkSizeSecs > 0 {
+		return t.retrieveChunks(ctx)
+	}
+
+	pe := PrometheusMatrixEnvelope{}
+	data, err := t.Cacher.Retrieve(ctx.CacheKey)
+	if err != nil {
+		return pe, err
+	}
+	err = decodeCacheMatrix(data, &pe)
+	return pe, err
+}
+
+// downsample returns a matrix of the points in the matrix that fall on the boundaries of the coarser step stepMS.
+// Series with no such points are dropped
+func (pe PrometheusMatrixEnvelope) downsample(stepMS int64) PrometheusMatrixEnvelope {
+	out := pe
+	out.Data.Result = make(model.Matrix, 0, len(pe.Data.Result))
+
+	for _, s := range pe.Data.Result {
+		values := make([]model.SamplePair, 0, len(s.Values)/2+1)
+		for _, v := range s.Values {
+			if int64(v.Timestamp)%stepMS == 0 {
+				values = append(values, v)
+			}
+		}
+		if len(values) > 0 {
+			out.Data.Result = append(out.Data.Result, &model.SampleStream{Metric: s.Metric, Values: values})
+		}
+	}
+
+	out.Data.Histograms = pe.Data.Histograms.filter(func(ts int64) bool { return ts%stepMS == 0 })
+
+	return out
+}
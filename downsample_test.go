@@ -0,0 +1,89 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTricksterHandler_promQueryRangeHandler_downsample(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es, requests := newSelectorTestServer()
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	// keep the 2015 test times from being aged out of the cache
+	o := tr.Config.Origins["default"]
+	o.MaxValueAgeSecs = time.Now().Unix()
+	o.FastForwardDisable = true
+	o.DownsampleSteps = []int64{15}
+	tr.Config.Origins["default"] = o
+
+	const start = 1435781520 // a multiple of each step, so the origin and Trickster evaluate at the same times
+	query := func(step string, start, end int64) {
+		path := "/api/v1/query_range?query=up&step=" + step +
+			"&start=" + strconv.FormatInt(start, 10) + "&end=" + strconv.FormatInt(end, 10)
+
+		// the origin's own response, without Trickster
+		resp, err := http.Get(es.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		<-requests
+		want := PrometheusMatrixEnvelope{}
+		if err := json.NewDecoder(resp.Body).Decode(&want); err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		tr.promQueryRangeHandler(w, httptest.NewRequest("GET", es.URL+path, nil))
+		got := PrometheusMatrixEnvelope{}
+		if err := json.NewDecoder(w.Result().Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.Data.Result, want.Data.Result) {
+			t.Errorf("step %s: wanted %v got %v.", step, want.Data.Result, got.Data.Result)
+		}
+	}
+
+	query("15s", start, start+600)
+	if len(requests) != 1 {
+		t.Fatalf("wanted 1 origin request got %d.", len(requests))
+	}
+	<-requests
+
+	// it should answer the same step in another format, and coarser steps that are multiples of the cached step,
+	// from its cache
+	query("15", start, start+600)
+	query("60", start, start+600)
+	query("45s", start, start+540)
+	if len(requests) != 0 {
+		t.Errorf("wanted the requests served from cache got %d origin requests.", len(requests))
+	}
+
+	// it should fetch steps that aren't multiples of the cached step, and ranges that aren't fully cached
+	query("20", start, start+600)
+	query("60", start-600, start+600)
+	if len(requests) != 2 {
+		t.Errorf("wanted 2 origin requests got %d.", len(requests))
+	}
+}
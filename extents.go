@@ -0,0 +1,196 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"sort"
+
+	"github.com/prometheus/common/model"
+)
+
+// ExtentList is a sorted list of non-overlapping extents, such as the time ranges of a cached query that were
+// fetched from the origin. Extents are inclusive of their start and end times, in milliseconds
+type ExtentList []MatrixExtents
+
+// add returns the list with the extents e included, coalescing any extents that overlap or that are
+// within a step of each other. The receiver is not modified
+func (el ExtentList) add(e MatrixExtents, stepMS int64) ExtentList {
+	out := make(ExtentList, 0, len(el)+1)
+
+	for _, x := range el {
+		switch {
+		case x.End+stepMS < e.Start:
+			out = append(out, x)
+		case e.End+stepMS < x.Start:
+			out = append(out, e)
+			e = x
+		default:
+			if x.Start < e.Start {
+				e.Start = x.Start
+			}
+			if x.End > e.End {
+				e.End = x.End
+			}
+		}
+	}
+
+	return append(out, e)
+}
+
+// crop returns the parts of the list between start and end, inclusive. A start or end of 0 is unbounded
+func (el ExtentList) crop(start, end int64) ExtentList {
+	out := make(ExtentList, 0, len(el))
+
+	for _, x := range el {
+		if start > 0 && x.Start < start {
+			x.Start = start
+		}
+		if end > 0 && x.End > end {
+			x.End = end
+		}
+		if x.Start <= x.End {
+			out = append(out, x)
+		}
+	}
+
+	return out
+}
+
+// missing returns the step-aligned ranges of the requested extents that are not in the list
+func (el ExtentList) missing(req MatrixExtents, stepMS int64) ExtentList {
+	out := make(ExtentList, 0)
+
+	cursor := req.Start
+	for _, x := range el {
+		if x.End < cursor {
+			continue
+		}
+		if x.Start > req.End {
+			break
+		}
+		if x.Start > cursor {
+			out = append(out, MatrixExtents{Start: cursor, End: x.Start - stepMS})
+		}
+		cursor = x.End + stepMS
+	}
+
+	if cursor <= req.End {
+		out = append(out, MatrixExtents{Start: cursor, End: req.End})
+	}
+
+	return out
+}
+
+// split returns the list with each extent broken into consecutive extents covering at most maxMS, aligned to the step
+func (el ExtentList) split(maxMS, stepMS int64) ExtentList {
+	size := (maxMS / stepMS) * stepMS
+	if size < stepMS {
+		size = stepMS
+	}
+
+	out := make(ExtentList, 0, len(el))
+	for _, x := range el {
+		for start := x.Start; start <= x.End; start += size {
+			end := start + size - stepMS
+			if end > x.End {
+				end = x.End
+			}
+			out = append(out, MatrixExtents{Start: start, End: end})
+		}
+	}
+
+	return out
+}
+
+// contains returns true if the timestamp ts is within any of the extents in the list
+func (el ExtentList) contains(ts int64) bool {
+	i := sort.Search(len(el), func(i int) bool { return el[i].End >= ts })
+	return i < len(el) && el[i].Start <= ts
+}
+
+// fillMatrix merges matrices fetched from the origin for the extents in fetched into the cached matrix, replacing any
+// cached points within those extents, and returns the merged matrix. Unlike mergeMatrix, the fetched data can fall
+// anywhere relative to the cached data, such as in a gap in the middle of it. The merged matrix only carries the
+// warnings of the fetched matrices, as warnings describe a single evaluation. The cached matrix is not modified
+func fillMatrix(cached PrometheusMatrixEnvelope, fetched []PrometheusMatrixEnvelope, extents ExtentList) PrometheusMatrixEnvelope {
+	out := PrometheusMatrixEnvelope{
+		Status: cached.Status,
+		Data: PrometheusMatrixData{
+			ResultType: cached.Data.ResultType,
+			Result:     make(model.Matrix, 0, len(cached.Data.Result)),
+		},
+		Extents: cached.Extents,
+	}
+
+	series := make(map[model.Fingerprint]*model.SampleStream)
+	for _, s := range cached.Data.Result {
+		values := make([]model.SamplePair, 0, len(s.Values))
+		for _, v := range s.Values {
+			if !extents.contains(int64(v.Timestamp)) {
+				values = append(values, v)
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+		stream := &model.SampleStream{Metric: s.Metric, Values: values}
+		series[s.Metric.Fingerprint()] = stream
+		out.Data.Result = append(out.Data.Result, stream)
+	}
+
+	for _, pe := range fetched {
+		if pe.Status != rvSuccess {
+			continue
+		}
+		out.Status = rvSuccess
+		out.Data.ResultType = pe.Data.ResultType
+		out.Warnings = mergeWarnings(out.Warnings, pe.Warnings...)
+
+		for _, s := range pe.Data.Result {
+			stream, ok := series[s.Metric.Fingerprint()]
+			if !ok {
+				stream = &model.SampleStream{Metric: s.Metric}
+				series[s.Metric.Fingerprint()] = stream
+				out.Data.Result = append(out.Data.Result, stream)
+			}
+			stream.Values = append(stream.Values, s.Values...)
+		}
+	}
+
+	for _, s := range out.Data.Result {
+		sort.SliceStable(s.Values, func(i, j int) bool { return s.Values[i].Timestamp < s.Values[j].Timestamp })
+	}
+
+	histograms := make([]HistogramMatrix, 0, len(fetched))
+	for _, pe := range fetched {
+		if pe.Status == rvSuccess {
+			histograms = append(histograms, pe.Data.Histograms)
+		}
+	}
+	out.Data.Histograms = fillHistograms(cached.Data.Histograms, histograms, extents)
+
+	return out
+}
+
+// cachedExtents returns the extents of the cached matrix that were fetched from the origin. Records cached before
+// extents were tracked are treated as having been fetched for the whole range of their data
+func (pe PrometheusMatrixEnvelope) cachedExtents() ExtentList {
+	if pe.Extents != nil {
+		return pe.Extents
+	}
+	if e := pe.getExtents(); e.Start != 0 && e.End != 0 {
+		return ExtentList{e}
+	}
+	return ExtentList{}
+}
@@ -0,0 +1,291 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestExtentList_add(t *testing.T) {
+	el := ExtentList{{Start: 100, End: 200}, {Start: 500, End: 600}}
+
+	tests := []struct {
+		e    MatrixExtents
+		want ExtentList
+	}{
+		// before, between and after
+		{MatrixExtents{Start: 0, End: 50}, ExtentList{{Start: 0, End: 50}, {Start: 100, End: 200}, {Start: 500, End: 600}}},
+		{MatrixExtents{Start: 300, End: 400}, ExtentList{{Start: 100, End: 200}, {Start: 300, End: 400}, {Start: 500, End: 600}}},
+		{MatrixExtents{Start: 700, End: 800}, ExtentList{{Start: 100, End: 200}, {Start: 500, End: 600}, {Start: 700, End: 800}}},
+		// overlapping and within a step
+		{MatrixExtents{Start: 150, End: 250}, ExtentList{{Start: 100, End: 250}, {Start: 500, End: 600}}},
+		{MatrixExtents{Start: 210, End: 490}, ExtentList{{Start: 100, End: 600}}},
+		{MatrixExtents{Start: 0, End: 1000}, ExtentList{{Start: 0, End: 1000}}},
+	}
+
+	for _, test := range tests {
+		if got := el.add(test.e, 10); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("adding %v: wanted %v got %v.", test.e, test.want, got)
+		}
+	}
+
+	// it should not modify the receiver
+	if !reflect.DeepEqual(el, ExtentList{{Start: 100, End: 200}, {Start: 500, End: 600}}) {
+		t.Errorf("receiver was modified: %v", el)
+	}
+}
+
+func TestExtentList_crop(t *testing.T) {
+	el := ExtentList{{Start: 100, End: 200}, {Start: 500, End: 600}}
+
+	tests := []struct {
+		start, end int64
+		want       ExtentList
+	}{
+		{0, 0, el},
+		{150, 0, ExtentList{{Start: 150, End: 200}, {Start: 500, End: 600}}},
+		{0, 550, ExtentList{{Start: 100, End: 200}, {Start: 500, End: 550}}},
+		{300, 400, ExtentList{}},
+	}
+
+	for _, test := range tests {
+		if got := el.crop(test.start, test.end); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("cropping to %d-%d: wanted %v got %v.", test.start, test.end, test.want, got)
+		}
+	}
+}
+
+func TestExtentList_missing(t *testing.T) {
+	el := ExtentList{{Start: 100, End: 200}, {Start: 500, End: 600}}
+
+	tests := []struct {
+		req  MatrixExtents
+		want ExtentList
+	}{
+		{MatrixExtents{Start: 100, End: 200}, ExtentList{}},
+		{MatrixExtents{Start: 0, End: 50}, ExtentList{{Start: 0, End: 50}}},
+		{MatrixExtents{Start: 50, End: 150}, ExtentList{{Start: 50, End: 90}}},
+		{MatrixExtents{Start: 150, End: 550}, ExtentList{{Start: 210, End: 490}}},
+		{MatrixExtents{Start: 0, End: 800}, ExtentList{{Start: 0, End: 90}, {Start: 210, End: 490}, {Start: 610, End: 800}}},
+	}
+
+	for _, test := range tests {
+		if got := el.missing(test.req, 10); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("missing from %v: wanted %v got %v.", test.req, test.want, got)
+		}
+	}
+
+	// everything is missing from an empty list
+	if got := (ExtentList{}).missing(MatrixExtents{Start: 0, End: 50}, 10); !reflect.DeepEqual(got, ExtentList{{Start: 0, End: 50}}) {
+		t.Errorf("wanted the whole request got %v.", got)
+	}
+}
+
+func TestExtentList_split(t *testing.T) {
+	el := ExtentList{{Start: 0, End: 100}, {Start: 200, End: 210}}
+
+	want := ExtentList{{Start: 0, End: 30}, {Start: 40, End: 70}, {Start: 80, End: 100}, {Start: 200, End: 210}}
+	if got := el.split(45, 10); !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted %v got %v.", want, got)
+	}
+
+	// it should never split below a single step
+	want = ExtentList{{Start: 0, End: 0}, {Start: 10, End: 10}}
+	if got := (ExtentList{{Start: 0, End: 10}}).split(5, 10); !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted %v got %v.", want, got)
+	}
+}
+
+func TestFillMatrix(t *testing.T) {
+	newMatrix := func(values map[string][]int64) PrometheusMatrixEnvelope {
+		pe := PrometheusMatrixEnvelope{Status: rvSuccess, Data: PrometheusMatrixData{ResultType: rvMatrix}}
+		for job, timestamps := range values {
+			s := &model.SampleStream{Metric: model.Metric{"job": model.LabelValue(job)}}
+			for _, ts := range timestamps {
+				s.Values = append(s.Values, model.SamplePair{Timestamp: model.Time(ts), Value: model.SampleValue(len(job))})
+			}
+			pe.Data.Result = append(pe.Data.Result, s)
+		}
+		return pe
+	}
+
+	cached := newMatrix(map[string][]int64{"a": {0, 10, 40, 50}, "bb": {40}})
+	fetched := []PrometheusMatrixEnvelope{newMatrix(map[string][]int64{"a": {20, 30, 40}, "ccc": {30}}), {}}
+
+	pe := fillMatrix(cached, fetched, ExtentList{{Start: 20, End: 40}})
+
+	// it should fill the gap, replace the points within the fetched extents and add new series
+	want := map[string][]int64{"a": {0, 10, 20, 30, 40, 50}, "ccc": {30}}
+	got := make(map[string][]int64)
+	for _, s := range pe.Data.Result {
+		for _, v := range s.Values {
+			got[string(s.Metric["job"])] = append(got[string(s.Metric["job"])], int64(v.Timestamp))
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted %v got %v.", want, got)
+	}
+
+	// it should not modify the cached matrix
+	if len(cached.Data.Result[0].Values)+len(cached.Data.Result[1].Values) != 5 {
+		t.Errorf("cached matrix was modified: %v", cached.Data.Result)
+	}
+}
+
+func TestTricksterHandler_promQueryRangeHandler_gap(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	ranges := make(chan string, 10)
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges <- r.FormValue(upStart) + "-" + r.FormValue(upEnd)
+		fmt.Fprint(w, exampleRangeResponse)
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	// keep the 2015 example data from being aged out of the cache
+	o := tr.Config.Origins["default"]
+	o.MaxValueAgeSecs = time.Now().Unix()
+	o.FastForwardDisable = true
+	tr.Config.Origins["default"] = o
+
+	ctx, err := tr.buildRequestContext(httptest.NewRecorder(), httptest.NewRequest("GET", es.URL+exampleRangeQuery, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cache the example data with the middle point missing, as if the origin was down when it was fetched
+	pe := PrometheusMatrixEnvelope{}
+	if err := json.Unmarshal([]byte(exampleRangeResponse), &pe); err != nil {
+		t.Fatal(err)
+	}
+	pe.cropToRange(0, 1435781430000)
+	pe.Extents = ExtentList{{Start: 1435781430000, End: 1435781430000}, {Start: 1435781460000, End: 1435781460000}}
+	data, err := tr.encodeCacheMatrix(pe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Cacher.Store(ctx.CacheKey, data, 60)
+
+	w := httptest.NewRecorder()
+	tr.promQueryRangeHandler(w, httptest.NewRequest("GET", es.URL+exampleRangeQuery, nil))
+
+	// it should only fetch the gap from the origin
+	if r := <-ranges; r != "1435781445-1435781445" {
+		t.Errorf("wanted 1435781445-1435781445 got %s.", r)
+	}
+	if len(ranges) != 0 {
+		t.Errorf("wanted 1 origin request got %d.", len(ranges)+1)
+	}
+
+	// it should respond with the cached points and the gap filled in
+	pe = PrometheusMatrixEnvelope{}
+	if err := json.NewDecoder(w.Result().Body).Decode(&pe); err != nil {
+		t.Fatal(err)
+	}
+	if pe.getValueCount() != 4 {
+		t.Errorf("wanted 4 values got %d.", pe.getValueCount())
+	}
+
+	// it should record the gap as fetched
+	data, err = tr.Cacher.Retrieve(ctx.CacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pe = PrometheusMatrixEnvelope{}
+	if err := decodeCacheMatrix(data, &pe); err != nil {
+		t.Fatal(err)
+	}
+	if want := (ExtentList{{Start: 1435781430000, End: 1435781460000}}); !reflect.DeepEqual(pe.Extents, want) {
+		t.Errorf("wanted extents %v got %v.", want, pe.Extents)
+	}
+}
+
+func TestTricksterHandler_promQueryRangeHandler_split(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	var m sync.Mutex
+	var inFlight, maxInFlight int
+	failStart := "1435781445"
+	ranges := make(chan string, 10)
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		fail := r.FormValue(upStart) == failStart
+		m.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+		ranges <- r.FormValue(upStart) + "-" + r.FormValue(upEnd)
+
+		m.Lock()
+		inFlight--
+		m.Unlock()
+
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, exampleRangeResponse)
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	// keep the 2015 example data from being aged out of the cache
+	o := tr.Config.Origins["default"]
+	o.MaxValueAgeSecs = time.Now().Unix()
+	o.FastForwardDisable = true
+	o.MaxOriginRangeSecs = 15
+	o.SplitConcurrency = 2
+	tr.Config.Origins["default"] = o
+
+	w := httptest.NewRecorder()
+	tr.promQueryRangeHandler(w, httptest.NewRequest("GET", es.URL+exampleRangeQuery, nil))
+
+	// it should split the request into one request per step, with at most 2 in flight
+	if len(ranges) != 3 {
+		t.Errorf("wanted 3 origin requests got %d.", len(ranges))
+	}
+	if maxInFlight > 2 {
+		t.Errorf("wanted at most 2 requests in flight got %d.", maxInFlight)
+	}
+
+	// it should fail the request when one of the split requests fails
+	if w.Result().StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("wanted 503 got %d.", w.Result().StatusCode)
+	}
+
+	// it should cache the results of the split requests that succeeded
+	ctx, err := tr.buildRequestContext(httptest.NewRecorder(), httptest.NewRequest("GET", es.URL+exampleRangeQuery, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ExtentList{{Start: 1435781445000, End: 1435781445000}}
+	if ctx.CacheLookupResult != crPartialHit || !reflect.DeepEqual(ctx.OriginExtents, want) {
+		t.Errorf("wanted a partial hit missing %v got %s missing %v.", want, ctx.CacheLookupResult, ctx.OriginExtents)
+	}
+}
@@ -0,0 +1,393 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
+)
+
+// contextKey is the type of the keys Trickster stores in request contexts
+type contextKey string
+
+// fanoutMemberKey is the request context key holding the name of the member origin a fanout sub-request is for
+const fanoutMemberKey contextKey = "fanoutMember"
+
+// bufferedResponseWriter is an http.ResponseWriter that captures the response in memory
+type bufferedResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponseWriter() *bufferedResponseWriter {
+	return &bufferedResponseWriter{header: http.Header{}}
+}
+
+// Header returns the response headers
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+// Write appends to the response body
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+// WriteHeader sets the response status code
+func (w *bufferedResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+// fanoutResult is the response of a single member origin to a fanout request
+type fanoutResult struct {
+	origin string
+	status int
+	body   []byte
+	err    error
+	// stale is true if the member origin served stale cached data because its origin was unavailable
+	stale bool
+}
+
+// warning describes a failed member origin response as a Prometheus warning
+func (res fanoutResult) warning() string {
+	if res.err != nil {
+		return fmt.Sprintf("fanout origin %q failed: %v", res.origin, res.err)
+	}
+	return fmt.Sprintf("fanout origin %q failed with status %d", res.origin, res.status)
+}
+
+// getProxyOrigin returns the origin to proxy non-query requests to. Fanout origins proxy them to their first member origin
+func (t *TricksterHandler) getProxyOrigin(r *http.Request) PrometheusOriginConfig {
+	o := t.getOrigin(r)
+	if o.OriginType == otFanout && len(o.FanoutOrigins) > 0 {
+		return t.getOriginByName(o.FanoutOrigins[0])
+	}
+	return o
+}
+
+// fanoutRequest sends a copy of the client request to each member origin of the fanout origin in parallel
+// using the provided handler, so that each member's response is cached under the member's own cache keys
+func (t *TricksterHandler) fanoutRequest(o PrometheusOriginConfig, r *http.Request, handler http.HandlerFunc) ([]fanoutResult, error) {
+	if len(o.FanoutOrigins) == 0 {
+		return nil, fmt.Errorf("fanout origin has no fanout_origins configured")
+	}
+
+	// Parse the form once so that each sub-request can be given its own copy of the params
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+
+	results := make([]fanoutResult, len(o.FanoutOrigins))
+
+	var wg sync.WaitGroup
+	for i, name := range o.FanoutOrigins {
+		results[i].origin = name
+
+		member, ok := t.Config.Origins[name]
+		if !ok {
+			results[i].err = fmt.Errorf("no such origin")
+			continue
+		}
+		if member.OriginType == otFanout {
+			results[i].err = fmt.Errorf("fanout origins cannot be nested")
+			continue
+		}
+
+		sr := r.WithContext(context.WithValue(r.Context(), fanoutMemberKey, name))
+		sr.Form = url.Values{}
+		for k, v := range r.Form {
+			sr.Form[k] = append([]string(nil), v...)
+		}
+
+		wg.Add(1)
+		go func(res *fanoutResult, sr *http.Request) {
+			defer wg.Done()
+			bw := newBufferedResponseWriter()
+			handler(bw, sr)
+			res.status = bw.status
+			res.body = bw.body.Bytes()
+			res.stale = bw.header.Get(hnStale) != ""
+		}(&results[i], sr)
+	}
+	wg.Wait()
+
+	return results, nil
+}
+
+// promFanoutQueryRangeHandler handles calls to /query_range for fanout origins, merging the matrices of each member origin
+func (t *TricksterHandler) promFanoutQueryRangeHandler(w http.ResponseWriter, r *http.Request, o PrometheusOriginConfig) {
+	results, err := t.fanoutRequest(o, r, t.promQueryRangeHandler)
+	if err != nil {
+		level.Error(t.Logger).Log(lfEvent, "error fanning out request", lfDetail, err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	members := make([]PrometheusMatrixEnvelope, 0, len(results))
+	warnings := make([]string, 0)
+	var failed *fanoutResult
+
+	for i, res := range results {
+		if res.err == nil && res.status == http.StatusOK {
+			pe := PrometheusMatrixEnvelope{}
+			if err := json.Unmarshal(res.body, &pe); err == nil && pe.Status == rvSuccess {
+				// a member's stale data makes the merged response stale, and its stale warning is kept with the others
+				if res.stale {
+					w.Header().Set(hnStale, "true")
+				}
+				warnings = mergeWarnings(warnings, pe.Warnings...)
+				pe.Warnings = nil
+				members = append(members, pe)
+				continue
+			}
+		}
+		level.Warn(t.Logger).Log(lfEvent, "fanout origin request failed", "origin", res.origin, "status", res.status)
+		warnings = append(warnings, res.warning())
+		if failed == nil {
+			failed = &results[i]
+		}
+	}
+
+	merged := mergeFanoutMatrices(members)
+	t.writeFanoutResponse(w, merged.Status == rvSuccess, func() ([]byte, error) {
+		if len(warnings) > 0 {
+			merged.Warnings = warnings
+		}
+		return json.Marshal(merged)
+	}, failed)
+}
+
+// promFanoutQueryHandler handles calls to /query for fanout origins, merging the vectors of each member origin
+func (t *TricksterHandler) promFanoutQueryHandler(w http.ResponseWriter, r *http.Request, o PrometheusOriginConfig) {
+	results, err := t.fanoutRequest(o, r, t.promQueryHandler)
+	if err != nil {
+		level.Error(t.Logger).Log(lfEvent, "error fanning out request", lfDetail, err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	merged := PrometheusVectorEnvelope{}
+	warnings := make([]string, 0)
+	scalars := true
+	var failed *fanoutResult
+
+	for i, res := range results {
+		if res.err == nil && res.status == http.StatusOK {
+			pv := PrometheusVectorEnvelope{}
+			if err := json.Unmarshal(res.body, &pv); err == nil && pv.Status == rvSuccess && pv.Data.ResultType != rvString {
+				warnings = mergeWarnings(warnings, pv.Warnings...)
+				pv.Warnings = nil
+				// a scalar is merged as a sample without labels, so it can be merged with the members' vectors
+				scalars = scalars && pv.Data.ResultType == rvScalar
+				pv.Data.Result, pv.Data.ResultType = pv.Data.samples(), rvVector
+				merged = mergeVectors(merged, pv)
+				continue
+			}
+		}
+		level.Warn(t.Logger).Log(lfEvent, "fanout origin request failed", "origin", res.origin, "status", res.status)
+		warnings = append(warnings, res.warning())
+		if failed == nil {
+			failed = &results[i]
+		}
+	}
+
+	// when every member returned a scalar, the first member's scalar is returned as one
+	if scalars {
+		merged.Data.ResultType = rvScalar
+	}
+
+	t.writeFanoutResponse(w, merged.Status == rvSuccess, func() ([]byte, error) {
+		if len(warnings) > 0 {
+			merged.Warnings = warnings
+		}
+		return json.Marshal(merged)
+	}, failed)
+}
+
+// promFanoutMetadataHandler handles calls to the metadata endpoints for fanout origins, merging the label names, label
+// values or series of each member origin
+func (t *TricksterHandler) promFanoutMetadataHandler(w http.ResponseWriter, r *http.Request, o PrometheusOriginConfig, endpoint string) {
+	results, err := t.fanoutRequest(o, r, t.promMetadataHandler(endpoint))
+	if err != nil {
+		level.Error(t.Logger).Log(lfEvent, "error fanning out request", lfDetail, err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	members := make([]json.RawMessage, 0, len(results))
+	warnings := make([]string, 0)
+	var failed *fanoutResult
+
+	for i, res := range results {
+		if res.err == nil && res.status == http.StatusOK {
+			pm := PrometheusMetadataEnvelope{}
+			if err := json.Unmarshal(res.body, &pm); err == nil && pm.Status == rvSuccess {
+				warnings = mergeWarnings(warnings, pm.Warnings...)
+				members = append(members, pm.Data)
+				continue
+			}
+		}
+		level.Warn(t.Logger).Log(lfEvent, "fanout origin request failed", "origin", res.origin, "status", res.status)
+		warnings = append(warnings, res.warning())
+		if failed == nil {
+			failed = &results[i]
+		}
+	}
+
+	t.writeFanoutResponse(w, len(members) > 0, func() ([]byte, error) {
+		data, err := mergeMetadata(endpoint, members)
+		if err != nil {
+			return nil, err
+		}
+		merged := PrometheusMetadataEnvelope{Status: rvSuccess, Data: data}
+		if len(warnings) > 0 {
+			merged.Warnings = warnings
+		}
+		return json.Marshal(merged)
+	}, failed)
+}
+
+// writeFanoutResponse writes the merged response if any member origin succeeded, or otherwise the first failed member response
+func (t *TricksterHandler) writeFanoutResponse(w http.ResponseWriter, ok bool, marshal func() ([]byte, error), failed *fanoutResult) {
+	if !ok {
+		if failed.status == 0 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		writeResponse(w, failed.body, &http.Response{StatusCode: failed.status})
+		return
+	}
+
+	body, err := marshal()
+	if err != nil {
+		level.Error(t.Logger).Log(lfEvent, "prometheus fanout marshaling error", lfDetail, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeResponse(w, body, &http.Response{StatusCode: http.StatusOK})
+}
+
+// mergeFanoutMatrices merges the matrices of the member origins, taking the union of the points of a series that is
+// returned by several members. Where members have a point at the same timestamp, the later member's point is kept
+func mergeFanoutMatrices(members []PrometheusMatrixEnvelope) PrometheusMatrixEnvelope {
+	merged := fillMatrix(PrometheusMatrixEnvelope{}, members, nil)
+
+	result := make(model.Matrix, 0, len(merged.Data.Result))
+	for _, s := range merged.Data.Result {
+		values := make([]model.SamplePair, 0, len(s.Values))
+		for _, v := range s.Values {
+			if len(values) > 0 && values[len(values)-1].Timestamp == v.Timestamp {
+				values[len(values)-1] = v
+				continue
+			}
+			values = append(values, v)
+		}
+		if len(values) > 0 {
+			s.Values = values
+			result = append(result, s)
+		}
+	}
+	merged.Data.Result = result
+
+	return merged
+}
+
+// mergeMetadata returns the union of the metadata of the member origins: the sorted label names or values, or the
+// series with distinct label sets in the order the members returned them
+func mergeMetadata(endpoint string, members []json.RawMessage) (json.RawMessage, error) {
+	if endpoint == mdSeries {
+		merged := make([]model.Metric, 0)
+		seen := make(map[model.Fingerprint]bool)
+		for _, data := range members {
+			var series []model.Metric
+			if err := json.Unmarshal(data, &series); err != nil {
+				return nil, err
+			}
+			for _, m := range series {
+				if fp := m.Fingerprint(); !seen[fp] {
+					seen[fp] = true
+					merged = append(merged, m)
+				}
+			}
+		}
+		return json.Marshal(merged)
+	}
+
+	merged := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, data := range members {
+		var values []string
+		if err := json.Unmarshal(data, &values); err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			if !seen[v] {
+				seen[v] = true
+				merged = append(merged, v)
+			}
+		}
+	}
+	sort.Strings(merged)
+	return json.Marshal(merged)
+}
+
+// mergeVectors merges the samples of pv2 into pv, dropping any sample whose label set is already present in pv
+func mergeVectors(pv PrometheusVectorEnvelope, pv2 PrometheusVectorEnvelope) PrometheusVectorEnvelope {
+	if pv.Status != rvSuccess {
+		return pv2
+	} else if pv2.Status != rvSuccess {
+		return pv
+	}
+
+	seen := make(map[uint64]bool, len(pv.Data.Result))
+	for _, s := range pv.Data.Result {
+		seen[uint64(s.Metric.Fingerprint())] = true
+	}
+
+	for _, s := range pv2.Data.Result {
+		if fp := uint64(s.Metric.Fingerprint()); !seen[fp] {
+			seen[fp] = true
+			pv.Data.Result = append(pv.Data.Result, s)
+		}
+	}
+
+	seen = make(map[uint64]bool, len(pv.Data.Histograms))
+	for _, s := range pv.Data.Histograms {
+		seen[uint64(s.Metric.Fingerprint())] = true
+	}
+	for _, s := range pv2.Data.Histograms {
+		if fp := uint64(s.Metric.Fingerprint()); !seen[fp] {
+			seen[fp] = true
+			pv.Data.Histograms = append(pv.Data.Histograms, s)
+		}
+	}
+
+	return pv
+}
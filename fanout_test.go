@@ -0,0 +1,339 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+const exampleShardRangeResponse = `{
+   "status" : "success",
+   "data" : {
+      "resultType" : "matrix",
+      "result" : [
+         {
+            "metric" : {
+               "__name__" : "up",
+               "job" : "prometheus",
+               "instance" : "localhost:9090"
+            },
+            "values" : [
+               [ 1435781430.000, "1" ],
+               [ 1435781445.000, "1" ],
+               [ 1435781460.000, "1" ]
+            ]
+         },
+         {
+            "metric" : {
+               "__name__" : "up",
+               "job" : "shard",
+               "instance" : "localhost:9092"
+            },
+            "values" : [
+               [ 1435781430.000, "1" ],
+               [ 1435781445.000, "1" ],
+               [ 1435781460.000, "1" ]
+            ]
+         }
+      ]
+   }
+}`
+
+func (t *TricksterHandler) setTestFanoutOrigin(memberURLs ...string) {
+	t.setTestOrigin(nonexistantOrigin)
+	fanout := PrometheusOriginConfig{OriginType: otFanout}
+	for i, u := range memberURLs {
+		name := "shard" + string('a'+rune(i))
+		t.Config.Origins[name] = PrometheusOriginConfig{
+			OriginURL:           u,
+			APIPath:             prometheusAPIv1Path,
+			IgnoreNoCacheHeader: true,
+			MaxValueAgeSecs:     86400,
+			FastForwardDisable:  true,
+		}
+		fanout.FanoutOrigins = append(fanout.FanoutOrigins, name)
+	}
+	t.Config.Origins["fanout"] = fanout
+}
+
+func TestTricksterHandler_promFanoutQueryRangeHandler(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	s1 := newTestServer(exampleRangeResponse)
+	defer s1.Close()
+	s2 := newTestServer(exampleShardRangeResponse)
+	defer s2.Close()
+	tr.setTestFanoutOrigin(s1.URL, s2.URL)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://fanout"+exampleRangeQuery, nil)
+	tr.promQueryRangeHandler(w, r)
+
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("wanted 200 got %d.", w.Result().StatusCode)
+	}
+
+	pe := PrometheusMatrixEnvelope{}
+	if err := json.Unmarshal(w.Body.Bytes(), &pe); err != nil {
+		t.Fatal(err)
+	}
+
+	// it should merge both shards, deduplicating the series present in both
+	if len(pe.Data.Result) != 3 {
+		t.Errorf("wanted 3 series got %d.", len(pe.Data.Result))
+	}
+	if pe.getValueCount() != 9 {
+		t.Errorf("wanted 9 values got %d.", pe.getValueCount())
+	}
+	if len(pe.Warnings) != 0 {
+		t.Errorf("wanted no warnings got %v.", pe.Warnings)
+	}
+}
+
+func TestTricksterHandler_promFanoutQueryRangeHandler_partialFailure(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	s1 := newTestServer(exampleRangeResponse)
+	defer s1.Close()
+	tr.setTestFanoutOrigin(s1.URL, nonexistantOrigin)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://fanout"+exampleRangeQuery, nil)
+	tr.promQueryRangeHandler(w, r)
+
+	// it should return the data of the healthy shard with a warning about the failed one
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("wanted 200 got %d.", w.Result().StatusCode)
+	}
+
+	pe := PrometheusMatrixEnvelope{}
+	if err := json.Unmarshal(w.Body.Bytes(), &pe); err != nil {
+		t.Fatal(err)
+	}
+	if pe.getValueCount() != 6 {
+		t.Errorf("wanted 6 values got %d.", pe.getValueCount())
+	}
+	if len(pe.Warnings) != 1 {
+		t.Errorf("wanted 1 warning got %v.", pe.Warnings)
+	}
+}
+
+func TestTricksterHandler_promFanoutQueryRangeHandler_stale(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	s1 := newTestServer(exampleRangeResponse)
+	s2 := newTestServer(exampleShardRangeResponse)
+	defer s2.Close()
+	tr.setTestFanoutOrigin(s1.URL, s2.URL)
+
+	// keep the 2015 example data from being aged out of the cache
+	for _, name := range []string{"sharda", "shardb"} {
+		o := tr.Config.Origins[name]
+		o.MaxValueAgeSecs = time.Now().Unix()
+		o.ServeStaleOnError = true
+		tr.Config.Origins[name] = o
+	}
+
+	// populate the cache
+	tr.promQueryRangeHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "http://fanout"+exampleRangeQuery, nil))
+
+	// take the first member's origin down, and request a range that is only partially cached
+	s1.Close()
+
+	w := httptest.NewRecorder()
+	tr.promQueryRangeHandler(w, httptest.NewRequest("GET", "http://fanout/api/v1/query_range?query=up&start=2015-07-01T20:09:30.781Z&end=2015-07-01T20:11:00.781Z&step=15", nil))
+
+	// it should mark the merged response stale, with the member's stale warning
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("wanted 200 got %d.", w.Result().StatusCode)
+	}
+	if w.Result().Header.Get(hnStale) != "true" {
+		t.Errorf("expected %s header", hnStale)
+	}
+
+	pe := PrometheusMatrixEnvelope{}
+	if err := json.Unmarshal(w.Body.Bytes(), &pe); err != nil {
+		t.Fatal(err)
+	}
+	if len(pe.Warnings) != 1 || pe.Warnings[0] != twStale {
+		t.Errorf("wanted the stale warning got %v.", pe.Warnings)
+	}
+}
+
+func TestTricksterHandler_promFanoutQueryRangeHandler_allFailed(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	tr.setTestFanoutOrigin(nonexistantOrigin, nonexistantOrigin)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://fanout"+exampleRangeQuery, nil)
+	tr.promQueryRangeHandler(w, r)
+
+	if w.Result().StatusCode != http.StatusBadGateway {
+		t.Errorf("wanted 502 got %d.", w.Result().StatusCode)
+	}
+}
+
+func TestMergeFanoutMatrices(t *testing.T) {
+	members := make([]PrometheusMatrixEnvelope, 0)
+	for _, result := range []string{
+		`[{"metric":{"job":"a"},"values":[[1435781430,"1"],[1435781445,"2"]]},{"metric":{"job":"b"},"values":[]}]`,
+		`[{"metric":{"job":"a"},"values":[[1435781445,"3"],[1435781460,"4"]]},{"metric":{"job":"c"},"values":[[1435781460,"5"]]}]`,
+	} {
+		pe := PrometheusMatrixEnvelope{}
+		if err := json.Unmarshal([]byte(`{"status":"success","data":{"resultType":"matrix","result":`+result+`}}`), &pe); err != nil {
+			t.Fatal(err)
+		}
+		members = append(members, pe)
+	}
+
+	// it should take the union of the points of a series in several members, and drop empty series
+	merged := mergeFanoutMatrices(members)
+	got := make(map[string][]model.SamplePair)
+	for _, s := range merged.Data.Result {
+		got[string(s.Metric["job"])] = s.Values
+	}
+	want := map[string][]model.SamplePair{
+		"a": {{Timestamp: 1435781430000, Value: 1}, {Timestamp: 1435781445000, Value: 3}, {Timestamp: 1435781460000, Value: 4}},
+		"c": {{Timestamp: 1435781460000, Value: 5}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted %v got %v.", want, got)
+	}
+	if merged.Status != rvSuccess {
+		t.Errorf("wanted %s got %s.", rvSuccess, merged.Status)
+	}
+}
+
+func TestTricksterHandler_promFanoutQueryHandler_scalar(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	const scalar = `{"status":"success","data":{"resultType":"scalar","result":[1435781451.781,"1"]}}`
+	s1 := newTestServer(scalar)
+	defer s1.Close()
+	s2 := newTestServer(scalar)
+	defer s2.Close()
+	s3 := newTestServer(exampleResponse)
+	defer s3.Close()
+
+	tests := []struct {
+		members    []string
+		resultType string
+		samples    int
+	}{
+		{[]string{s1.URL, s2.URL}, rvScalar, 1},
+		{[]string{s1.URL, s3.URL}, rvVector, 3},
+	}
+
+	for _, test := range tests {
+		tr.setTestFanoutOrigin(test.members...)
+
+		w := httptest.NewRecorder()
+		tr.promQueryHandler(w, httptest.NewRequest("GET", "http://fanout"+exampleQuery, nil))
+		if w.Result().StatusCode != http.StatusOK {
+			t.Fatalf("wanted 200 got %d.", w.Result().StatusCode)
+		}
+
+		// it should merge scalars rather than count them as failures
+		pv := PrometheusVectorEnvelope{}
+		if err := json.Unmarshal(w.Body.Bytes(), &pv); err != nil {
+			t.Fatal(err)
+		}
+		if pv.Data.ResultType != test.resultType || len(pv.Data.samples()) != test.samples {
+			t.Errorf("wanted %d samples as %s got %s.", test.samples, test.resultType, w.Body.String())
+		}
+		if len(pv.Warnings) != 0 {
+			t.Errorf("wanted no warnings got %v.", pv.Warnings)
+		}
+	}
+}
+
+func TestTricksterHandler_promFanoutQueryHandler(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	s1 := newTestServer(exampleResponse)
+	defer s1.Close()
+	s2 := newTestServer(exampleResponse)
+	defer s2.Close()
+	tr.setTestFanoutOrigin(s1.URL, s2.URL)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://fanout"+exampleQuery, nil)
+	tr.promQueryHandler(w, r)
+
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("wanted 200 got %d.", w.Result().StatusCode)
+	}
+
+	pv := PrometheusVectorEnvelope{}
+	if err := json.Unmarshal(w.Body.Bytes(), &pv); err != nil {
+		t.Fatal(err)
+	}
+
+	// it should deduplicate the identical samples returned by both shards
+	if len(pv.Data.Result) != 2 {
+		t.Errorf("wanted 2 samples got %d.", len(pv.Data.Result))
+	}
+}
+
+func TestTricksterHandler_promFanoutMetadataHandler(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	tests := []struct {
+		endpoint string
+		path     string
+		members  []string
+		want     string
+	}{
+		{
+			endpoint: mdLabels,
+			path:     "/api/v1/labels",
+			members:  []string{`["__name__","job"]`, `["instance","job"]`},
+			want:     `["__name__","instance","job"]`,
+		},
+		{
+			endpoint: mdSeries,
+			path:     "/api/v1/series?match[]=up",
+			members:  []string{`[{"__name__":"up","job":"a"}]`, `[{"__name__":"up","job":"a"},{"__name__":"up","job":"b"}]`},
+			want:     `[{"__name__":"up","job":"a"},{"__name__":"up","job":"b"}]`,
+		},
+	}
+
+	for _, test := range tests {
+		s1 := newTestServer(`{"status":"success","data":` + test.members[0] + `}`)
+		defer s1.Close()
+		s2 := newTestServer(`{"status":"success","data":` + test.members[1] + `}`)
+		defer s2.Close()
+		tr.setTestFanoutOrigin(s1.URL, s2.URL)
+
+		w := httptest.NewRecorder()
+		tr.promMetadataHandler(test.endpoint)(w, httptest.NewRequest("GET", "http://fanout"+test.path, nil))
+		if w.Result().StatusCode != http.StatusOK {
+			t.Fatalf("%s: wanted 200 got %d.", test.endpoint, w.Result().StatusCode)
+		}
+
+		// it should return the union of the members' metadata
+		if err := jsonEqual([]byte(`{"status":"success","data":`+test.want+`}`), w.Body.Bytes()); err != nil {
+			t.Errorf("%s: %v", test.endpoint, err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
+)
+
+// Fast Forward Modes
+const (
+	ffOff    = "off"
+	ffAppend = "append-unaligned"
+	ffSnap   = "snap"
+)
+
+// fastForwardModes maps the accepted values of FastForward to their modes. An unset FastForward is ffAppend, and
+// "append" is an alias of ffAppend
+var fastForwardModes = map[string]string{
+	"":       ffAppend,
+	"append": ffAppend,
+	ffAppend: ffAppend,
+	ffSnap:   ffSnap,
+	ffOff:    ffOff,
+}
+
+// fastForwardMode returns the origin's Fast Forward mode. FastForwardDisable turns it off regardless of FastForward.
+// FastForward values are validated when the configuration is loaded, so an unknown value can only be set in code,
+// and is treated as ffAppend
+func (o PrometheusOriginConfig) fastForwardMode() string {
+	if o.FastForwardDisable {
+		return ffOff
+	}
+	if mode, ok := fastForwardModes[o.FastForward]; ok {
+		return mode
+	}
+	return ffAppend
+}
+
+// fastForwardTime returns the timestamp at which a Fast Forward sample taken at ts is added to a range: truncated to
+// the second for ffAppend, and rounded up to the next step boundary for ffSnap
+func fastForwardTime(ts model.Time, mode string, stepMS int64) model.Time {
+	if mode == ffSnap && stepMS > 0 {
+		return model.Time(((int64(ts) + stepMS - 1) / stepMS) * stepMS)
+	}
+	return model.Time((int64(ts) / 1000) * 1000)
+}
+
+// mergeVector adds the samples of an instant query for the latest time to the matching series of the range,
+// according to the Fast Forward mode. A sample is only added when it is later than the last point of its series,
+// and a sample for a series that is not in the range is added as a new series
+func (t *TricksterHandler) mergeVector(pe PrometheusMatrixEnvelope, pv PrometheusVectorEnvelope, mode string, stepMS int64) PrometheusMatrixEnvelope {
+	if mode == ffOff {
+		return pe
+	}
+
+	pe.Warnings = mergeWarnings(pe.Warnings, pv.Warnings...)
+	pe.Data.Histograms = mergeHistogramVector(pe.Data.Histograms, pv.Data.Histograms, mode, stepMS)
+
+	samples := pv.Data.samples()
+	if len(samples) == 0 {
+		level.Debug(t.Logger).Log(lfEvent, "mergeVectorPrematureExit")
+		return pe
+	}
+
+	for _, sample := range samples {
+		point := model.SamplePair{Timestamp: fastForwardTime(sample.Timestamp, mode, stepMS), Value: sample.Value}
+
+		found := false
+		for _, s := range pe.Data.Result {
+			if !sample.Metric.Equal(s.Metric) {
+				continue
+			}
+			found = true
+			if len(s.Values) == 0 || point.Timestamp > s.Values[len(s.Values)-1].Timestamp {
+				s.Values = append(s.Values, point)
+			}
+			break
+		}
+
+		if !found {
+			pe.Data.Result = append(pe.Data.Result, &model.SampleStream{Metric: sample.Metric, Values: []model.SamplePair{point}})
+		}
+	}
+
+	return pe
+}
@@ -0,0 +1,221 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestPrometheusOriginConfig_fastForwardMode(t *testing.T) {
+	tests := []struct {
+		disable bool
+		mode    string
+		want    string
+	}{
+		{false, "", ffAppend},
+		{false, "append-unaligned", ffAppend},
+		{false, "append", ffAppend},
+		{false, "snap", ffSnap},
+		{false, "off", ffOff},
+		{true, "snap", ffOff},
+	}
+
+	for _, test := range tests {
+		o := PrometheusOriginConfig{FastForwardDisable: test.disable, FastForward: test.mode}
+		if got := o.fastForwardMode(); got != test.want {
+			t.Errorf("%v %q: wanted %s got %s.", test.disable, test.mode, test.want, got)
+		}
+	}
+}
+
+func TestFastForwardTime(t *testing.T) {
+	tests := []struct {
+		ts     model.Time
+		mode   string
+		stepMS int64
+		want   model.Time
+	}{
+		{1435781467781, ffAppend, 15000, 1435781467000},
+		{1435781467781, ffSnap, 15000, 1435781475000},
+		{1435781475000, ffSnap, 15000, 1435781475000},
+		{1435781475001, ffSnap, 15000, 1435781490000},
+		{1435781467781, ffSnap, 0, 1435781467000},
+	}
+
+	for _, test := range tests {
+		if got := fastForwardTime(test.ts, test.mode, test.stepMS); got != test.want {
+			t.Errorf("%d %s %d: wanted %d got %d.", test.ts, test.mode, test.stepMS, test.want, got)
+		}
+	}
+}
+
+func TestTricksterHandler_mergeVector_modes(t *testing.T) {
+	tr, closeTr := newTestTricksterHandler(t)
+	defer closeTr(t)
+
+	const vector = `{"status":"success","data":{"resultType":"vector","result":[
+		{"metric":{"job":"a"},"value":[1435781467.781,"3"]},
+		{"metric":{"job":"b"},"value":[1435781467.781,"4"]},
+		{"metric":{"job":"c"},"value":[1435781467.781,"5"]}]}}`
+
+	tests := []struct {
+		name   string
+		matrix string
+		mode   string
+		want   map[string][]model.Time
+	}{
+		{
+			name:   "off",
+			matrix: `[{"metric":{"job":"a"},"values":[[1435781445,"1"],[1435781460,"2"]]}]`,
+			mode:   ffOff,
+			want:   map[string][]model.Time{"a": {1435781445000, 1435781460000}},
+		},
+		{
+			name:   "append adds new series",
+			matrix: `[{"metric":{"job":"a"},"values":[[1435781445,"1"],[1435781460,"2"]]}]`,
+			mode:   ffAppend,
+			want: map[string][]model.Time{
+				"a": {1435781445000, 1435781460000, 1435781467000},
+				"b": {1435781467000},
+				"c": {1435781467000},
+			},
+		},
+		{
+			name:   "snap adds new series",
+			matrix: `[{"metric":{"job":"a"},"values":[[1435781445,"1"],[1435781460,"2"]]}]`,
+			mode:   ffSnap,
+			want: map[string][]model.Time{
+				"a": {1435781445000, 1435781460000, 1435781475000},
+				"b": {1435781475000},
+				"c": {1435781475000},
+			},
+		},
+		{
+			name:   "empty series",
+			matrix: `[{"metric":{"job":"a"},"values":[]},{"metric":{"job":"b"},"values":[[1435781460,"2"]]}]`,
+			mode:   ffSnap,
+			want: map[string][]model.Time{
+				"a": {1435781475000},
+				"b": {1435781460000, 1435781475000},
+				"c": {1435781475000},
+			},
+		},
+		{
+			name:   "no duplicate points",
+			matrix: `[{"metric":{"job":"a"},"values":[[1435781460,"1"],[1435781475,"2"]]},{"metric":{"job":"b"},"values":[[1435781467,"2"]]}]`,
+			mode:   ffSnap,
+			want: map[string][]model.Time{
+				"a": {1435781460000, 1435781475000},
+				"b": {1435781467000, 1435781475000},
+				"c": {1435781475000},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		pm := PrometheusMatrixEnvelope{}
+		if err := json.Unmarshal([]byte(`{"status":"success","data":{"resultType":"matrix","result":`+test.matrix+`}}`), &pm); err != nil {
+			t.Fatal(err)
+		}
+		pv := PrometheusVectorEnvelope{}
+		if err := json.Unmarshal([]byte(vector), &pv); err != nil {
+			t.Fatal(err)
+		}
+
+		pe := tr.mergeVector(pm, pv, test.mode, 15000)
+		got := make(map[string][]model.Time)
+		for _, s := range pe.Data.Result {
+			got[string(s.Metric["job"])] = []model.Time{}
+			for _, v := range s.Values {
+				got[string(s.Metric["job"])] = append(got[string(s.Metric["job"])], v.Timestamp)
+			}
+		}
+		if test.mode != ffOff && len(got) != len(test.want) {
+			t.Errorf("%s: wanted %v got %v.", test.name, test.want, got)
+			continue
+		}
+		for job, want := range test.want {
+			if !reflect.DeepEqual(got[job], want) {
+				t.Errorf("%s: wanted %v for %s got %v.", test.name, want, job, got[job])
+			}
+		}
+	}
+}
+
+func TestTricksterHandler_promQueryRangeHandler_fastForwardSnap(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	// evaluate a series with a value at every step, and a series that appears in the latest instant
+	now := time.Now().Unix()
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/query") {
+			fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"a"},"value":[%d.5,"1"]},{"metric":{"job":"b"},"value":[%d.5,"2"]}]}}`, now, now)
+			return
+		}
+		start, _ := strconv.ParseInt(r.FormValue(upStart), 10, 64)
+		end, _ := strconv.ParseInt(r.FormValue(upEnd), 10, 64)
+		values := make([]string, 0)
+		for ts := start; ts <= end; ts += 15 {
+			values = append(values, fmt.Sprintf(`[%d,"1"]`, ts))
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"a"},"values":[%s]}]}}`, strings.Join(values, ","))
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	o := tr.Config.Origins["default"]
+	o.FastForward = ffSnap
+	tr.Config.Origins["default"] = o
+
+	snapped := model.Time(((now*1000 + 500 + 14999) / 15000) * 15000)
+	path := es.URL + "/api/v1/query_range?query=up&step=15&start=" + strconv.FormatInt(now-300, 10) + "&end=" + strconv.FormatInt(now, 10)
+	// once from the origin, and once from the cache
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		tr.promQueryRangeHandler(w, httptest.NewRequest("GET", path, nil))
+		if w.Result().StatusCode != http.StatusOK {
+			t.Fatalf("wanted 200 got %d.", w.Result().StatusCode)
+		}
+
+		pe := PrometheusMatrixEnvelope{}
+		if err := json.NewDecoder(w.Result().Body).Decode(&pe); err != nil {
+			t.Fatal(err)
+		}
+		if len(pe.Data.Result) != 2 {
+			t.Fatalf("wanted 2 series got %d.", len(pe.Data.Result))
+		}
+
+		// it should add the latest point once, at the next step boundary
+		for _, s := range pe.Data.Result {
+			last := s.Values[len(s.Values)-1]
+			if last.Timestamp != snapped {
+				t.Errorf("request %d: wanted the fast forward point at %d for %s got %v.", i, snapped, s.Metric, last)
+			}
+			if len(s.Values) > 1 && s.Values[len(s.Values)-2].Timestamp >= last.Timestamp {
+				t.Errorf("request %d: wanted increasing timestamps for %s got %v.", i, s.Metric, s.Values)
+			}
+		}
+	}
+}
@@ -49,14 +49,14 @@ func (c *FilesystemCache) Connect() error {
 }
 
 // Store places an object in the cache using the specified key and ttl
-func (c *FilesystemCache) Store(cacheKey string, data string, ttl int64) error {
+func (c *FilesystemCache) Store(cacheKey string, data []byte, ttl int64) error {
 	expFile, dataFile := c.getFileNames(cacheKey)
 	expiration := []byte(strconv.FormatInt(time.Now().Unix()+ttl, 10))
 
 	level.Debug(c.T.Logger).Log("event", "filesystem cache store", "key", cacheKey, "expFile", expFile, "dataFile", dataFile)
 	mtx := c.getMutex(cacheKey)
 	mtx.Lock()
-	err1 := ioutil.WriteFile(dataFile, []byte(data), os.FileMode(0777))
+	err1 := ioutil.WriteFile(dataFile, data, os.FileMode(0777))
 	err2 := ioutil.WriteFile(expFile, expiration, os.FileMode(0777))
 	mtx.Unlock()
 
@@ -69,7 +69,7 @@ func (c *FilesystemCache) Store(cacheKey string, data string, ttl int64) error {
 }
 
 // Retrieve looks for an object in cache and returns it (or an error if not found)
-func (c *FilesystemCache) Retrieve(cacheKey string) (string, error) {
+func (c *FilesystemCache) Retrieve(cacheKey string) ([]byte, error) {
 	_, dataFile := c.getFileNames(cacheKey)
 	level.Debug(c.T.Logger).Log("event", "filesystem cache retrieve", "key", cacheKey, "dataFile", dataFile)
 
@@ -78,10 +78,10 @@ func (c *FilesystemCache) Retrieve(cacheKey string) (string, error) {
 	content, err := ioutil.ReadFile(dataFile)
 	mtx.Unlock()
 	if err != nil {
-		return "", fmt.Errorf("Value for key [%s] not in cache", cacheKey)
+		return nil, fmt.Errorf("Value for key [%s] not in cache", cacheKey)
 	}
 
-	return string(content), nil
+	return content, nil
 }
 
 // Reap continually iterates through the cache to find expired elements and removes them
@@ -14,6 +14,7 @@
 package main
 
 import (
+	"os"
 	"testing"
 
 	"github.com/go-kit/kit/log"
@@ -42,7 +43,7 @@ func TestFilesystemCache_Store(t *testing.T) {
 	}
 
 	// it should store a value
-	err = fc.Store("cacheKey", "data", 60000)
+	err = fc.Store("cacheKey", []byte("data"), 60000)
 	if err != nil {
 		t.Error(err)
 	}
@@ -57,7 +58,7 @@ func TestFilesystemCache_Retrieve(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	err = fc.Store("cacheKey", "data", 60000)
+	err = fc.Store("cacheKey", []byte("data"), 60000)
 	if err != nil {
 		t.Error(err)
 	}
@@ -67,7 +68,17 @@ func TestFilesystemCache_Retrieve(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	if data != "data" {
+	if string(data) != "data" {
 		t.Errorf("wanted \"%s\". got \"%s\".", "data", data)
 	}
 }
+
+func BenchmarkFilesystemCache(b *testing.B) {
+	cfg := Config{Caching: CachingConfig{ReapSleepMS: 1000}}
+	tr := TricksterHandler{Logger: log.NewNopLogger(), Config: &cfg}
+	fc := FilesystemCache{T: &tr, Config: FilesystemCacheConfig{CachePath: os.TempDir()}}
+	if err := fc.Connect(); err != nil {
+		b.Fatal(err)
+	}
+	benchmarkCache(b, &fc)
+}
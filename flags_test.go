@@ -14,6 +14,9 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -53,3 +56,64 @@ func TestLoadConfiguration(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestLoadConfiguration_validate(t *testing.T) {
+	for _, test := range []struct {
+		config  string
+		setting string
+	}{
+		{"[cache]\n  cache_type = 'memroy'\n", "cache_type"},
+		{"[cache]\n  serialization = 'jsn'\n", "serialization"},
+		{"[cache]\n  compression = 'snapy'\n", "compression"},
+		{"[origins]\n  [origins.default]\n    origin_type = 'promethues'\n", "origin_type"},
+		{"[origins]\n  [origins.default]\n    load_balancing = 'roundrobin'\n", "load_balancing"},
+		{"[origins]\n  [origins.default]\n    client_rate_limit_key = 'token'\n", "client_rate_limit_key"},
+		{"[cache]\n  serialization = 'json'\n  compression = 'gzip'\n" +
+			"[origins]\n  [origins.default]\n    origin_type = 'fanout'\n    load_balancing = 'hedged'\n    client_rate_limit_key = 'Authorization'\n", ""},
+	} {
+		f, err := ioutil.TempFile("", "trickster")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		f.WriteString(test.config)
+		f.Close()
+
+		// it should reject unknown values of each setting with options
+		err = loadConfiguration(NewConfig(), []string{"-config", f.Name()})
+		if test.setting == "" && err != nil {
+			t.Errorf("unexpected error %v", err)
+		} else if test.setting != "" && (err == nil || !strings.Contains(err.Error(), test.setting)) {
+			t.Errorf("wanted a %s error got %v", test.setting, err)
+		}
+	}
+}
+
+func TestLoadConfiguration_fastForward(t *testing.T) {
+	for _, test := range []struct {
+		mode string
+		ok   bool
+	}{
+		{"append-unaligned", true},
+		{"append", true},
+		{"snap", true},
+		{"off", true},
+		{"snapp", false},
+	} {
+		f, err := ioutil.TempFile("", "trickster")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		f.WriteString("[origins]\n  [origins.default]\n    fast_forward = '" + test.mode + "'\n")
+		f.Close()
+
+		// it should reject unknown fast forward modes
+		err = loadConfiguration(NewConfig(), []string{"-config", f.Name()})
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error %v", test.mode, err)
+		} else if !test.ok && (err == nil || !strings.Contains(err.Error(), "fast_forward")) {
+			t.Errorf("%s: wanted a fast_forward error got %v", test.mode, err)
+		}
+	}
+}
@@ -14,11 +14,12 @@
 package main
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"math"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
@@ -29,7 +30,6 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
-	"github.com/golang/snappy"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/model"
@@ -38,24 +38,42 @@ import (
 const (
 	// Origin database types
 	otPrometheus = "prometheus"
+	otFanout     = "fanout"
 
 	// Common HTTP Header Values
 	hvNoCache         = "no-cache"
 	hvApplicationJSON = "application/json"
+	hvFormURLEncoded  = "application/x-www-form-urlencoded"
 
 	// Common HTTP Header Names
 	hnCacheControl  = "Cache-Control"
 	hnAllowOrigin   = "Access-Control-Allow-Origin"
 	hnContentType   = "Content-Type"
 	hnAuthorization = "Authorization"
+	hnStale         = "X-Trickster-Stale"
+	hnRetryAfter    = "Retry-After"
+	hnXForwardedFor = "X-Forwarded-For"
+	hnVia           = "Via"
 
 	// HTTP methods
 	hmGet = "GET"
 
+	// defaultSplitConcurrency is the default maximum number of split origin requests in flight for a client request
+	defaultSplitConcurrency = 4
+
 	// Prometheus response values
 	rvSuccess = "success"
 	rvMatrix  = "matrix"
 	rvVector  = "vector"
+	rvScalar  = "scalar"
+	rvString  = "string"
+	rvError   = "error"
+
+	// Prometheus error types
+	etTooManyRequests = "too_many_requests"
+	etUnauthorized    = "unauthorized"
+	etForbidden       = "forbidden"
+	etBadData         = "bad_data"
 
 	// Common URL parameter names
 	upQuery      = "query"
@@ -67,23 +85,41 @@ const (
 	upTimeout    = "timeout"
 	upOrigin     = "origin"
 	upTime       = "time"
+	upTimeShift  = "timeShift"
+	upStats      = "stats"
 
 	// Cache lookup results
-	crKeyMiss    = "kmiss"
-	crRangeMiss  = "rmiss"
-	crHit        = "hit"
-	crPartialHit = "phit"
-	crPurge      = "purge"
+	crKeyMiss       = "kmiss"
+	crRangeMiss     = "rmiss"
+	crHit           = "hit"
+	crPartialHit    = "phit"
+	crPurge         = "purge"
+	crStale         = "stale"
+	crDownsampleHit = "dhit"
+
+	// Warnings Trickster adds to responses
+	twStale        = "origin is unavailable; results were served from the Trickster cache and may be incomplete or stale"
+	twPartialStale = "origin is unavailable for part of the requested range; results were served partially from the Trickster cache and may be incomplete or stale"
+	twFastForward  = "origin is unavailable; the most recent data could not be fetched and may be missing"
 )
 
 // TricksterHandler contains the services the Handlers need to operate
 type TricksterHandler struct {
-	Logger           log.Logger
-	Config           *Config
-	Metrics          *ApplicationMetrics
-	Cacher           Cache
-	ResponseChannels map[string]chan *ClientRequestContext
-	ChannelCreateMtx sync.Mutex
+	Logger             log.Logger
+	Config             *Config
+	Metrics            *ApplicationMetrics
+	Cacher             Cache
+	ResponseChannels   map[string]chan *ClientRequestContext
+	ChannelCreateMtx   sync.Mutex
+	UpstreamPools      map[string]*UpstreamPool
+	UpstreamPoolsMtx   sync.Mutex
+	CircuitBreakers    map[string]*CircuitBreaker
+	CircuitBreakersMtx sync.Mutex
+	RateLimiters       map[string]*RateLimiter
+	RateLimitersMtx    sync.Mutex
+	ProxyTransports    map[string]*http.Transport
+	ProxyTransportsMtx sync.Mutex
+	Authenticator      *ProxyAuthenticator
 }
 
 // HTTP Handlers
@@ -104,9 +140,9 @@ func (t *TricksterHandler) promHealthCheckHandler(w http.ResponseWriter, r *http
 	// Check the labels path for Prometheus Origin Handler to satisfy health check
 	path := prometheusAPIv1Path + mnLabels
 
-	origin := t.getOrigin(r)
+	origin := t.getProxyOrigin(r)
 	originURL := origin.OriginURL + strings.Replace(path, "//", "/", 1)
-	body, resp, _, err := t.getURL(origin, r.Method, originURL, r.URL.Query(), getProxyableClientHeaders(r))
+	body, resp, _, err := t.getURL(r.Context(), origin, r.Method, originURL, r.URL.Query(), getProxyableClientHeaders(origin, r))
 	if err != nil {
 		level.Error(t.Logger).Log(lfEvent, "error fetching data from origin Prometheus", lfDetail, err.Error())
 		w.WriteHeader(http.StatusBadGateway)
@@ -121,40 +157,13 @@ func (t *TricksterHandler) promHealthCheckHandler(w http.ResponseWriter, r *http
 	w.Write(body)
 }
 
-// promFullProxyHandler handles calls to non-api paths for single-origin configurations and multi-origin via param or hostname
-// can't support multi-origin full proxy for path-based proxying
-func (t *TricksterHandler) promFullProxyHandler(w http.ResponseWriter, r *http.Request) {
-	level.Debug(t.Logger).Log(lfEvent, "promFullProxyHandler", "path", r.URL.Path, "method", r.Method)
-
-	path := r.URL.Path
-	vars := mux.Vars(r)
-
-	// clear out the origin moniker from the front of the API path
-	if originName, ok := vars["originMoniker"]; ok {
-		if strings.HasPrefix(path, "/"+originName) {
-			path = strings.Replace(path, "/"+originName, "", 1)
-		}
-	}
-
-	origin := t.getOrigin(r)
-	originURL := origin.OriginURL + strings.Replace(path, "//", "/", 1)
-	body, resp, _, err := t.getURL(origin, r.Method, originURL, r.URL.Query(), getProxyableClientHeaders(r))
-	if err != nil {
-		level.Error(t.Logger).Log(lfEvent, "error fetching data from origin Prometheus", lfDetail, err.Error())
-		w.WriteHeader(http.StatusBadGateway)
+// promQueryHandler handles calls to /query (for instantaneous values)
+func (t *TricksterHandler) promQueryHandler(w http.ResponseWriter, r *http.Request) {
+	if o := t.getOrigin(r); o.OriginType == otFanout {
+		t.promFanoutQueryHandler(w, r, o)
 		return
 	}
 
-	for k, v := range resp.Header {
-		w.Header().Set(k, strings.Join(v, ","))
-	}
-
-	w.WriteHeader(resp.StatusCode)
-	w.Write(body)
-}
-
-// promQueryHandler handles calls to /query (for instantaneous values)
-func (t *TricksterHandler) promQueryHandler(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 	vars := mux.Vars(r)
 
@@ -187,6 +196,11 @@ func (t *TricksterHandler) promQueryHandler(w http.ResponseWriter, r *http.Reque
 
 // promQueryRangeHandler handles calls to /query_range (requests for timeseries values)
 func (t *TricksterHandler) promQueryRangeHandler(w http.ResponseWriter, r *http.Request) {
+	if o := t.getOrigin(r); o.OriginType == otFanout {
+		t.promFanoutQueryRangeHandler(w, r, o)
+		return
+	}
+
 	ctx, err := t.buildRequestContext(w, r)
 	if err != nil {
 		level.Error(t.Logger).Log(lfEvent, "error building request context", lfDetail, err.Error())
@@ -197,7 +211,7 @@ func (t *TricksterHandler) promQueryRangeHandler(w http.ResponseWriter, r *http.
 	// This WaitGroup ensures that the server does not write the response until we are 100% done Trickstering the range request.
 	// The responsders that fulfill client requests will mark the waitgroup done when the response is ready for delivery.
 	ctx.WaitGroup.Add(1)
-	if ctx.CacheLookupResult == crHit {
+	if ctx.CacheLookupResult == crHit || ctx.CacheLookupResult == crDownsampleHit {
 		t.respondToCacheHit(ctx)
 	} else {
 		t.queueRangeProxyRequest(ctx)
@@ -221,18 +235,43 @@ func defaultPrometheusMatrixEnvelope() PrometheusMatrixEnvelope {
 	}
 }
 
-// getProxyableClientHeaders returns any pertinent http headers from the client that we should pass through to the Origin when proxying
-func getProxyableClientHeaders(r *http.Request) http.Header {
+// getProxyableClientHeaders returns any pertinent http headers from the client that we should pass through to the Origin when proxying:
+// the origin's forwarded headers (by default, Authorization), and X-Forwarded-For and Via headers identifying the client and Trickster
+func getProxyableClientHeaders(o PrometheusOriginConfig, r *http.Request) http.Header {
 	headers := http.Header{}
 
-	// pass through Authorization Header
-	if authorization, ok := r.Header[hnAuthorization]; ok {
-		headers.Add(hnAuthorization, strings.Join(authorization, " "))
+	for _, name := range forwardHeaders(o) {
+		name = http.CanonicalHeaderKey(name)
+		if values, ok := r.Header[name]; ok {
+			headers[name] = append([]string(nil), values...)
+		}
+	}
+
+	// append the client to any proxies it came through
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior, ok := r.Header[hnXForwardedFor]; ok {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		headers.Set(hnXForwardedFor, ip)
 	}
 
+	via := fmt.Sprintf("%d.%d %s", r.ProtoMajor, r.ProtoMinor, applicationName)
+	if prior, ok := r.Header[hnVia]; ok {
+		via = strings.Join(prior, ", ") + ", " + via
+	}
+	headers.Set(hnVia, via)
+
 	return headers
 }
 
+// forwardHeaders returns the names of the client request headers that are passed through to the origin
+func forwardHeaders(o PrometheusOriginConfig) []string {
+	if o.ForwardHeaders == nil {
+		return []string{hnAuthorization}
+	}
+	return o.ForwardHeaders
+}
+
 // getOrigin determines the origin server to service the request based on the Host header and url params
 func (t *TricksterHandler) getOrigin(r *http.Request) PrometheusOriginConfig {
 	var originName string
@@ -240,20 +279,28 @@ func (t *TricksterHandler) getOrigin(r *http.Request) PrometheusOriginConfig {
 
 	vars := mux.Vars(r)
 
-	// Check for the Origin Name URL Path
-	if originName, ok = vars["originMoniker"]; !ok {
-		// Check for the Origin Name URL Parmameter (origin=)
-		if on, ok := r.URL.Query()[upOrigin]; ok {
-			originName = on[1]
-		} else {
-			// Otherwise use the Host Header
-			originName = r.Host
+	// Check for a Fanout Member Origin Name in the request context
+	if originName, ok = r.Context().Value(fanoutMemberKey).(string); !ok {
+		// Check for the Origin Name URL Path
+		if originName, ok = vars["originMoniker"]; !ok {
+			// Check for the Origin Name URL Parmameter (origin=)
+			if on, ok := r.URL.Query()[upOrigin]; ok {
+				originName = on[1]
+			} else {
+				// Otherwise use the Host Header
+				originName = r.Host
+			}
 		}
 	}
 
+	return t.getOriginByName(originName)
+}
+
+// getOriginByName returns the named origin, or the default origin if there is no origin by that name
+func (t *TricksterHandler) getOriginByName(originName string) PrometheusOriginConfig {
 	// If we have matching origin in our Origins Map, return it.
 	if p, ok := t.Config.Origins[originName]; ok {
-		return p
+		return withPrimaryUpstream(p)
 	}
 
 	// Otherwise, return the default origin if it is configured
@@ -264,8 +311,17 @@ func (t *TricksterHandler) getOrigin(r *http.Request) PrometheusOriginConfig {
 
 	if t.Config.DefaultOriginURL != "" {
 		p.OriginURL = t.Config.DefaultOriginURL
+		p.OriginURLs = nil
 	}
 
+	return withPrimaryUpstream(p)
+}
+
+// withPrimaryUpstream defaults the OriginURL of an origin configured only with OriginURLs to its first upstream
+func withPrimaryUpstream(p PrometheusOriginConfig) PrometheusOriginConfig {
+	if p.OriginURL == "" && len(p.OriginURLs) > 0 {
+		p.OriginURL = p.OriginURLs[0]
+	}
 	return p
 }
 
@@ -278,29 +334,57 @@ func setResponseHeaders(w http.ResponseWriter) {
 	w.Header().Set(hnContentType, hvApplicationJSON)
 }
 
-// getURL makes an HTTP request to the provided URL with the provided parameters and returns the response body
-func (t *TricksterHandler) getURL(o PrometheusOriginConfig, method string, uri string, params url.Values, headers http.Header) ([]byte, *http.Response, time.Duration, error) {
-	if len(params) > 0 {
+// getURL makes an HTTP request to the provided URL with the provided parameters and returns the response body.
+// POST requests send the parameters as a form-encoded body, as Prometheus accepts for its query endpoints,
+// so that large queries aren't limited by the maximum URL length. The request gives up waiting for a free origin
+// request slot when ctx is done
+func (t *TricksterHandler) getURL(ctx context.Context, o PrometheusOriginConfig, method string, uri string, params url.Values, headers http.Header) ([]byte, *http.Response, time.Duration, error) {
+	var body []byte
+	if method == http.MethodPost {
+		body = []byte(params.Encode())
+		h := http.Header{}
+		for k, v := range headers {
+			h[k] = v
+		}
+		h.Set(hnContentType, hvFormURLEncoded)
+		headers = h
+	} else if len(params) > 0 {
 		uri += "?" + params.Encode()
 	}
 
-	parsedURL, err := url.Parse(uri)
-	if err != nil {
+	return t.requestURL(ctx, o, method, uri, headers, body)
+}
+
+// requestURL makes an HTTP request to the provided URL with the provided body and returns the response body
+func (t *TricksterHandler) requestURL(ctx context.Context, o PrometheusOriginConfig, method string, uri string, headers http.Header, reqBody []byte) ([]byte, *http.Response, time.Duration, error) {
+	if _, err := url.Parse(uri); err != nil {
 		return nil, nil, 0, fmt.Errorf("error parsing URL %q: %v", uri, err)
 	}
 
-	startTime := time.Now()
-	client := &http.Client{Timeout: time.Duration(o.TimeoutSecs * time.Second.Nanoseconds())}
+	// the slot is acquired first, so a half-open breaker's probe can't be lost while waiting for one
+	rl := t.getRateLimiter(o)
+	if err := rl.acquire(ctx); err != nil {
+		return nil, nil, 0, err
+	}
 
-	resp, err := client.Do(&http.Request{Method: method, URL: parsedURL})
-	if err != nil {
-		return nil, nil, 0, fmt.Errorf("error downloading URL %q: %v", uri, err)
+	cb := t.getCircuitBreaker(o)
+	if !cb.allow() {
+		rl.release()
+		return nil, nil, 0, errCircuitOpen
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	startTime := time.Now()
+
+	body, resp, err := t.doOriginRequest(ctx, o, method, uri, t.originRequestHeaders(o, headers), reqBody)
+	rl.release()
+	if err != nil && ctx.Err() != nil {
+		// the client went away, which says nothing about the origin
+		cb.abandon()
+	} else {
+		cb.record(err == nil && resp.StatusCode < http.StatusInternalServerError)
+	}
 	if err != nil {
-		return nil, nil, 0, fmt.Errorf("error reading body from HTTP response for URL %q: %v", uri, err)
+		return nil, nil, 0, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
@@ -325,14 +409,10 @@ func (t *TricksterHandler) getVectorFromPrometheus(url string, params url.Values
 	if err != nil {
 		return pe, body, nil, fmt.Errorf("error fetching data from Prometheus: %v", err)
 	}
-	// Unmarshal the prometheus data into another PrometheusMatrixEnvelope
+	// Unmarshal the prometheus data into a PrometheusVectorEnvelope, which also holds scalar and string results
 	err = json.Unmarshal(body, &pe)
 	if err != nil {
-		// If we get a scalar response, we just want to return the resp without an error
-		// this will allow the upper layers to just use the raw response
-		if pe.Data.ResultType != "scalar" {
-			return pe, nil, nil, fmt.Errorf("Prometheus vector unmarshaling error for URL %q: %v", url, err)
-		}
+		return pe, nil, nil, fmt.Errorf("Prometheus vector unmarshaling error for URL %q: %v", url, err)
 	}
 
 	return pe, body, resp, nil
@@ -342,7 +422,8 @@ func (t *TricksterHandler) getMatrixFromPrometheus(url string, params url.Values
 	pe := PrometheusMatrixEnvelope{}
 
 	// Make the HTTP Request - don't use fetchPromQuery here, that is for instantaneous only.
-	body, resp, duration, err := t.getURL(t.getOrigin(r), r.Method, url, params, getProxyableClientHeaders(r))
+	o := t.getOrigin(r)
+	body, resp, duration, err := t.getURL(r.Context(), o, r.Method, url, params, getProxyableClientHeaders(o, r))
 	if err != nil {
 		return pe, nil, nil, 0, err
 	}
@@ -359,36 +440,17 @@ func (t *TricksterHandler) getMatrixFromPrometheus(url string, params url.Values
 }
 
 // fetchPromQuery checks for cached instantaneous value for the query and returns it if found,
-// otherwise proxies the request to the Prometheus origin and sets the cache with a low TTL
+// otherwise proxies the request to the Prometheus origin and sets the cache with the TTL from the origin's instant query policy
 // fetchPromQuery does not do any data marshalling
 func (t *TricksterHandler) fetchPromQuery(originURL string, params url.Values, r *http.Request) ([]byte, *http.Response, error) {
-	var ttl int64 = 15
-	var end int64
-	var err error
+	o := t.getOrigin(r)
 
-	cacheKeyBase := originURL
-	// if we have an authorization header, that should be part of the cache key to ensure only authorized users can access cached datasets
-	if authorization, ok := r.Header[hnAuthorization]; ok {
-		cacheKeyBase += strings.Join(authorization, " ")
-	}
-
-	if ts, ok := params[upTime]; ok {
-		reqStart, err := parseTime(ts[0])
-		if err != nil {
-			return nil, nil, err
-		}
-		end = reqStart.Unix()
-		if end <= (time.Now().Unix()-1800) && end%1800 == 0 {
-			// the Time param is perfectly on the hour and not recent, this is unusual for random dashboard loads.
-			// It might be some kind of a daily or hourly rollup. Let's cache it longer than 15s
-			ttl = 1800
-		}
-		end = (end / 15) * 15
-
-		params.Set(upTime, strconv.Itoa(int(end)))
+	ttl, err := instantQueryPolicy(o).apply(params, time.Now().Unix())
+	if err != nil {
+		return nil, nil, err
 	}
 
-	cacheKey := deriveCacheKey(cacheKeyBase, params)
+	cacheKey := deriveCacheKey(o, originURL, r.Header, params)
 
 	var body []byte
 	resp := &http.Response{}
@@ -400,16 +462,20 @@ func (t *TricksterHandler) fetchPromQuery(originURL string, params url.Values, r
 	cachedBody, err := t.Cacher.Retrieve(cacheKey)
 	if err != nil {
 		// Cache Miss, we need to get it from prometheus
-		body, resp, duration, err = t.getURL(t.getOrigin(r), r.Method, originURL, params, getProxyableClientHeaders(r))
+		body, resp, duration, err = t.getURL(r.Context(), o, r.Method, originURL, params, getProxyableClientHeaders(o, r))
 		if err != nil {
 			return nil, nil, err
 		}
 
 		t.Metrics.ProxyRequestDuration.WithLabelValues(originURL, otPrometheus, mnQuery, crKeyMiss, strconv.Itoa(resp.StatusCode)).Observe(duration.Seconds())
-		t.Cacher.Store(cacheKey, string(body), ttl)
+		if record, err := t.encodeCacheRecord(body); err == nil {
+			t.Cacher.Store(cacheKey, record, ttl)
+		} else {
+			level.Error(t.Logger).Log(lfEvent, "error encoding cache record", lfDetail, err.Error())
+		}
 	} else {
 		// Cache hit, return the data set
-		body = []byte(cachedBody)
+		body = decodeCacheRecord(cachedBody)
 		cacheResult = crHit
 		resp.StatusCode = http.StatusOK
 	}
@@ -436,7 +502,12 @@ func (t *TricksterHandler) buildRequestContext(w http.ResponseWriter, r *http.Re
 	if err := r.ParseForm(); err != nil {
 		return nil, errors.Wrap(err, "unable to parse form")
 	}
-	ctx.RequestParams = r.Form
+	// Copy the params, since the query and time range of a time-shifted request are rewritten below, and the
+	// request's context is rebuilt from the original params once it is dequeued for the origin
+	ctx.RequestParams = make(url.Values, len(r.Form))
+	for k, v := range r.Form {
+		ctx.RequestParams[k] = v
+	}
 
 	// Validate and parse the step value from the user request URL params.
 	if len(ctx.RequestParams[upStep]) == 0 {
@@ -452,23 +523,19 @@ func (t *TricksterHandler) buildRequestContext(w http.ResponseWriter, r *http.Re
 	}
 	ctx.StepMS = int64(step.Seconds() * 1000)
 
-	cacheKeyBase := ctx.Origin.OriginURL + ctx.StepParam
-	// if we have an authorization header, that should be part of the cache key to ensure only authorized users can access cached datasets
-	if authorization, ok := r.Header[hnAuthorization]; ok {
-		cacheKeyBase += strings.Join(authorization, " ")
+	// Time-shifted requests are served from the cache of the unshifted query
+	if err := applyTimeShift(ctx); err != nil {
+		return nil, err
 	}
 
 	// Derive a hashed cacheKey for the query where we will get and set the result set
 	// inclusion of the step ensures that datasets with different resolutions are not written to the same key.
-	ctx.CacheKey = deriveCacheKey(cacheKeyBase, ctx.RequestParams)
+	ctx.CacheKey = rangeCacheKey(ctx.Origin, ctx.StepMS, r.Header, ctx.RequestParams)
 
 	// We will look for a Cache-Control: No-Cache request header and,
 	// if present, bypass the cache for a fresh full query from prometheus.
 	// Any user can trigger w/ hard reload (ctrl/cmd+shift+r) to clear out cache-related anomalies
-	noCache := false
-	if ctx.Origin.IgnoreNoCacheHeader == false && (strings.ToLower(r.Header.Get(hnCacheControl)) == hvNoCache) {
-		noCache = true
-	}
+	noCache := noCacheRequested(ctx.Origin, r)
 
 	// get the browser-requested start/end times, so we can determine what part of the range is not in the cache
 	if len(ctx.RequestParams[upStart]) == 0 {
@@ -489,7 +556,8 @@ func (t *TricksterHandler) buildRequestContext(w http.ResponseWriter, r *http.Re
 		return nil, errors.Wrap(err, fmt.Sprintf("failed to parse parameter %q with value %q", upEnd, ctx.RequestParams[upEnd][0]))
 	}
 
-	ctx.RequestExtents.Start, ctx.RequestExtents.End, err = alignStepBoundaries(reqStart.Unix()*1000, reqEnd.Unix()*1000, ctx.StepMS, ctx.Time)
+	ctx.RequestExtents.Start, ctx.RequestExtents.End, err = alignStepBoundaries(reqStart.Unix()*1000-ctx.ShiftMS,
+		reqEnd.Unix()*1000-ctx.ShiftMS, ctx.StepMS, ctx.Time)
 	if err != nil {
 		return nil, errors.Wrap(err, "error aligning step boundary")
 	}
@@ -498,12 +566,17 @@ func (t *TricksterHandler) buildRequestContext(w http.ResponseWriter, r *http.Re
 	ctx.Matrix = defaultPrometheusMatrixEnvelope()
 	ctx.CacheLookupResult = crKeyMiss
 
-	// parameters for filling gap on the upper bound
-	ctx.OriginUpperExtents.Start = ctx.RequestExtents.Start
-	ctx.OriginUpperExtents.End = ctx.RequestExtents.End
+	// Until we know what's in the cache, the whole request is fetched from the origin
+	ctx.OriginExtents = ExtentList{ctx.RequestExtents}
 
 	// Get the cached result set if present
-	cachedBody, err := t.Cacher.Retrieve(ctx.CacheKey)
+	var cachedBody []byte
+	var cachedMatrix PrometheusMatrixEnvelope
+	if ctx.Origin.ChunkSizeSecs > 0 {
+		cachedMatrix, err = t.retrieveChunks(ctx)
+	} else {
+		cachedBody, err = t.Cacher.Retrieve(ctx.CacheKey)
+	}
 
 	if err != nil || noCache {
 		// Cache Miss, Get the whole blob from Prometheus.
@@ -516,90 +589,92 @@ func (t *TricksterHandler) buildRequestContext(w http.ResponseWriter, r *http.Re
 		// So we can have a Range Miss, Partial Hit, Full Hit when comparing cached range to what the client requested.
 		// So let's find out what we are missing (if anything) and fetch what we don't have
 
-		// See if cache data is compressed by looking for the first character to be "{":, with which the uncompressed JSON would start
-		// We do this instead of checking the Compression config bit because if someone turns compression on or off when using filesystem or redis cache,
-		// we will have no idea if what is already in the cache was compressed or not based on previous settings
-		cb := []byte(cachedBody)
-		if cb[0] != 123 {
-			// Not a JSON object, try decompressing
-			level.Debug(t.Logger).Log("event", "Decompressing Cached Data", "cacheKey", ctx.CacheKey)
-			cb, err = snappy.Decode(nil, cb)
-			if err == nil {
-				cachedBody = string(cb)
+		if ctx.Origin.ChunkSizeSecs > 0 {
+			ctx.Matrix = cachedMatrix
+		} else {
+			// Decode the cache payload into a PrometheusMatrixEnvelope struct
+			err = decodeCacheMatrix(cachedBody, &ctx.Matrix)
+			// If there is an error unmarshaling the cache we should treat it as a cache miss
+			// and re-fetch from origin
+			if err != nil {
+				ctx.Matrix = defaultPrometheusMatrixEnvelope()
+				ctx.CacheLookupResult = crRangeMiss
+				return ctx, nil
 			}
 		}
 
-		// Marshall the cache payload into a PrometheusMatrixEnvelope struct
-		err = json.Unmarshal([]byte(cachedBody), &ctx.Matrix)
-		// If there is an error unmarshaling the cache we should treat it as a cache miss
-		// and re-fetch from origin
-		if err != nil {
-			ctx.CacheLookupResult = crRangeMiss
-			return ctx, nil
-		}
-
-		// Get the Extents of the data in the cache
-		ce := ctx.Matrix.getExtents()
-
-		extent := "none"
+		// Get the ranges that were fetched into the cache, which may have gaps (e.g., from an origin outage)
+		ce := ctx.Matrix.cachedExtents()
 
 		// Figure out our Deltas
-		if ce.End == 0 || ce.Start == 0 {
-			// Something went wrong fetching extents
-			ctx.CacheLookupResult = crRangeMiss
-		} else if ctx.RequestExtents.Start >= ce.Start && ctx.RequestExtents.End <= ce.End {
+		ctx.OriginExtents = ce.missing(ctx.RequestExtents, ctx.StepMS)
+		switch {
+		case len(ctx.OriginExtents) == 0:
 			// Full cache hit, no need to refresh dataset.
 			// Everything we are requesting is already in cache
 			ctx.CacheLookupResult = crHit
-			ctx.OriginUpperExtents.Start = 0
-			ctx.OriginUpperExtents.End = 0
-		} else if ctx.RequestExtents.Start < ce.Start && ctx.RequestExtents.End > ce.End {
-			// Partial Cache hit on both ends.
-			ctx.CacheLookupResult = crPartialHit
-			ctx.OriginUpperExtents.Start = ce.End + ctx.StepMS
-			ctx.OriginUpperExtents.End = ctx.RequestExtents.End
-			ctx.OriginLowerExtents.Start = ((ctx.RequestExtents.Start / ctx.StepMS) * ctx.StepMS)
-			ctx.OriginLowerExtents.End = ce.Start
-			extent = "both"
-		} else if ctx.RequestExtents.Start > ce.End {
-			// Range Miss on the Upper Extent of Cache. We will fill from where our cached data stops to the requested end
+		case len(ctx.OriginExtents) == 1 && ctx.OriginExtents[0] == ctx.RequestExtents:
+			// Range Miss, nothing we are requesting is in the cache
 			ctx.CacheLookupResult = crRangeMiss
-			ctx.OriginUpperExtents.Start = ce.End + ctx.StepMS
-			extent = "upper"
-		} else if ctx.RequestExtents.End > ce.End {
-			// Partial Cache Hit, Missing the Upper Extent
+		default:
+			// Partial Cache hit, we will fill each missing range from the origin
 			ctx.CacheLookupResult = crPartialHit
-			ctx.OriginUpperExtents.Start = ce.End + ctx.StepMS
-			extent = "upper"
-		} else if ctx.RequestExtents.End < ce.Start {
-			// Range Miss on the Lower Extent of Cache. We will fill from the requested start up to where our cached data stops
-			ctx.CacheLookupResult = crRangeMiss
-			ctx.OriginLowerExtents.Start = ((ctx.RequestExtents.Start / ctx.StepMS) * ctx.StepMS)
-			ctx.OriginLowerExtents.End = ce.Start - ctx.StepMS
-			ctx.OriginUpperExtents.Start = 0
-			ctx.OriginUpperExtents.End = 0
-			extent = "lower"
-		} else if ctx.RequestExtents.Start < ce.Start {
-			// Partial Cache Hit, Missing Lower Extent
-			ctx.CacheLookupResult = crPartialHit
-			ctx.OriginLowerExtents.Start = ((ctx.RequestExtents.Start / ctx.StepMS) * ctx.StepMS)
-			ctx.OriginLowerExtents.End = ce.Start - ctx.StepMS
-			ctx.OriginUpperExtents.Start = 0
-			ctx.OriginUpperExtents.End = 0
-			extent = "upper"
-		} else {
-			panic(fmt.Sprintf("Reaching this final clause should be impossible. Yikes! reqStart=%d, reqEnd=%d, ce.Start=%d, ce.End=%d", ctx.RequestExtents.Start, ctx.RequestExtents.End, ce.Start, ce.End))
+		}
+
+		if ctx.Origin.BackfillToleranceSecs > 0 {
+			applyBackfillTolerance(ctx, ce)
 		}
 
 		level.Debug(t.Logger).Log(lfEvent, "deltaRoutineCompleted", "CacheLookupResult", ctx.CacheLookupResult, lfCacheKey, ctx.CacheKey,
-			"cacheStart", ce.Start, "cacheEnd", ce.End, "reqStart", ctx.RequestExtents.Start, "reqEnd", ctx.RequestExtents.End,
-			"OriginLowerExtents.Start", ctx.OriginLowerExtents.Start, "OriginLowerExtents.End", ctx.OriginLowerExtents.End,
-			"OriginUpperExtents.Start", ctx.OriginUpperExtents.Start, "OriginUpperExtents.End", ctx.OriginUpperExtents.End, "extent", extent)
+			"cachedExtents", fmt.Sprintf("%v", ce), "reqStart", ctx.RequestExtents.Start, "reqEnd", ctx.RequestExtents.End,
+			"originExtents", fmt.Sprintf("%v", ctx.OriginExtents))
+	}
+
+	// A request for a coarser step than is cached may be answered from the cached results of a finer step
+	if len(ctx.Origin.DownsampleSteps) > 0 && ctx.CacheLookupResult != crHit && !noCache {
+		t.downsampleFromCache(ctx)
 	}
 
 	return ctx, nil
 }
 
+// applyBackfillTolerance adds the cached points the request touches that are within the origin's backfill tolerance
+// window to the extents fetched from the origin, since they may have changed since they were cached (e.g., late
+// scrapes or recording rules catching up). ce is the extents of the cached data
+func applyBackfillTolerance(ctx *ClientRequestContext, ce ExtentList) {
+	windowStart := ((ctx.Time - ctx.Origin.BackfillToleranceSecs) * 1000 / ctx.StepMS) * ctx.StepMS
+
+	// Re-fetch the part of each cached range within the window that the request touches. Only the cached points within
+	// the fetched extents are replaced, so the cached points outside the request are kept as they are
+	refetched := false
+	for _, x := range ce.crop(windowStart, 0) {
+		if ctx.RequestExtents.End < x.Start || ctx.RequestExtents.Start > x.End {
+			continue
+		}
+
+		e := x
+		if ctx.RequestExtents.Start > e.Start {
+			e.Start = ctx.RequestExtents.Start
+		}
+		if ctx.RequestExtents.End < e.End {
+			e.End = ctx.RequestExtents.End
+		}
+
+		ctx.OriginExtents = ctx.OriginExtents.add(e, ctx.StepMS)
+		refetched = true
+	}
+
+	if refetched && ctx.CacheLookupResult == crHit {
+		ctx.CacheLookupResult = crPartialHit
+	}
+}
+
+// noCacheRequested returns true if the client sent a Cache-Control: no-cache request header to bypass the cache,
+// and the origin doesn't ignore it
+func noCacheRequested(o PrometheusOriginConfig, r *http.Request) bool {
+	return !o.IgnoreNoCacheHeader && strings.ToLower(r.Header.Get(hnCacheControl)) == hvNoCache
+}
+
 func (t *TricksterHandler) respondToCacheHit(ctx *ClientRequestContext) {
 	defer ctx.WaitGroup.Done()
 	t.Metrics.CacheRequestStatus.WithLabelValues(ctx.Origin.OriginURL, otPrometheus, mnQueryRange, ctx.CacheLookupResult, "200").Inc()
@@ -610,7 +685,7 @@ func (t *TricksterHandler) respondToCacheHit(ctx *ClientRequestContext) {
 	r := &http.Response{}
 
 	// If Fast Forward is enabled and the request is a real-time request, go get that data
-	if !ctx.Origin.FastForwardDisable && !(ctx.RequestExtents.End < (ctx.Time*1000)-ctx.StepMS) {
+	if ctx.Origin.fastForwardMode() != ffOff && ctx.ShiftMS == 0 && !(ctx.RequestExtents.End < (ctx.Time*1000)-ctx.StepMS) {
 		// Query the latest points if Fast Forward is enabled
 		queryURL := ctx.Origin.OriginURL + mnQuery
 		originParams := url.Values{}
@@ -621,15 +696,21 @@ func (t *TricksterHandler) respondToCacheHit(ctx *ClientRequestContext) {
 		ffd, _, resp, err := t.getVectorFromPrometheus(queryURL, originParams, ctx.Request)
 		if err != nil {
 			level.Error(t.Logger).Log(lfEvent, "error fetching data from origin Prometheus", lfDetail, err.Error())
-			ctx.Writer.WriteHeader(http.StatusBadGateway)
-			return
-		}
-		r = resp
-		if resp.StatusCode == http.StatusOK && ffd.Status == rvSuccess {
-			ctx.Matrix = t.mergeVector(ctx.Matrix, ffd)
+			if !ctx.Origin.ServeStaleOnError {
+				ctx.Writer.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			markStale(ctx.Writer, &ctx.Matrix, twFastForward)
+		} else {
+			r = resp
+			if resp.StatusCode == http.StatusOK && ffd.Status == rvSuccess {
+				ctx.Matrix = t.mergeVector(ctx.Matrix, ffd, ctx.Origin.fastForwardMode(), ctx.StepMS)
+			}
 		}
 	}
 
+	ctx.Matrix.shiftTimestamps(ctx.ShiftMS)
+
 	// Marshal the Envelope back to a json object for User Response)
 	body, err := json.Marshal(ctx.Matrix)
 	if err != nil {
@@ -653,6 +734,12 @@ func writeResponse(w http.ResponseWriter, body []byte, resp *http.Response) {
 	w.Write(body)
 }
 
+// writePrometheusError responds with the provided status and a Prometheus error envelope
+func writePrometheusError(w http.ResponseWriter, status int, errorType string, message string) {
+	body, _ := json.Marshal(PrometheusErrorEnvelope{Status: rvError, ErrorType: errorType, Error: message})
+	writeResponse(w, body, &http.Response{StatusCode: status})
+}
+
 func (t *TricksterHandler) queueRangeProxyRequest(ctx *ClientRequestContext) {
 	t.ChannelCreateMtx.Lock()
 	ch, ok := t.ResponseChannels[ctx.CacheKey]
@@ -700,81 +787,53 @@ func (t *TricksterHandler) originRangeProxyHandler(cacheKey string, originRangeR
 		}
 
 		// The cache miss became a cache hit between the time it was queued and processed.
-		if ctx.CacheLookupResult == crHit {
+		if ctx.CacheLookupResult == crHit || ctx.CacheLookupResult == crDownsampleHit {
 			level.Debug(t.Logger).Log(lfEvent, "delayedCacheHit", lfDetail, "cache was populated with needed data by another proxy request while this one was queued.")
 			// Lay the newly-retreived data into the original origin range request so it can fully service the client
 			r.Matrix = ctx.Matrix
 			// And change the lookup result to a hit.
-			r.CacheLookupResult = crHit
+			r.CacheLookupResult = ctx.CacheLookupResult
 			// Respond with the modified original request object so the right WaitGroup is marked as Done()
 			t.respondToCacheHit(r)
 		} else {
 
-			// Now we know if we need to make any calls to the Origin, lets set those up
-			upperDeltaData := PrometheusMatrixEnvelope{}
-			lowerDeltaData := PrometheusMatrixEnvelope{}
+			// Now we know if we need to make any calls to the Origin, lets set those up.
+			// Large ranges are split into several smaller requests, of which only a few are in flight at once
+			originExtents := ctx.OriginExtents
+			if ctx.Origin.MaxOriginRangeSecs > 0 {
+				originExtents = originExtents.split(ctx.Origin.MaxOriginRangeSecs*1000, ctx.StepMS)
+			}
+			sem := make(chan struct{}, splitConcurrency(ctx.Origin))
+			deltaData := make([]PrometheusMatrixEnvelope, len(originExtents))
 			fastForwardData := PrometheusVectorEnvelope{}
 
 			var wg sync.WaitGroup
 
-			var m sync.Mutex // Protects originErr and resp below.
+			var m sync.Mutex // Protects originErr, resp and the extents below.
 			var originErr error
 			var errorBody []byte
 			resp := &http.Response{}
+			refreshedExtents := ExtentList{} // the ranges successfully fetched from the origin
+			fetchedExtents := ExtentList{}   // the ranges successfully fetched, excluding any not yet scraped at the live edge
 
-			if ctx.OriginLowerExtents.Start > 0 && ctx.OriginLowerExtents.End > 0 {
+			for i, e := range originExtents {
 				wg.Add(1)
-				go func() {
+				go func(i int, e MatrixExtents) {
 					defer wg.Done()
 
-					queryURL := ctx.Origin.OriginURL + mnQueryRange
-					originParams := url.Values{}
-					// Add the prometheus query params from the user urlparams to the origin request
-					passthroughParam(upQuery, ctx.RequestParams, originParams, nil)
-					passthroughParam(upTimeout, ctx.RequestParams, originParams, nil)
-					originParams.Add(upStep, ctx.StepParam)
-					originParams.Add(upStart, strconv.FormatInt(ctx.OriginLowerExtents.Start/1000, 10))
-					originParams.Add(upEnd, strconv.FormatInt(ctx.OriginLowerExtents.End/1000, 10))
-					ldd, b, r, duration, err := t.getMatrixFromPrometheus(queryURL, originParams, r.Request)
-
-					if err != nil {
-						m.Lock()
-						originErr = err
-						m.Unlock()
-						return
-					}
-
-					m.Lock()
-					if resp.StatusCode == 0 || r.StatusCode != http.StatusOK {
-						if r.StatusCode != http.StatusOK {
-							errorBody = b
-						}
-						resp = r
-					}
-					m.Unlock()
-
-					if r.StatusCode == http.StatusOK && ldd.Status == rvSuccess {
-						lowerDeltaData = ldd
-						t.Metrics.ProxyRequestDuration.WithLabelValues(ctx.Origin.OriginURL, otPrometheus,
-							mnQueryRange, ctx.CacheLookupResult, strconv.Itoa(r.StatusCode)).Observe(duration.Seconds())
-					}
-				}()
-			}
-
-			if ctx.OriginUpperExtents.Start > 0 && ctx.OriginUpperExtents.End > 0 {
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
+					sem <- struct{}{}
+					defer func() { <-sem }()
 
 					queryURL := ctx.Origin.OriginURL + mnQueryRange
 					originParams := url.Values{}
 					// Add the prometheus query params from the user urlparams to the origin request
 					passthroughParam(upQuery, ctx.RequestParams, originParams, nil)
 					passthroughParam(upTimeout, ctx.RequestParams, originParams, nil)
+					passthroughParam(upStats, ctx.RequestParams, originParams, nil)
 					originParams.Add(upStep, ctx.StepParam)
-					originParams.Add(upStart, strconv.FormatInt(ctx.OriginUpperExtents.Start/1000, 10))
-					originParams.Add(upEnd, strconv.FormatInt(ctx.OriginUpperExtents.End/1000, 10))
-					udd, b, r, duration, err := t.getMatrixFromPrometheus(queryURL, originParams, r.Request)
+					originParams.Add(upStart, strconv.FormatInt(e.Start/1000, 10))
+					originParams.Add(upEnd, strconv.FormatInt(e.End/1000, 10))
+					dd, b, r, duration, err := t.getMatrixFromPrometheus(queryURL, originParams, r.Request)
 
 					if err != nil {
 						m.Lock()
@@ -784,23 +843,33 @@ func (t *TricksterHandler) originRangeProxyHandler(cacheKey string, originRangeR
 					}
 
 					m.Lock()
+					defer m.Unlock()
 					if resp.StatusCode == 0 || r.StatusCode != http.StatusOK {
 						if r.StatusCode != http.StatusOK {
 							errorBody = b
 						}
 						resp = r
 					}
-					m.Unlock()
 
-					if r != nil && r.StatusCode == http.StatusOK && udd.Status == rvSuccess {
-						upperDeltaData = udd
+					if r.StatusCode == http.StatusOK && dd.Status == rvSuccess {
+						dd.cropToRange(e.Start, e.End)
+						deltaData[i] = dd
+						refreshedExtents = refreshedExtents.add(e, ctx.StepMS)
+						if e.End >= ctx.Time*1000-ctx.StepMS {
+							// Points at the live edge may not have been scraped yet, so only the range up to
+							// the newest point returned is considered fetched
+							e.End = dd.getExtents().End
+						}
+						if e.End >= e.Start {
+							fetchedExtents = fetchedExtents.add(e, ctx.StepMS)
+						}
 						t.Metrics.ProxyRequestDuration.WithLabelValues(ctx.Origin.OriginURL, otPrometheus,
 							mnQueryRange, ctx.CacheLookupResult, strconv.Itoa(r.StatusCode)).Observe(duration.Seconds())
 					}
-				}()
+				}(i, e)
 			}
 
-			if !ctx.Origin.FastForwardDisable && !(ctx.RequestExtents.End < ctx.Time*1000-ctx.StepMS) {
+			if ctx.Origin.fastForwardMode() != ffOff && ctx.ShiftMS == 0 && !(ctx.RequestExtents.End < ctx.Time*1000-ctx.StepMS) {
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
@@ -838,57 +907,49 @@ func (t *TricksterHandler) originRangeProxyHandler(cacheKey string, originRangeR
 
 			wg.Wait()
 
-			if originErr != nil {
-				level.Error(t.Logger).Log(lfEvent, "error fetching data from origin Prometheus", lfDetail, originErr.Error())
-				r.Writer.WriteHeader(http.StatusBadGateway)
-				r.WaitGroup.Done()
-				continue
-			}
-
-			t.Metrics.CacheRequestStatus.WithLabelValues(ctx.Origin.OriginURL, otPrometheus, mnQueryRange, ctx.CacheLookupResult, strconv.Itoa(resp.StatusCode)).Inc()
-
 			uncachedElementCnt := int64(0)
-
-			if lowerDeltaData.Status == rvSuccess {
-				uncachedElementCnt += lowerDeltaData.getValueCount()
-				ctx.Matrix = t.mergeMatrix(ctx.Matrix, lowerDeltaData)
+			for _, dd := range deltaData {
+				uncachedElementCnt += dd.getValueCount()
 			}
 
-			if upperDeltaData.Status == rvSuccess {
-				uncachedElementCnt += upperDeltaData.getValueCount()
-				ctx.Matrix = t.mergeMatrix(upperDeltaData, ctx.Matrix)
+			// Lay the fetched data into the cached data, replacing any cached points within the fetched extents
+			// (i.e., those within the backfill tolerance window)
+			extents := ctx.Matrix.cachedExtents()
+			for _, e := range fetchedExtents {
+				extents = extents.add(e, ctx.StepMS)
+			}
+			ctx.Matrix = fillMatrix(ctx.Matrix, deltaData, refreshedExtents)
+			ctx.Matrix.Extents = extents
+			if len(deltaData) == 1 {
+				// Stats describe a single origin request, so they are only returned when the request made exactly one
+				ctx.Matrix.Data.Stats = deltaData[0].Data.Stats
 			}
 
-			// If it's not a full cache hit, we want to write this back to the cache
-			if ctx.CacheLookupResult != crHit {
-				cacheMatrix := ctx.Matrix.copy()
-
-				// Prune any old points based on retention policy
-				cacheMatrix.cropToRange(int64(ctx.Time-ctx.Origin.MaxValueAgeSecs)*1000, 0)
-
-				if ctx.Origin.NoCacheLastDataSecs != 0 {
-					cacheMatrix.cropToRange(0, int64(ctx.Time-ctx.Origin.NoCacheLastDataSecs)*1000)
-				}
-
-				// Marshal the Envelope back to a json object for Cache Storage
-				cacheBody, err := json.Marshal(cacheMatrix)
-				if err != nil {
+			// Write whatever was fetched back to the cache, even if other requests to the origin failed
+			if len(refreshedExtents) > 0 {
+				if err := t.storeRangeMatrix(ctx, refreshedExtents); err != nil {
 					level.Error(t.Logger).Log(lfEvent, "prometheus matrix marshaling error", lfDetail, err.Error())
 					r.Writer.WriteHeader(http.StatusInternalServerError)
 					r.WaitGroup.Done()
 					continue
 				}
+			}
 
-				if t.Config.Caching.Compression {
-					level.Debug(t.Logger).Log("event", "Compressing Cached Data", "cacheKey", ctx.CacheKey)
-					cacheBody = snappy.Encode(nil, cacheBody)
-				}
+			// If the origin failed, serve what we have in cache when configured to do so
+			if (originErr != nil || resp.StatusCode >= http.StatusInternalServerError) && t.respondWithStaleData(r, ctx, len(refreshedExtents) > 0) {
+				r.WaitGroup.Done()
+				continue
+			}
 
-				// Set the Cache Key with the merged dataset
-				t.Cacher.Store(cacheKey, string(cacheBody), t.Config.Caching.RecordTTLSecs)
-				level.Debug(t.Logger).Log(lfEvent, "setCacheRecord", lfCacheKey, cacheKey, "ttl", t.Config.Caching.RecordTTLSecs)
+			if originErr != nil {
+				level.Error(t.Logger).Log(lfEvent, "error fetching data from origin Prometheus", lfDetail, originErr.Error())
+				r.Writer.WriteHeader(http.StatusBadGateway)
+				r.WaitGroup.Done()
+				continue
 			}
 
+			t.Metrics.CacheRequestStatus.WithLabelValues(ctx.Origin.OriginURL, otPrometheus, mnQueryRange, ctx.CacheLookupResult, strconv.Itoa(resp.StatusCode)).Inc()
+
 			//Do the extraction of the range the user requested, if needed.
 			// The only time it may not be needed is if the result was a Key Miss (so the dataset we have is exactly what the user asked for)
 			// I add one more step on the end of the request to ensure we catch the fast forward data
@@ -909,9 +970,11 @@ func (t *TricksterHandler) originRangeProxyHandler(cacheKey string, originRangeR
 
 			// Stictch in Fast Forward Data
 			if fastForwardData.Status == rvSuccess {
-				ctx.Matrix = t.mergeVector(ctx.Matrix, fastForwardData)
+				ctx.Matrix = t.mergeVector(ctx.Matrix, fastForwardData, ctx.Origin.fastForwardMode(), ctx.StepMS)
 			}
 
+			ctx.Matrix.shiftTimestamps(ctx.ShiftMS)
+
 			// Marshal the Envelope back to a json object for User Response)
 			body, err := json.Marshal(ctx.Matrix)
 			if err != nil {
@@ -934,6 +997,46 @@ func (t *TricksterHandler) originRangeProxyHandler(cacheKey string, originRangeR
 	}
 }
 
+// splitConcurrency returns the maximum number of split requests for a client request in flight to the origin at once
+func splitConcurrency(o PrometheusOriginConfig) int {
+	if o.SplitConcurrency > 0 {
+		return o.SplitConcurrency
+	}
+	return defaultSplitConcurrency
+}
+
+// storeRangeMatrix writes the request's matrix, including the extents newly fetched from the origin, to the cache
+func (t *TricksterHandler) storeRangeMatrix(ctx *ClientRequestContext, fetched ExtentList) error {
+	// Warnings and stats describe the origin requests for this response, so they aren't replayed from the cache
+	cacheMatrix := ctx.Matrix.copy()
+	cacheMatrix.Warnings = nil
+	cacheMatrix.Data.Stats = nil
+
+	// Prune any old points based on retention policy
+	cacheMatrix.cropToRange(int64(ctx.Time-ctx.Origin.MaxValueAgeSecs)*1000, 0)
+
+	if ctx.Origin.NoCacheLastDataSecs != 0 {
+		cacheMatrix.cropToRange(0, int64(ctx.Time-ctx.Origin.NoCacheLastDataSecs)*1000)
+	}
+
+	if ctx.Origin.ChunkSizeSecs > 0 {
+		// Only rewrite the chunks holding the data we just fetched
+		return t.storeChunks(ctx, cacheMatrix, fetched)
+	}
+
+	// Encode the Envelope for Cache Storage
+	cacheBody, err := t.encodeCacheMatrix(cacheMatrix)
+	if err != nil {
+		return err
+	}
+
+	// Set the Cache Key with the merged dataset
+	t.Cacher.Store(ctx.CacheKey, cacheBody, t.Config.Caching.RecordTTLSecs)
+	level.Debug(t.Logger).Log(lfEvent, "setCacheRecord", lfCacheKey, ctx.CacheKey, "ttl", t.Config.Caching.RecordTTLSecs)
+
+	return nil
+}
+
 func alignStepBoundaries(start int64, end int64, stepMS int64, now int64) (int64, int64, error) {
 	// Don't query beyond Time.Now() or charts will have weird data on the far right
 	if end > now*1000 {
@@ -962,32 +1065,7 @@ func (pe PrometheusMatrixEnvelope) getValueCount() int64 {
 	for j := range pe.Data.Result {
 		i += int64(len(pe.Data.Result[j].Values))
 	}
-	return i
-}
-
-// mergeVector merges the passed PrometheusVectorEnvelope object with the calling PrometheusVectorEnvelope object
-func (t *TricksterHandler) mergeVector(pe PrometheusMatrixEnvelope, pv PrometheusVectorEnvelope) PrometheusMatrixEnvelope {
-	if len(pv.Data.Result) == 0 {
-		level.Debug(t.Logger).Log(lfEvent, "mergeVectorPrematureExit")
-		return pe
-	}
-
-	for i := range pv.Data.Result {
-		result2 := pv.Data.Result[i]
-		for j := range pe.Data.Result {
-			result1 := pe.Data.Result[j]
-			if result2.Metric.Equal(result1.Metric) {
-				if result2.Timestamp > result1.Values[len(result1.Values)-1].Timestamp {
-					pe.Data.Result[j].Values = append(pe.Data.Result[j].Values, model.SamplePair{
-						Timestamp: model.Time((int64(result2.Timestamp) / 1000) * 1000),
-						Value:     result2.Value,
-					})
-				}
-			}
-		}
-	}
-
-	return pe
+	return i + pe.Data.Histograms.count()
 }
 
 // mergeMatrix merges the passed PrometheusMatrixEnvelope object with the calling PrometheusMatrixEnvelope object
@@ -999,6 +1077,9 @@ func (t *TricksterHandler) mergeMatrix(pe PrometheusMatrixEnvelope, pe2 Promethe
 		return pe
 	}
 
+	pe.Warnings = mergeWarnings(pe.Warnings, pe2.Warnings...)
+	pe.Data.Histograms = fillHistograms(pe.Data.Histograms, []HistogramMatrix{pe2.Data.Histograms}, nil)
+
 	for i := range pe2.Data.Result {
 		metricSetFound := false
 		result2 := pe2.Data.Result[i]
@@ -1007,6 +1088,10 @@ func (t *TricksterHandler) mergeMatrix(pe PrometheusMatrixEnvelope, pe2 Promethe
 			result1 := pe.Data.Result[j]
 			if result2.Metric.Equal(result1.Metric) {
 				metricSetFound = true
+				if len(result1.Values) == 0 {
+					result1.Values = result2.Values
+					break METRIC_MERGE
+				}
 				// Ensure that we don't duplicate datapoints or put points out-of-order
 				// This method assumes that `pe2` is "before" `pe`, we need to actually
 				// check and enforce that assumption
@@ -1033,8 +1118,30 @@ func (t *TricksterHandler) mergeMatrix(pe PrometheusMatrixEnvelope, pe2 Promethe
 	return pe
 }
 
+// mergeWarnings returns the warnings with any of the additional warnings that aren't already present appended
+func mergeWarnings(warnings []string, additional ...string) []string {
+	for _, a := range additional {
+		found := false
+		for _, w := range warnings {
+			if w == a {
+				found = true
+				break
+			}
+		}
+		if !found {
+			warnings = append(warnings, a)
+		}
+	}
+	return warnings
+}
+
 // cropToRange crops the datasets in a given PrometheusMatrixEnvelope down to the provided start and end times
 func (pe *PrometheusMatrixEnvelope) cropToRange(start int64, end int64) {
+	if pe.Extents != nil {
+		pe.Extents = pe.Extents.crop(start, end)
+	}
+	pe.Data.Histograms = pe.Data.Histograms.crop(start, end)
+
 	seriesToRemove := make([]int, 0)
 
 	// iterate through each metric series in the result
@@ -1107,17 +1214,36 @@ func (pe PrometheusMatrixEnvelope) getExtents() MatrixExtents {
 		}
 	}
 
+	for _, s := range pe.Data.Histograms {
+		if len(s.Histograms) > 0 {
+			if ts := int64(s.Histograms[0].Timestamp); oldest == 0 || ts < oldest {
+				oldest = ts
+			}
+			if ts := int64(s.Histograms[len(s.Histograms)-1].Timestamp); newest == 0 || ts > newest {
+				newest = ts
+			}
+		}
+	}
+
 	return MatrixExtents{Start: oldest, End: newest}
 }
 
 // copy return a deep copy of PrometheusMatrixEnvelope.
 func (pe PrometheusMatrixEnvelope) copy() PrometheusMatrixEnvelope {
 	resPe := PrometheusMatrixEnvelope{
-		Status: pe.Status,
+		Status:    pe.Status,
+		ErrorType: pe.ErrorType,
+		Error:     pe.Error,
 		Data: PrometheusMatrixData{
 			ResultType: pe.Data.ResultType,
 			Result:     make([]*model.SampleStream, len(pe.Data.Result)),
+			Stats:      pe.Data.Stats,
+			Histograms: pe.Data.Histograms.filter(func(int64) bool { return true }),
 		},
+		Extents: pe.Extents,
+	}
+	if pe.Warnings != nil {
+		resPe.Warnings = append([]string{}, pe.Warnings...)
 	}
 	for index := range pe.Data.Result {
 		resSampleSteam := *pe.Data.Result[index]
@@ -1141,8 +1267,23 @@ func md5sum(input string) string {
 	return fmt.Sprintf("%x", md5.Sum([]byte(input)))
 }
 
-// deriveCacheKey calculates a query-specific keyname based on the prometheus query in the user request
-func deriveCacheKey(prefix string, params url.Values) string {
+// rangeCacheKey returns the cache key of a range request at the step stepMS. The step is keyed in milliseconds, so
+// requests for the same step in different formats (e.g., "15" and "15s") share the cache
+func rangeCacheKey(o PrometheusOriginConfig, stepMS int64, header http.Header, params url.Values) string {
+	return deriveCacheKey(o, o.OriginURL+strconv.FormatInt(stepMS, 10), header, params)
+}
+
+// deriveCacheKey calculates a query-specific keyname based on the prometheus query in the user request,
+// along with any of the origin's cache key headers and parameters that are present in the request
+func deriveCacheKey(o PrometheusOriginConfig, prefix string, header http.Header, params url.Values) string {
+	// the cache key headers (by default, the Authorization header) should be part of the cache key
+	// to ensure only authorized users can access cached datasets
+	for _, name := range cacheKeyHeaders(o) {
+		if values, ok := header[http.CanonicalHeaderKey(name)]; ok {
+			prefix += "\n" + http.CanonicalHeaderKey(name) + ": " + strings.Join(values, " ")
+		}
+	}
+
 	k := ""
 	// if we have a prefix, set it up
 	if len(prefix) > 0 {
@@ -1150,16 +1291,34 @@ func deriveCacheKey(prefix string, params url.Values) string {
 	}
 
 	if query, ok := params[upQuery]; ok {
-		k += "." + md5sum(query[0])
+		q := query[0]
+		if o.NormalizeQueries || o.OffsetAwareCaching {
+			q = normalizeQuery(q)
+		}
+		k += "." + md5sum(q)
 	}
 
 	if t, ok := params[upTime]; ok {
 		k += "." + md5sum(t[0])
 	}
 
+	for _, name := range o.CacheKeyParams {
+		if values, ok := params[name]; ok {
+			k += "." + md5sum(name+"="+strings.Join(values, "&"))
+		}
+	}
+
 	return k
 }
 
+// cacheKeyHeaders returns the names of the client request headers that are part of the origin's cache keys
+func cacheKeyHeaders(o PrometheusOriginConfig) []string {
+	if o.CacheKeyHeaders == nil {
+		return []string{hnAuthorization}
+	}
+	return o.CacheKeyHeaders
+}
+
 var reRelativeTime = regexp.MustCompile(`([0-9]+)([mshdw])`)
 
 // parseTime converts a query time URL parameter to time.Time.
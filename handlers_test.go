@@ -15,6 +15,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -22,8 +23,12 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/prometheus/common/model"
@@ -146,6 +151,7 @@ func newTestTricksterHandler(t *testing.T) (tr *TricksterHandler, close func(t *
 	}
 
 	return tr, func(t *testing.T) {
+		tr.closeUpstreamPools()
 		tr.Metrics.Unregister()
 		if err := tr.Cacher.Close(); err != nil {
 			t.Fatal("Error closing cacher:", err)
@@ -382,7 +388,7 @@ func TestTricksterHandler_getURL(t *testing.T) {
 	tr.setTestOrigin(es.URL)
 
 	// it should get from the echo server
-	b, _, _, err := tr.getURL(tr.Config.Origins["default"], "GET", es.URL, url.Values{}, nil)
+	b, _, _, err := tr.getURL(context.Background(), tr.Config.Origins["default"], "GET", es.URL, url.Values{}, nil)
 	if err != nil {
 		t.Error(err)
 	}
@@ -473,7 +479,7 @@ func TestTricksterHandler_mergeVector(t *testing.T) {
 	}
 
 	// it should merge the values from the vector into the matrix
-	pe := tr.mergeVector(pm, pv)
+	pe := tr.mergeVector(pm, pv, ffAppend, 15000)
 
 	if 8 != pe.getValueCount() {
 		t.Errorf("wanted 8 got %d.", pe.getValueCount())
@@ -670,6 +676,49 @@ func TestTricksterHandler_mergeMatrix(t *testing.T) {
 				},
 			},
 		},
+		// Series without values
+		{
+			a: PrometheusMatrixEnvelope{
+				Status: rvSuccess,
+				Data: PrometheusMatrixData{
+					ResultType: "matrix",
+					Result: model.Matrix{
+						&model.SampleStream{
+							Metric: model.Metric{"__name__": "a"},
+							Values: []model.SamplePair{},
+						},
+					},
+				},
+			},
+			b: PrometheusMatrixEnvelope{
+				Status: rvSuccess,
+				Data: PrometheusMatrixData{
+					ResultType: "matrix",
+					Result: model.Matrix{
+						&model.SampleStream{
+							Metric: model.Metric{"__name__": "a"},
+							Values: []model.SamplePair{
+								model.SamplePair{1, 1.5},
+							},
+						},
+					},
+				},
+			},
+			merged: PrometheusMatrixEnvelope{
+				Status: rvSuccess,
+				Data: PrometheusMatrixData{
+					ResultType: "matrix",
+					Result: model.Matrix{
+						&model.SampleStream{
+							Metric: model.Metric{"__name__": "a"},
+							Values: []model.SamplePair{
+								model.SamplePair{1, 1.5},
+							},
+						},
+					},
+				},
+			},
+		},
 	}
 
 	tr, closeTr := newTestTricksterHandler(t)
@@ -750,3 +799,517 @@ func TestAlignStepBoundaries(t *testing.T) {
 		})
 	}
 }
+
+func TestDeriveCacheKey(t *testing.T) {
+	params := url.Values{upQuery: []string{"up"}, "dedup": []string{"true"}}
+	tenantA := http.Header{hnAuthorization: []string{"Bearer a"}, "X-Scope-Orgid": []string{"a"}}
+	tenantB := http.Header{hnAuthorization: []string{"Bearer a"}, "X-Scope-Orgid": []string{"b"}}
+	userB := http.Header{hnAuthorization: []string{"Bearer b"}, "X-Scope-Orgid": []string{"a"}}
+
+	// it should include the Authorization header by default
+	o := PrometheusOriginConfig{}
+	if deriveCacheKey(o, "prefix", tenantA, params) == deriveCacheKey(o, "prefix", userB, params) {
+		t.Errorf("expected different cache keys for different Authorization headers")
+	}
+	if deriveCacheKey(o, "prefix", tenantA, params) != deriveCacheKey(o, "prefix", tenantB, params) {
+		t.Errorf("expected the same cache key for different tenant headers")
+	}
+
+	// it should include only the configured headers
+	o.CacheKeyHeaders = []string{"x-scope-orgid"}
+	if deriveCacheKey(o, "prefix", tenantA, params) == deriveCacheKey(o, "prefix", tenantB, params) {
+		t.Errorf("expected different cache keys for different tenant headers")
+	}
+	if deriveCacheKey(o, "prefix", tenantA, params) != deriveCacheKey(o, "prefix", userB, params) {
+		t.Errorf("expected the same cache key for different Authorization headers")
+	}
+
+	// it should include the configured params
+	if deriveCacheKey(o, "prefix", tenantA, params) != deriveCacheKey(o, "prefix", tenantA, url.Values{upQuery: []string{"up"}}) {
+		t.Errorf("expected the same cache key without cache key params")
+	}
+	o.CacheKeyParams = []string{"dedup"}
+	if deriveCacheKey(o, "prefix", tenantA, params) == deriveCacheKey(o, "prefix", tenantA, url.Values{upQuery: []string{"up"}}) {
+		t.Errorf("expected different cache keys with cache key params")
+	}
+}
+
+func TestTricksterHandler_buildRequestContext_cacheKeyHeaders(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	o := tr.Config.Origins["default"]
+	o.CacheKeyHeaders = []string{"X-Scope-OrgID"}
+	tr.Config.Origins["default"] = o
+
+	keys := make(map[string]bool)
+	for _, tenant := range []string{"a", "b"} {
+		r := httptest.NewRequest("GET", nonexistantOrigin+exampleRangeQuery, nil)
+		r.Header.Set("X-Scope-OrgID", tenant)
+		ctx, err := tr.buildRequestContext(httptest.NewRecorder(), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[ctx.CacheKey] = true
+	}
+
+	// it should key each tenant's requests separately
+	if len(keys) != 2 {
+		t.Errorf("wanted 2 cache keys got %d.", len(keys))
+	}
+}
+
+func TestTricksterHandler_promQueryHandler_forwardHeaders(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	var originHeaders http.Header
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originHeaders = r.Header
+		fmt.Fprint(w, exampleResponse)
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	o := tr.Config.Origins["default"]
+	o.ForwardHeaders = []string{hnAuthorization, "X-Scope-OrgID"}
+	o.InjectHeaders = map[string]string{"X-Static": "static"}
+	tr.Config.Origins["default"] = o
+
+	r := httptest.NewRequest("GET", es.URL+exampleQuery, nil)
+	r.Header.Set(hnAuthorization, "Bearer token")
+	r.Header.Set("X-Scope-OrgID", "tenant")
+	r.Header.Set("User-Agent", "grafana")
+	r.Header.Set(hnXForwardedFor, "10.0.0.1")
+	r.Header.Set(hnVia, "1.0 proxy")
+
+	w := httptest.NewRecorder()
+	tr.promQueryHandler(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("wanted 200 got %d.", w.Result().StatusCode)
+	}
+
+	// it should forward only the allowed headers, and add the injected and proxy headers
+	expected := map[string]string{
+		hnAuthorization: "Bearer token",
+		"X-Scope-Orgid": "tenant",
+		"X-Static":      "static",
+		hnXForwardedFor: "10.0.0.1, 192.0.2.1",
+		hnVia:           "1.0 proxy, 1.1 trickster",
+	}
+	for k, v := range expected {
+		if originHeaders.Get(k) != v {
+			t.Errorf("wanted %s header %q got %q.", k, v, originHeaders.Get(k))
+		}
+	}
+	if originHeaders.Get("User-Agent") == "grafana" {
+		t.Errorf("expected User-Agent header not to be forwarded")
+	}
+}
+
+// originRequest records a request received by a test origin
+type originRequest struct {
+	Method      string
+	ContentType string
+	RawQuery    string
+	Body        string
+}
+
+// newRecordingTestServer returns a test server that responds with body and sends each request it receives to the channel
+func newRecordingTestServer(body string) (*httptest.Server, chan originRequest) {
+	requests := make(chan originRequest, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		requests <- originRequest{Method: r.Method, ContentType: r.Header.Get(hnContentType), RawQuery: r.URL.RawQuery, Body: string(b)}
+		fmt.Fprint(w, body)
+	}))
+	return s, requests
+}
+
+func TestTricksterHandler_getURL_post(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es, requests := newRecordingTestServer("{}")
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	params := url.Values{upQuery: []string{"up"}}
+	if _, _, _, err := tr.getURL(context.Background(), tr.Config.Origins["default"], http.MethodPost, es.URL, params, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// it should send the params as a form-encoded body
+	req := <-requests
+	if req.Method != http.MethodPost || req.ContentType != hvFormURLEncoded || req.Body != "query=up" || req.RawQuery != "" {
+		t.Errorf("wanted a form-encoded POST of query=up got %+v.", req)
+	}
+}
+
+func TestTricksterHandler_promQueryRangeHandler_post(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es, requests := newRecordingTestServer(exampleRangeResponse)
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	o := tr.Config.Origins["default"]
+	o.FastForwardDisable = true
+	tr.Config.Origins["default"] = o
+
+	form := url.Values{upQuery: []string{"up"}, upStart: []string{exampleRangeQuery_start}, upEnd: []string{exampleRangeQuery_end}, upStep: []string{"15"}}
+	newPost := func() *http.Request {
+		r := httptest.NewRequest(http.MethodPost, es.URL+"/api/v1/query_range", strings.NewReader(form.Encode()))
+		r.Header.Set(hnContentType, hvFormURLEncoded)
+		return r
+	}
+
+	w := httptest.NewRecorder()
+	tr.promQueryRangeHandler(w, newPost())
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("wanted 200 got %d.", w.Result().StatusCode)
+	}
+
+	// it should forward the query as a form-encoded body
+	req := <-requests
+	if req.Method != http.MethodPost || req.ContentType != hvFormURLEncoded || req.RawQuery != "" {
+		t.Errorf("wanted a form-encoded POST got %+v.", req)
+	}
+	if body, err := url.ParseQuery(req.Body); err != nil || body.Get(upQuery) != "up" {
+		t.Errorf("wanted query=up in the body got %q.", req.Body)
+	}
+
+	// it should derive the same cache key as the equivalent GET
+	postCtx, err := tr.buildRequestContext(w, newPost())
+	if err != nil {
+		t.Fatal(err)
+	}
+	getCtx, err := tr.buildRequestContext(w, httptest.NewRequest(http.MethodGet, es.URL+"/api/v1/query_range?"+form.Encode(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if postCtx.CacheKey != getCtx.CacheKey {
+		t.Errorf("wanted cache key %s got %s.", getCtx.CacheKey, postCtx.CacheKey)
+	}
+}
+
+func TestTricksterHandler_promFullProxyHandler_post(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es, requests := newRecordingTestServer("{}")
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	o := tr.Config.Origins["default"]
+	o.EnableAdminAPI = true
+	tr.Config.Origins["default"] = o
+
+	r := httptest.NewRequest(http.MethodPost, es.URL+"/api/v1/admin/tsdb/snapshot?skip_head=true", strings.NewReader(`{"a":1}`))
+	r.Header.Set(hnContentType, hvApplicationJSON)
+	w := httptest.NewRecorder()
+	tr.promFullProxyHandler(w, r)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("wanted 200 got %d.", w.Result().StatusCode)
+	}
+
+	// it should forward the body and query string as-is
+	req := <-requests
+	want := originRequest{Method: http.MethodPost, ContentType: hvApplicationJSON, RawQuery: "skip_head=true", Body: `{"a":1}`}
+	if req != want {
+		t.Errorf("wanted %+v got %+v.", want, req)
+	}
+}
+
+func TestApplyBackfillTolerance(t *testing.T) {
+	tests := []struct {
+		name             string
+		toleranceSecs    int64
+		request          MatrixExtents
+		cached, origin   ExtentList
+		lookupResult     string
+		wantOrigin       ExtentList
+		wantLookupResult string
+	}{
+		{
+			name:             "full hit touching the window",
+			toleranceSecs:    15,
+			request:          MatrixExtents{Start: 1435781400000, End: 1435781460000},
+			cached:           ExtentList{{Start: 1435781400000, End: 1435781460000}},
+			origin:           ExtentList{},
+			lookupResult:     crHit,
+			wantOrigin:       ExtentList{{Start: 1435781445000, End: 1435781460000}},
+			wantLookupResult: crPartialHit,
+		},
+		{
+			name:             "request ending before the window",
+			toleranceSecs:    15,
+			request:          MatrixExtents{Start: 1435781400000, End: 1435781430000},
+			cached:           ExtentList{{Start: 1435781400000, End: 1435781460000}},
+			origin:           ExtentList{},
+			lookupResult:     crHit,
+			wantOrigin:       ExtentList{},
+			wantLookupResult: crHit,
+		},
+		{
+			name:             "upper miss is extended into the window",
+			toleranceSecs:    30,
+			request:          MatrixExtents{Start: 1435781400000, End: 1435781460000},
+			cached:           ExtentList{{Start: 1435781400000, End: 1435781445000}},
+			origin:           ExtentList{{Start: 1435781460000, End: 1435781460000}},
+			lookupResult:     crPartialHit,
+			wantOrigin:       ExtentList{{Start: 1435781430000, End: 1435781460000}},
+			wantLookupResult: crPartialHit,
+		},
+		{
+			name:             "cached points after the request are not re-fetched",
+			toleranceSecs:    15,
+			request:          MatrixExtents{Start: 1435781400000, End: 1435781445000},
+			cached:           ExtentList{{Start: 1435781400000, End: 1435781460000}},
+			origin:           ExtentList{},
+			lookupResult:     crHit,
+			wantOrigin:       ExtentList{{Start: 1435781445000, End: 1435781445000}},
+			wantLookupResult: crPartialHit,
+		},
+		{
+			name:             "window starting before the cached data",
+			toleranceSecs:    60,
+			request:          MatrixExtents{Start: 1435781400000, End: 1435781460000},
+			cached:           ExtentList{{Start: 1435781445000, End: 1435781460000}},
+			origin:           ExtentList{{Start: 1435781400000, End: 1435781430000}},
+			lookupResult:     crPartialHit,
+			wantOrigin:       ExtentList{{Start: 1435781400000, End: 1435781460000}},
+			wantLookupResult: crPartialHit,
+		},
+		{
+			name:             "each cached range in the window is re-fetched",
+			toleranceSecs:    60,
+			request:          MatrixExtents{Start: 1435781400000, End: 1435781460000},
+			cached:           ExtentList{{Start: 1435781400000, End: 1435781415000}, {Start: 1435781445000, End: 1435781460000}},
+			origin:           ExtentList{{Start: 1435781430000, End: 1435781430000}},
+			lookupResult:     crPartialHit,
+			wantOrigin:       ExtentList{{Start: 1435781400000, End: 1435781460000}},
+			wantLookupResult: crPartialHit,
+		},
+	}
+
+	for _, test := range tests {
+		ctx := &ClientRequestContext{
+			Origin:            PrometheusOriginConfig{BackfillToleranceSecs: test.toleranceSecs},
+			RequestExtents:    test.request,
+			OriginExtents:     test.origin,
+			CacheLookupResult: test.lookupResult,
+			StepMS:            15000,
+			Time:              1435781460,
+		}
+		applyBackfillTolerance(ctx, test.cached)
+		if !reflect.DeepEqual(ctx.OriginExtents, test.wantOrigin) {
+			t.Errorf("%s: wanted origin extents %v got %v.", test.name, test.wantOrigin, ctx.OriginExtents)
+		}
+		if ctx.CacheLookupResult != test.wantLookupResult {
+			t.Errorf("%s: wanted %s got %s.", test.name, test.wantLookupResult, ctx.CacheLookupResult)
+		}
+	}
+}
+
+func TestTricksterHandler_promQueryRangeHandler_backfillTolerance(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	var m sync.Mutex
+	body := exampleRangeResponse
+	starts := make(chan string, 10)
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		starts <- r.FormValue(upStart)
+		m.Lock()
+		defer m.Unlock()
+		fmt.Fprint(w, body)
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	// keep the 2015 example data from being aged out of the cache, and treat the last two points as recent
+	o := tr.Config.Origins["default"]
+	o.MaxValueAgeSecs = time.Now().Unix()
+	o.FastForwardDisable = true
+	o.BackfillToleranceSecs = time.Now().Unix() - 1435781450
+	tr.Config.Origins["default"] = o
+
+	tr.promQueryRangeHandler(httptest.NewRecorder(), httptest.NewRequest("GET", es.URL+exampleRangeQuery, nil))
+	<-starts
+
+	// the origin has since backfilled the recent points
+	m.Lock()
+	body = `{"status":"success","data":{"resultType":"matrix","result":[` +
+		`{"metric":{"__name__":"up","job":"prometheus","instance":"localhost:9090"},"values":[[1435781445,"2"],[1435781460,"2"]]}]}}`
+	m.Unlock()
+
+	w := httptest.NewRecorder()
+	tr.promQueryRangeHandler(w, httptest.NewRequest("GET", es.URL+exampleRangeQuery, nil))
+
+	// it should re-fetch only the points within the window
+	if start := <-starts; start != "1435781445" {
+		t.Errorf("wanted start 1435781445 got %s.", start)
+	}
+
+	// it should serve the older points from the cache and replace the recent ones
+	pe := PrometheusMatrixEnvelope{}
+	if err := json.NewDecoder(w.Result().Body).Decode(&pe); err != nil {
+		t.Fatal(err)
+	}
+	for _, stream := range pe.Data.Result {
+		var want []model.SamplePair
+		if stream.Metric["job"] == "prometheus" {
+			want = []model.SamplePair{{Timestamp: 1435781430000, Value: 1}, {Timestamp: 1435781445000, Value: 2}, {Timestamp: 1435781460000, Value: 2}}
+		} else {
+			want = []model.SamplePair{{Timestamp: 1435781430000, Value: 0}}
+		}
+		if !reflect.DeepEqual(stream.Values, want) {
+			t.Errorf("wanted %v got %v.", want, stream.Values)
+		}
+	}
+}
+
+func TestMergeWarnings(t *testing.T) {
+	got := mergeWarnings([]string{"a", "b"}, "b", "c", "c")
+	if !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("wanted [a b c] got %v.", got)
+	}
+	if got := mergeWarnings(nil); got != nil {
+		t.Errorf("wanted nil got %v.", got)
+	}
+}
+
+func TestTricksterHandler_promQueryRangeHandler_warnings(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	// respond with a warning naming the start of each requested range, and stats when requested
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := strings.Replace(exampleRangeResponse, `"status" : "success",`,
+			`"status" : "success", "warnings": ["origin warning", "range from `+r.FormValue(upStart)+`"],`, 1)
+		if r.FormValue(upStats) != "" {
+			body = strings.Replace(body, `"resultType" : "matrix",`, `"resultType" : "matrix", "stats": {"timings": {"evalTotalTime": 0.5}},`, 1)
+		}
+		fmt.Fprint(w, body)
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	// keep the 2015 example data from being aged out of the cache
+	o := tr.Config.Origins["default"]
+	o.MaxValueAgeSecs = time.Now().Unix()
+	o.FastForwardDisable = true
+	o.MaxOriginRangeSecs = 15
+	tr.Config.Origins["default"] = o
+
+	query := func(q string) PrometheusMatrixEnvelope {
+		w := httptest.NewRecorder()
+		tr.promQueryRangeHandler(w, httptest.NewRequest("GET", es.URL+q, nil))
+		pe := PrometheusMatrixEnvelope{}
+		if err := json.NewDecoder(w.Result().Body).Decode(&pe); err != nil {
+			t.Fatal(err)
+		}
+		return pe
+	}
+
+	// it should merge the warnings from each origin request, without duplicates, and omit their stats
+	pe := query(exampleRangeQuery + "&stats=all")
+	want := []string{"origin warning", "range from 1435781430", "range from 1435781445", "range from 1435781460"}
+	sort.Strings(pe.Warnings)
+	if !reflect.DeepEqual(pe.Warnings, want) {
+		t.Errorf("wanted %v got %v.", want, pe.Warnings)
+	}
+	if pe.Data.Stats != nil {
+		t.Errorf("wanted no stats got %s.", pe.Data.Stats)
+	}
+
+	// it should return the stats of a single origin request
+	pe = query("/api/v1/query_range?query=up&start=2015-07-01T20:10:15.781Z&end=2015-07-01T20:11:00.781Z&step=15&stats=all")
+	if string(pe.Data.Stats) != `{"timings":{"evalTotalTime":0.5}}` {
+		t.Errorf("wanted the origin's stats got %s.", pe.Data.Stats)
+	}
+
+	// it should not replay the warnings or the stats from the cached data
+	pe = query(exampleRangeQuery + "&stats=all")
+	if len(pe.Warnings) != 0 || pe.Data.Stats != nil {
+		t.Errorf("wanted no warnings or stats got %v, %s.", pe.Warnings, pe.Data.Stats)
+	}
+
+	// it should only return the warnings of the ranges fetched for the request
+	pe = query("/api/v1/query_range?query=up&start=2015-07-01T20:10:15.781Z&end=2015-07-01T20:11:15.781Z&step=15")
+	want = []string{"origin warning", "range from 1435781475"}
+	sort.Strings(pe.Warnings)
+	if !reflect.DeepEqual(pe.Warnings, want) {
+		t.Errorf("wanted %v got %v.", want, pe.Warnings)
+	}
+}
+
+func TestTricksterHandler_mergeVector_scalar(t *testing.T) {
+	tr, closeTr := newTestTricksterHandler(t)
+	defer closeTr(t)
+
+	pm := PrometheusMatrixEnvelope{}
+	if err := json.Unmarshal([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{},"values":[[1435781445,"1"],[1435781460,"2"]]}]}}`), &pm); err != nil {
+		t.Fatal(err)
+	}
+	pv := PrometheusVectorEnvelope{}
+	if err := json.Unmarshal([]byte(`{"status":"success","data":{"resultType":"scalar","result":[1435781467.781,"3"]}}`), &pv); err != nil {
+		t.Fatal(err)
+	}
+
+	// it should append the scalar to the series without labels
+	pe := tr.mergeVector(pm, pv, ffAppend, 15000)
+	values := pe.Data.Result[0].Values
+	if len(values) != 3 || values[2].Timestamp != 1435781467000 || values[2].Value != 3 {
+		t.Errorf("wanted the scalar appended got %v.", values)
+	}
+}
+
+func TestTricksterHandler_promQueryRangeHandler_scalar(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	// evaluate time() over a range as Prometheus does, as a series without labels, and as a scalar at an instant
+	now := time.Now().Unix()
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/query") {
+			fmt.Fprintf(w, `{"status":"success","data":{"resultType":"scalar","result":[%d.5,"%d.5"]}}`, now, now)
+			return
+		}
+		start, _ := strconv.ParseInt(r.FormValue(upStart), 10, 64)
+		end, _ := strconv.ParseInt(r.FormValue(upEnd), 10, 64)
+		values := make([]string, 0)
+		for ts := start; ts <= end; ts += 15 {
+			values = append(values, fmt.Sprintf(`[%d,"%d"]`, ts, ts))
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{},"values":[%s]}]}}`, strings.Join(values, ","))
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	// end the range just before now, so the fast forward point is not already in the range when now is on a step
+	path := es.URL + "/api/v1/query_range?query=time()&step=15&start=" + strconv.FormatInt(now-300, 10) + "&end=" + strconv.FormatInt(now-1, 10)
+	// once from the origin, and once from the cache
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		tr.promQueryRangeHandler(w, httptest.NewRequest("GET", path, nil))
+		if w.Result().StatusCode != http.StatusOK {
+			t.Fatalf("wanted 200 got %d.", w.Result().StatusCode)
+		}
+
+		// it should fast forward the range with the scalar
+		pe := PrometheusMatrixEnvelope{}
+		if err := json.NewDecoder(w.Result().Body).Decode(&pe); err != nil {
+			t.Fatal(err)
+		}
+		if len(pe.Data.Result) != 1 {
+			t.Fatalf("wanted 1 series got %d.", len(pe.Data.Result))
+		}
+		values := pe.Data.Result[0].Values
+		if last := values[len(values)-1]; last.Timestamp != model.Time(now*1000) || last.Value != model.SampleValue(now)+0.5 {
+			t.Errorf("wanted the fast forward point %d got %v.", now, last)
+		}
+		if len(values) < 20 {
+			t.Errorf("wanted at least 20 values got %d.", len(values))
+		}
+	}
+}
@@ -0,0 +1,178 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/prometheus/common/model"
+)
+
+// HistogramPair is a native histogram sample. The histogram is kept in the JSON form returned by the origin, since
+// Trickster only needs the timestamp of a sample to merge, crop and cache it
+type HistogramPair struct {
+	Timestamp model.Time
+	Histogram json.RawMessage
+}
+
+// MarshalJSON encodes the sample as a timestamp and histogram pair, as in the Prometheus HTTP API
+func (p HistogramPair) MarshalJSON() ([]byte, error) {
+	return json.Marshal([...]interface{}{p.Timestamp, p.Histogram})
+}
+
+// UnmarshalJSON decodes a timestamp and histogram pair
+func (p *HistogramPair) UnmarshalJSON(b []byte) error {
+	v := [...]interface{}{&p.Timestamp, &p.Histogram}
+	return json.Unmarshal(b, &v)
+}
+
+// HistogramStream is the native histogram samples of a series in a range query result
+type HistogramStream struct {
+	Metric     model.Metric    `json:"metric"`
+	Histograms []HistogramPair `json:"histograms"`
+}
+
+// HistogramMatrix is the native histogram series of a range query result
+type HistogramMatrix []*HistogramStream
+
+// HistogramSample is a native histogram sample of a series in an instant query result
+type HistogramSample struct {
+	Metric    model.Metric  `json:"metric"`
+	Histogram HistogramPair `json:"histogram"`
+}
+
+// HistogramVector is the native histogram samples of an instant query result
+type HistogramVector []*HistogramSample
+
+// filter returns the matrix with only the samples for which keep returns true. Series left without samples are
+// dropped. The receiver is not modified
+func (hm HistogramMatrix) filter(keep func(ts int64) bool) HistogramMatrix {
+	if hm == nil {
+		return nil
+	}
+
+	out := make(HistogramMatrix, 0, len(hm))
+	for _, s := range hm {
+		histograms := make([]HistogramPair, 0, len(s.Histograms))
+		for _, h := range s.Histograms {
+			if keep(int64(h.Timestamp)) {
+				histograms = append(histograms, h)
+			}
+		}
+		if len(histograms) > 0 {
+			out = append(out, &HistogramStream{Metric: s.Metric, Histograms: histograms})
+		}
+	}
+
+	return out
+}
+
+// crop returns the samples of the matrix between start and end, inclusive. A start or end of 0 is unbounded
+func (hm HistogramMatrix) crop(start, end int64) HistogramMatrix {
+	return hm.filter(func(ts int64) bool {
+		return (start <= 0 || ts >= start) && (end <= 0 || ts <= end)
+	})
+}
+
+// shift returns the matrix with every sample moved forward by shiftMS
+func (hm HistogramMatrix) shift(shiftMS int64) HistogramMatrix {
+	out := hm.filter(func(int64) bool { return true })
+	for _, s := range out {
+		for i := range s.Histograms {
+			s.Histograms[i].Timestamp += model.Time(shiftMS)
+		}
+	}
+	return out
+}
+
+// count returns the number of samples in the matrix
+func (hm HistogramMatrix) count() int64 {
+	n := int64(0)
+	for _, s := range hm {
+		n += int64(len(s.Histograms))
+	}
+	return n
+}
+
+// fillHistograms merges the histogram samples fetched from the origin for the extents in fetched into the cached
+// samples, replacing any cached samples within those extents, as fillMatrix does for float samples. Where samples
+// share a timestamp, the last one merged is kept. The cached matrix is not modified
+func fillHistograms(cached HistogramMatrix, fetched []HistogramMatrix, extents ExtentList) HistogramMatrix {
+	out := cached.filter(func(ts int64) bool { return !extents.contains(ts) })
+
+	series := make(map[model.Fingerprint]*HistogramStream, len(out))
+	for _, s := range out {
+		series[s.Metric.Fingerprint()] = s
+	}
+
+	for _, hm := range fetched {
+		for _, s := range hm {
+			stream, ok := series[s.Metric.Fingerprint()]
+			if !ok {
+				stream = &HistogramStream{Metric: s.Metric}
+				series[s.Metric.Fingerprint()] = stream
+				out = append(out, stream)
+			}
+			stream.Histograms = append(stream.Histograms, s.Histograms...)
+		}
+	}
+
+	for _, s := range out {
+		sort.SliceStable(s.Histograms, func(i, j int) bool { return s.Histograms[i].Timestamp < s.Histograms[j].Timestamp })
+
+		// keep the last of any samples sharing a timestamp
+		deduped := s.Histograms[:0]
+		for i, h := range s.Histograms {
+			if i+1 < len(s.Histograms) && s.Histograms[i+1].Timestamp == h.Timestamp {
+				continue
+			}
+			deduped = append(deduped, h)
+		}
+		s.Histograms = deduped
+	}
+
+	if cached == nil && len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// mergeHistogramVector adds the latest histogram samples from an instant query to the matrix according to the Fast
+// Forward mode, as mergeVector does for float samples, and returns the matrix
+func mergeHistogramVector(hm HistogramMatrix, hv HistogramVector, mode string, stepMS int64) HistogramMatrix {
+	for _, sample := range hv {
+		pair := HistogramPair{
+			Timestamp: fastForwardTime(sample.Histogram.Timestamp, mode, stepMS),
+			Histogram: sample.Histogram.Histogram,
+		}
+
+		found := false
+		for _, s := range hm {
+			if !sample.Metric.Equal(s.Metric) {
+				continue
+			}
+			found = true
+			if len(s.Histograms) == 0 || pair.Timestamp > s.Histograms[len(s.Histograms)-1].Timestamp {
+				s.Histograms = append(s.Histograms, pair)
+			}
+			break
+		}
+
+		if !found {
+			hm = append(hm, &HistogramStream{Metric: sample.Metric, Histograms: []HistogramPair{pair}})
+		}
+	}
+	return hm
+}
@@ -0,0 +1,270 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// exampleHistogramRangeResponse is a query_range response from a Prometheus server with native histograms enabled,
+	// with a float series, a native histogram series and a series that changed from floats to native histograms
+	exampleHistogramRangeResponse = `{
+   "status" : "success",
+   "data" : {
+      "resultType" : "matrix",
+      "result" : [
+         {
+            "metric" : { "__name__" : "rpc_duration_seconds", "job" : "api" },
+            "histograms" : [
+               [ 1435781430, { "count" : "10", "sum" : "3.5", "buckets" : [ [ 0, "0.25", "0.5", "6" ], [ 0, "0.5", "1", "4" ] ] } ],
+               [ 1435781445, { "count" : "12", "sum" : "4", "buckets" : [ [ 0, "0.25", "0.5", "7" ], [ 0, "0.5", "1", "5" ] ] } ],
+               [ 1435781460, { "count" : "15", "sum" : "5.25", "buckets" : [ [ 0, "0.25", "0.5", "9" ], [ 0, "0.5", "1", "6" ] ] } ]
+            ]
+         },
+         {
+            "metric" : { "__name__" : "rpc_duration_seconds", "job" : "worker" },
+            "values" : [ [ 1435781430, "1" ] ],
+            "histograms" : [
+               [ 1435781445, { "count" : "2", "sum" : "0.5", "buckets" : [ [ 0, "0.25", "0.5", "2" ] ] } ],
+               [ 1435781460, { "count" : "3", "sum" : "0.75", "buckets" : [ [ 0, "0.25", "0.5", "3" ] ] } ]
+            ]
+         },
+         {
+            "metric" : { "__name__" : "rpc_requests_total", "job" : "api" },
+            "values" : [ [ 1435781430, "10" ], [ 1435781445, "12" ], [ 1435781460, "15" ] ]
+         }
+      ]
+   }
+}`
+
+	// exampleHistogramResponse is a query response for the same series at a later time
+	exampleHistogramResponse = `{
+   "status" : "success",
+   "data" : {
+      "resultType" : "vector",
+      "result" : [
+         {
+            "metric" : { "__name__" : "rpc_requests_total", "job" : "api" },
+            "value" : [ 1435781467.781, "16" ]
+         },
+         {
+            "metric" : { "__name__" : "rpc_duration_seconds", "job" : "api" },
+            "histogram" : [ 1435781467.781, { "count" : "16", "sum" : "5.5", "buckets" : [ [ 0, "0.25", "0.5", "10" ], [ 0, "0.5", "1", "6" ] ] } ]
+         }
+      ]
+   }
+}`
+)
+
+// jsonEqual returns an error if the JSON documents differ, ignoring formatting
+func jsonEqual(want, got []byte) error {
+	var w, g interface{}
+	if err := json.Unmarshal(want, &w); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(got, &g); err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(w, g) {
+		return fmt.Errorf("wanted %s got %s", want, got)
+	}
+	return nil
+}
+
+// histogramTimestamps returns the timestamps of the native histogram samples of each series, by job
+func histogramTimestamps(pe PrometheusMatrixEnvelope) map[string][]model.Time {
+	out := make(map[string][]model.Time)
+	for _, s := range pe.Data.Histograms {
+		for _, h := range s.Histograms {
+			out[string(s.Metric["job"])] = append(out[string(s.Metric["job"])], h.Timestamp)
+		}
+	}
+	return out
+}
+
+func TestPrometheusMatrixEnvelope_histogramsJSON(t *testing.T) {
+	pe := PrometheusMatrixEnvelope{}
+	if err := json.Unmarshal([]byte(exampleHistogramRangeResponse), &pe); err != nil {
+		t.Fatal(err)
+	}
+
+	// it should decode the float and native histogram samples separately
+	if len(pe.Data.Result) != 2 || len(pe.Data.Histograms) != 2 {
+		t.Fatalf("wanted 2 float and 2 histogram series got %d and %d.", len(pe.Data.Result), len(pe.Data.Histograms))
+	}
+	if pe.getValueCount() != 9 {
+		t.Errorf("wanted 9 samples got %d.", pe.getValueCount())
+	}
+	if e := pe.getExtents(); e.Start != 1435781430000 || e.End != 1435781460000 {
+		t.Errorf("wanted extents including the histograms got %v.", e)
+	}
+
+	// it should encode them together, as they were returned by the origin
+	body, err := json.Marshal(pe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jsonEqual([]byte(exampleHistogramRangeResponse), body); err != nil {
+		t.Error(err)
+	}
+
+	pv := PrometheusVectorEnvelope{}
+	if err := json.Unmarshal([]byte(exampleHistogramResponse), &pv); err != nil {
+		t.Fatal(err)
+	}
+	if len(pv.Data.Result) != 1 || len(pv.Data.Histograms) != 1 {
+		t.Fatalf("wanted 1 float and 1 histogram sample got %d and %d.", len(pv.Data.Result), len(pv.Data.Histograms))
+	}
+	if body, err = json.Marshal(pv); err != nil {
+		t.Fatal(err)
+	}
+	if err := jsonEqual([]byte(exampleHistogramResponse), body); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPrometheusMatrixEnvelope_histogramsCropAndMerge(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	pe := PrometheusMatrixEnvelope{}
+	if err := json.Unmarshal([]byte(exampleHistogramRangeResponse), &pe); err != nil {
+		t.Fatal(err)
+	}
+
+	// it should crop the histograms without modifying the original
+	cropped := pe.copy()
+	cropped.cropToRange(1435781445000, 1435781445000)
+	want := map[string][]model.Time{"api": {1435781445000}, "worker": {1435781445000}}
+	if got := histogramTimestamps(cropped); !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted %v got %v.", want, got)
+	}
+	if pe.getValueCount() != 9 {
+		t.Errorf("original was modified: %d samples.", pe.getValueCount())
+	}
+
+	// it should fill a gap in the histograms
+	lower, upper := pe.copy(), pe.copy()
+	lower.cropToRange(0, 1435781430000)
+	upper.cropToRange(1435781460000, 0)
+	cached := lower.copy()
+	cached.Data.Histograms = fillHistograms(lower.Data.Histograms, []HistogramMatrix{upper.Data.Histograms}, nil)
+	middle := pe.copy()
+	middle.cropToRange(1435781445000, 1435781445000)
+	filled := fillMatrix(cached, []PrometheusMatrixEnvelope{middle}, ExtentList{{Start: 1435781445000, End: 1435781445000}})
+	want = map[string][]model.Time{"api": {1435781430000, 1435781445000, 1435781460000}, "worker": {1435781445000, 1435781460000}}
+	if got := histogramTimestamps(filled); !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted %v got %v.", want, got)
+	}
+
+	// it should merge an earlier matrix without duplicating samples
+	merged := tr.mergeMatrix(upper, pe.copy())
+	if got := histogramTimestamps(merged); !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted %v got %v.", want, got)
+	}
+
+	// it should fast forward the histograms
+	pv := PrometheusVectorEnvelope{}
+	if err := json.Unmarshal([]byte(exampleHistogramResponse), &pv); err != nil {
+		t.Fatal(err)
+	}
+	ff := tr.mergeVector(pe.copy(), pv, ffAppend, 15000)
+	want = map[string][]model.Time{"api": {1435781430000, 1435781445000, 1435781460000, 1435781467000}, "worker": {1435781445000, 1435781460000}}
+	if got := histogramTimestamps(ff); !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted %v got %v.", want, got)
+	}
+	if ff.getValueCount() != 11 {
+		t.Errorf("wanted 11 samples got %d.", ff.getValueCount())
+	}
+}
+
+func TestTricksterHandler_encodeCacheMatrix_histograms(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	pe := PrometheusMatrixEnvelope{}
+	if err := json.Unmarshal([]byte(exampleHistogramRangeResponse), &pe); err != nil {
+		t.Fatal(err)
+	}
+	want, err := json.Marshal(pe)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// it should round trip the histograms in each cache format
+	for _, serialization := range []string{csBinary, csJSON} {
+		tr.Config.Caching.Serialization = serialization
+
+		data, err := tr.encodeCacheMatrix(pe)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pe2 := PrometheusMatrixEnvelope{}
+		if err := decodeCacheMatrix(data, &pe2); err != nil {
+			t.Fatalf("%s: %v", serialization, err)
+		}
+		got, err := json.Marshal(pe2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := jsonEqual(want, got); err != nil {
+			t.Errorf("%s: %v", serialization, err)
+		}
+	}
+
+	// it should decode the previous binary version, which has no histograms
+	data := encodeMatrix(PrometheusMatrixEnvelope{Status: pe.Status, Data: PrometheusMatrixData{ResultType: rvMatrix, Result: pe.Data.Result}})
+	data[1] = matrixCodecVersionNoHistograms
+	pe2 := PrometheusMatrixEnvelope{}
+	if err := decodeMatrix(data[:len(data)-1], &pe2); err != nil {
+		t.Fatal(err)
+	}
+	if len(pe2.Data.Result) != 2 || pe2.Data.Histograms != nil {
+		t.Errorf("wanted 2 float series and no histograms got %v and %v.", pe2.Data.Result, pe2.Data.Histograms)
+	}
+}
+
+func TestTricksterHandler_promQueryRangeHandler_histograms(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es, requests := newRecordingTestServer(exampleHistogramRangeResponse)
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	// keep the 2015 example data from being aged out of the cache
+	o := tr.Config.Origins["default"]
+	o.MaxValueAgeSecs = time.Now().Unix()
+	o.FastForwardDisable = true
+	tr.Config.Origins["default"] = o
+
+	// it should serve the histograms from the origin, and then from the cache
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		tr.promQueryRangeHandler(w, httptest.NewRequest("GET", es.URL+exampleRangeQuery, nil))
+		if err := jsonEqual([]byte(exampleHistogramRangeResponse), w.Body.Bytes()); err != nil {
+			t.Errorf("request %d: %v", i, err)
+		}
+	}
+	if len(requests) != 1 {
+		t.Errorf("wanted 1 origin request got %d.", len(requests))
+	}
+}
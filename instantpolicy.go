@@ -0,0 +1,81 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"net/url"
+	"strconv"
+)
+
+const (
+	defaultInstantRoundSecs = 15
+	defaultInstantTTLSecs   = 15
+)
+
+// defaultInstantAgeRules caches times that are on a half-hour boundary and at least 30 minutes old for 30 minutes.
+// These are unusual for random dashboard loads, and are likely to be some kind of a daily or hourly rollup
+var defaultInstantAgeRules = []InstantQueryAgeRule{{MinAgeSecs: 1800, AlignSecs: 1800, TTLSecs: 1800}}
+
+// instantQueryPolicy returns the origin's instant query policy with defaults applied
+func instantQueryPolicy(o PrometheusOriginConfig) InstantQueryPolicy {
+	p := o.InstantQueryPolicy
+	if p.RoundSecs <= 0 {
+		p.RoundSecs = defaultInstantRoundSecs
+	}
+	if p.TTLSecs <= 0 {
+		p.TTLSecs = defaultInstantTTLSecs
+	}
+	if p.AgeRules == nil {
+		p.AgeRules = defaultInstantAgeRules
+	}
+	return p
+}
+
+// apply rounds the time param of an instant query, if present, according to the policy and returns how long
+// the query's result should be cached. now is the current time in seconds
+func (p InstantQueryPolicy) apply(params url.Values, now int64) (int64, error) {
+	ts, ok := params[upTime]
+	if !ok || len(ts) == 0 {
+		// the origin evaluates the query at the current time
+		return p.TTLSecs, nil
+	}
+
+	reqTime, err := parseTime(ts[0])
+	if err != nil {
+		return 0, err
+	}
+	end := reqTime.Unix()
+
+	ttl := p.TTLSecs
+	for _, rule := range p.AgeRules {
+		if rule.matches(end, now) {
+			ttl = rule.TTLSecs
+			break
+		}
+	}
+
+	if !p.DisableRounding {
+		params.Set(upTime, strconv.FormatInt((end/p.RoundSecs)*p.RoundSecs, 10))
+	}
+
+	return ttl, nil
+}
+
+// matches returns true if the rule applies to a query at time end, in seconds
+func (r InstantQueryAgeRule) matches(end, now int64) bool {
+	if now-end < r.MinAgeSecs {
+		return false
+	}
+	return r.AlignSecs <= 0 || end%r.AlignSecs == 0
+}
@@ -0,0 +1,131 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestInstantQueryPolicy_apply(t *testing.T) {
+	const now = 1435788000 // 2015-07-01T22:00:00Z
+
+	tests := []struct {
+		name     string
+		policy   InstantQueryPolicy
+		time     string
+		wantTime string
+		wantTTL  int64
+	}{
+		{
+			name:    "no time param",
+			wantTTL: 15,
+		},
+		{
+			name:     "recent time is rounded to 15s",
+			time:     "1435787993",
+			wantTime: "1435787985",
+			wantTTL:  15,
+		},
+		{
+			name:     "fractional and rfc3339 times are rounded",
+			time:     "2015-07-01T21:59:53.5Z",
+			wantTime: "1435787985",
+			wantTTL:  15,
+		},
+		{
+			name:     "old half hour boundary gets the rollup ttl",
+			time:     "1435779000",
+			wantTime: "1435779000",
+			wantTTL:  1800,
+		},
+		{
+			name:     "recent half hour boundary gets the default ttl",
+			time:     "1435788000",
+			wantTime: "1435788000",
+			wantTTL:  15,
+		},
+		{
+			name:     "old unaligned time gets the default ttl",
+			time:     "1435779007",
+			wantTime: "1435779000",
+			wantTTL:  15,
+		},
+		{
+			name:     "custom rounding and ttl",
+			policy:   InstantQueryPolicy{RoundSecs: 60, TTLSecs: 30},
+			time:     "1435787993",
+			wantTime: "1435787940",
+			wantTTL:  30,
+		},
+		{
+			name:     "disabled rounding keeps the exact time",
+			policy:   InstantQueryPolicy{DisableRounding: true},
+			time:     "1435787993.25",
+			wantTime: "1435787993.25",
+			wantTTL:  15,
+		},
+		{
+			name: "first matching age rule applies",
+			policy: InstantQueryPolicy{AgeRules: []InstantQueryAgeRule{
+				{MinAgeSecs: 86400, TTLSecs: 86400},
+				{MinAgeSecs: 3600, TTLSecs: 600},
+			}},
+			time:     "1435690000",
+			wantTime: "1435689990",
+			wantTTL:  86400,
+		},
+		{
+			name: "later age rule applies when earlier rules don't",
+			policy: InstantQueryPolicy{AgeRules: []InstantQueryAgeRule{
+				{MinAgeSecs: 86400, TTLSecs: 86400},
+				{MinAgeSecs: 3600, TTLSecs: 600},
+			}},
+			time:     "1435780000",
+			wantTime: "1435779990",
+			wantTTL:  600,
+		},
+		{
+			name:     "empty age rules disable the rollup ttl",
+			policy:   InstantQueryPolicy{AgeRules: []InstantQueryAgeRule{}},
+			time:     "1435779000",
+			wantTime: "1435779000",
+			wantTTL:  15,
+		},
+	}
+
+	for _, test := range tests {
+		params := url.Values{}
+		if test.time != "" {
+			params.Set(upTime, test.time)
+		}
+
+		ttl, err := instantQueryPolicy(PrometheusOriginConfig{InstantQueryPolicy: test.policy}).apply(params, now)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if ttl != test.wantTTL {
+			t.Errorf("%s: wanted ttl %d got %d.", test.name, test.wantTTL, ttl)
+		}
+		if params.Get(upTime) != test.wantTime {
+			t.Errorf("%s: wanted time %q got %q.", test.name, test.wantTime, params.Get(upTime))
+		}
+	}
+
+	// it should reject invalid times
+	if _, err := instantQueryPolicy(PrometheusOriginConfig{}).apply(url.Values{upTime: []string{"now"}}, now); err == nil {
+		t.Errorf("expected error for invalid time")
+	}
+}
@@ -14,10 +14,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -39,9 +43,18 @@ const (
 	mnQuery      = "query"
 	mnLabels     = "label/__name__/values"
 	mnHealth     = "health"
+	mnAdmin      = "admin/"
+
+	// Metadata API paths
+	mnLabelNames  = "labels"
+	mnLabelValues = "label/{labelName}/values"
+	mnSeries      = "series"
 
 	// Prometheus URL endpoints
 	prometheusAPIv1Path = "/api/v1/"
+
+	// shutdownTimeout is how long in-flight requests are given to finish when Trickster is stopped
+	shutdownTimeout = 30 * time.Second
 )
 
 func main() {
@@ -78,30 +91,81 @@ func main() {
 	}
 	defer t.Cacher.Close()
 
+	authenticator, err := newProxyAuthenticator(t.Config.ProxyServer.Auth, t.Logger)
+	if err != nil {
+		level.Error(t.Logger).Log("event", "Unable to configure proxy authentication", "detail", err.Error())
+		os.Exit(1)
+	}
+	t.Authenticator = authenticator
+
+	t.startUpstreamPools()
+
 	router := mux.NewRouter()
 
 	// Health Check Paths
 	router.HandleFunc("/ping", t.pingHandler).Methods("GET")
-	router.HandleFunc("/{originMoniker}/"+mnHealth, t.promHealthCheckHandler).Methods("GET")
-	router.HandleFunc("/"+mnHealth, t.promHealthCheckHandler).Methods("GET")
+	router.Handle("/{originMoniker}/"+mnHealth, handlers.CompressHandler(http.HandlerFunc(t.promHealthCheckHandler))).Methods("GET")
+	router.Handle("/"+mnHealth, handlers.CompressHandler(http.HandlerFunc(t.promHealthCheckHandler))).Methods("GET")
 
-	// Path-based  multi-origin support - no support for full proxy of the prometheus UI, only querying
-	router.HandleFunc("/{originMoniker}"+prometheusAPIv1Path+mnQueryRange, t.promQueryRangeHandler).Methods("GET", "POST")
-	router.HandleFunc("/{originMoniker}"+prometheusAPIv1Path+mnQuery, t.promQueryHandler).Methods("GET", "POST")
-	router.PathPrefix("/{originMoniker}" + prometheusAPIv1Path).HandlerFunc(t.promFullProxyHandler).Methods("GET")
+	// Query responses are compressed here, while the full proxy forwards the client's Accept-Encoding and streams
+	// the origin's response as-is, so the origin's compression, Content-Length and Content-Encoding are preserved
 
-	router.HandleFunc(prometheusAPIv1Path+mnQueryRange, t.promQueryRangeHandler).Methods("GET", "POST")
-	router.HandleFunc(prometheusAPIv1Path+mnQuery, t.promQueryHandler).Methods("GET", "POST")
-	router.PathPrefix(prometheusAPIv1Path).HandlerFunc(t.promFullProxyHandler).Methods("GET")
+	// Path-based  multi-origin support - no support for full proxy of the prometheus UI, only querying
+	router.Handle("/{originMoniker}"+prometheusAPIv1Path+mnQueryRange, handlers.CompressHandler(t.withRateLimits(t.promQueryRangeHandler))).Methods("GET", "POST")
+	router.Handle("/{originMoniker}"+prometheusAPIv1Path+mnQuery, handlers.CompressHandler(t.withRateLimits(t.promQueryHandler))).Methods("GET", "POST")
+	router.Handle("/{originMoniker}"+prometheusAPIv1Path+mnLabelNames, handlers.CompressHandler(t.withRateLimits(t.promMetadataHandler(mdLabels)))).Methods("GET", "POST")
+	router.Handle("/{originMoniker}"+prometheusAPIv1Path+mnLabelValues, handlers.CompressHandler(t.withRateLimits(t.promMetadataHandler(mdLabelValues)))).Methods("GET")
+	router.Handle("/{originMoniker}"+prometheusAPIv1Path+mnSeries, handlers.CompressHandler(t.withRateLimits(t.promMetadataHandler(mdSeries)))).Methods("GET", "POST")
+	router.PathPrefix("/{originMoniker}" + prometheusAPIv1Path).HandlerFunc(t.withRateLimits(t.promFullProxyHandler))
+
+	router.Handle(prometheusAPIv1Path+mnQueryRange, handlers.CompressHandler(t.withRateLimits(t.promQueryRangeHandler))).Methods("GET", "POST")
+	router.Handle(prometheusAPIv1Path+mnQuery, handlers.CompressHandler(t.withRateLimits(t.promQueryHandler))).Methods("GET", "POST")
+	router.Handle(prometheusAPIv1Path+mnLabelNames, handlers.CompressHandler(t.withRateLimits(t.promMetadataHandler(mdLabels)))).Methods("GET", "POST")
+	router.Handle(prometheusAPIv1Path+mnLabelValues, handlers.CompressHandler(t.withRateLimits(t.promMetadataHandler(mdLabelValues)))).Methods("GET")
+	router.Handle(prometheusAPIv1Path+mnSeries, handlers.CompressHandler(t.withRateLimits(t.promMetadataHandler(mdSeries)))).Methods("GET", "POST")
+	router.PathPrefix(prometheusAPIv1Path).HandlerFunc(t.withRateLimits(t.promFullProxyHandler))
 
 	// Catch All for Single-Origin proxy
-	router.PathPrefix("/").HandlerFunc(t.promFullProxyHandler).Methods("GET")
+	router.PathPrefix("/").HandlerFunc(t.withRateLimits(t.promFullProxyHandler))
 
 	level.Info(t.Logger).Log("event", "proxy http endpoint starting", "address", t.Config.ProxyServer.ListenAddress, "port", t.Config.ProxyServer.ListenPort)
 
+	server := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", t.Config.ProxyServer.ListenAddress, t.Config.ProxyServer.ListenPort),
+		Handler: t.withAuthentication(router),
+	}
+
+	// Stop accepting requests on SIGINT or SIGTERM, and let the in-flight requests finish
+	shutdown := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		level.Info(t.Logger).Log("event", "proxy http endpoint shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(ctx)
+		close(shutdown)
+	}()
+
 	// Start the Server
-	err := http.ListenAndServe(fmt.Sprintf("%s:%d", t.Config.ProxyServer.ListenAddress, t.Config.ProxyServer.ListenPort), handlers.CompressHandler(router))
-	level.Error(t.Logger).Log("event", "exiting", "err", err)
+	if t.Config.ProxyServer.TLSCertFile != "" && t.Config.ProxyServer.TLSKeyFile != "" {
+		if server.TLSConfig, err = newProxyTLSConfig(t.Config.ProxyServer); err != nil {
+			level.Error(t.Logger).Log("event", "Unable to configure proxy TLS", "detail", err.Error())
+			os.Exit(1)
+		}
+		err = server.ListenAndServeTLS(t.Config.ProxyServer.TLSCertFile, t.Config.ProxyServer.TLSKeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		<-shutdown
+		level.Info(t.Logger).Log("event", "exiting")
+	} else {
+		level.Error(t.Logger).Log("event", "exiting", "err", err)
+	}
+
+	t.closeUpstreamPools()
 }
 
 func exposeProfilerEndpoint(c *Config, l log.Logger) {
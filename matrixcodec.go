@@ -0,0 +1,547 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// Cache serialization formats
+	csBinary = "binary"
+	csJSON   = "json"
+
+	// matrixCodecMagic is the first byte of a binary-encoded matrix. A snappy block can't start with a 0 byte
+	// unless it is empty, and JSON starts with "{", so the formats can be told apart by sniffing
+	matrixCodecMagic = 0x00
+	// matrixCodecVersion is the version of the binary encoding, which must change whenever the layout does.
+	// Version 2 added the extents of the matrix that were fetched from the origin, and version 3 added native histograms
+	matrixCodecVersion = 0x03
+	// matrixCodecVersionNoHistograms and matrixCodecVersionNoExtents are previous versions of the binary encoding,
+	// which are still decoded
+	matrixCodecVersionNoHistograms = 0x02
+	matrixCodecVersionNoExtents    = 0x01
+)
+
+// encodeMatrix serializes a PrometheusMatrixEnvelope into the compact binary format used for cache records.
+//
+// After the magic and version bytes, the layout is a sequence of uvarints and length-prefixed strings:
+// the status, the result type, the warnings, the extents fetched from the origin (each as its start and its length), a table of every distinct label name and value (so each is stored once),
+// and then each series as its label pairs (indexes into the table), its sample count, its timestamps in
+// milliseconds (the first in full, the second as a delta and the rest as delta-of-deltas), and a length-prefixed
+// bitstream of its values, XOR-compressed against the previous value as described in the Gorilla paper.
+// Native histogram series follow the float series, each as its label pairs, its sample count, its timestamps
+// encoded as above, and each histogram as a length-prefixed string of its JSON form.
+func encodeMatrix(pe PrometheusMatrixEnvelope) []byte {
+	buf := make([]byte, 0, 64+pe.getValueCount()*4)
+	buf = append(buf, matrixCodecMagic, matrixCodecVersion)
+
+	buf = appendString(buf, pe.Status)
+	buf = appendString(buf, pe.Data.ResultType)
+
+	buf = appendUvarint(buf, uint64(len(pe.Warnings)))
+	for _, w := range pe.Warnings {
+		buf = appendString(buf, w)
+	}
+
+	extents := pe.cachedExtents()
+	buf = appendUvarint(buf, uint64(len(extents)))
+	for _, e := range extents {
+		buf = appendVarint(buf, e.Start)
+		buf = appendUvarint(buf, uint64(e.End-e.Start))
+	}
+
+	// Intern the label names and values
+	strs := make([]string, 0)
+	index := make(map[string]uint64)
+	intern := func(s string) uint64 {
+		i, ok := index[s]
+		if !ok {
+			i = uint64(len(strs))
+			index[s] = i
+			strs = append(strs, s)
+		}
+		return i
+	}
+
+	internMetric := func(m model.Metric) []uint64 {
+		names := make([]string, 0, len(m))
+		for n := range m {
+			names = append(names, string(n))
+		}
+		sort.Strings(names)
+
+		idx := make([]uint64, 0, len(names)*2)
+		for _, n := range names {
+			idx = append(idx, intern(n), intern(string(m[model.LabelName(n)])))
+		}
+		return idx
+	}
+
+	labels := make([][]uint64, len(pe.Data.Result))
+	for i, s := range pe.Data.Result {
+		labels[i] = internMetric(s.Metric)
+	}
+	histogramLabels := make([][]uint64, len(pe.Data.Histograms))
+	for i, s := range pe.Data.Histograms {
+		histogramLabels[i] = internMetric(s.Metric)
+	}
+
+	buf = appendUvarint(buf, uint64(len(strs)))
+	for _, s := range strs {
+		buf = appendString(buf, s)
+	}
+
+	buf = appendUvarint(buf, uint64(len(pe.Data.Result)))
+	for i, s := range pe.Data.Result {
+		buf = appendUvarint(buf, uint64(len(labels[i])/2))
+		for _, idx := range labels[i] {
+			buf = appendUvarint(buf, idx)
+		}
+
+		buf = appendUvarint(buf, uint64(len(s.Values)))
+		if len(s.Values) == 0 {
+			continue
+		}
+
+		timestamps := make([]model.Time, len(s.Values))
+		for j, v := range s.Values {
+			timestamps[j] = v.Timestamp
+		}
+		buf = appendTimestamps(buf, timestamps)
+
+		values := encodeXORValues(s.Values)
+		buf = appendUvarint(buf, uint64(len(values)))
+		buf = append(buf, values...)
+	}
+
+	buf = appendUvarint(buf, uint64(len(pe.Data.Histograms)))
+	for i, s := range pe.Data.Histograms {
+		buf = appendUvarint(buf, uint64(len(histogramLabels[i])/2))
+		for _, idx := range histogramLabels[i] {
+			buf = appendUvarint(buf, idx)
+		}
+
+		buf = appendUvarint(buf, uint64(len(s.Histograms)))
+		timestamps := make([]model.Time, len(s.Histograms))
+		for j, h := range s.Histograms {
+			timestamps[j] = h.Timestamp
+		}
+		buf = appendTimestamps(buf, timestamps)
+		for _, h := range s.Histograms {
+			buf = appendString(buf, string(h.Histogram))
+		}
+	}
+
+	return buf
+}
+
+// appendTimestamps appends the timestamps, the first in full, the second as a delta and the rest as delta-of-deltas
+func appendTimestamps(buf []byte, timestamps []model.Time) []byte {
+	var prev, prevDelta int64
+	for j, t := range timestamps {
+		ts := int64(t)
+		switch j {
+		case 0:
+			buf = appendVarint(buf, ts)
+		default:
+			delta := ts - prev
+			buf = appendVarint(buf, delta-prevDelta)
+			prevDelta = delta
+		}
+		prev = ts
+	}
+	return buf
+}
+
+// decodeMatrix deserializes a PrometheusMatrixEnvelope encoded by encodeMatrix
+func decodeMatrix(data []byte, pe *PrometheusMatrixEnvelope) error {
+	if len(data) < 2 || data[0] != matrixCodecMagic {
+		return fmt.Errorf("not a binary matrix")
+	}
+	version := data[1]
+	if version != matrixCodecVersion && version != matrixCodecVersionNoHistograms && version != matrixCodecVersionNoExtents {
+		return fmt.Errorf("unsupported binary matrix version %d", data[1])
+	}
+
+	r := &byteReader{buf: data[2:]}
+
+	pe.Status = r.string()
+	pe.Data.ResultType = r.string()
+
+	pe.Warnings = nil
+	if n := r.uvarint(); n > 0 {
+		pe.Warnings = make([]string, 0, r.bound(n))
+		for i := uint64(0); i < n && r.err == nil; i++ {
+			pe.Warnings = append(pe.Warnings, r.string())
+		}
+	}
+
+	// matrices without extents are treated as having been fetched for the whole range of their data
+	pe.Extents = nil
+	if version != matrixCodecVersionNoExtents {
+		n := r.uvarint()
+		pe.Extents = make(ExtentList, 0, r.bound(n))
+		for i := uint64(0); i < n && r.err == nil; i++ {
+			start := r.varint()
+			pe.Extents = append(pe.Extents, MatrixExtents{Start: start, End: start + int64(r.uvarint())})
+		}
+	}
+
+	n := r.uvarint()
+	strs := make([]string, 0, r.bound(n))
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		strs = append(strs, r.string())
+	}
+	str := func(i uint64) string {
+		if i >= uint64(len(strs)) {
+			r.fail()
+			return ""
+		}
+		return strs[i]
+	}
+
+	metric := func() model.Metric {
+		nl := r.uvarint()
+		m := make(model.Metric, r.bound(nl))
+		for j := uint64(0); j < nl && r.err == nil; j++ {
+			name := str(r.uvarint())
+			m[model.LabelName(name)] = model.LabelValue(str(r.uvarint()))
+		}
+		return m
+	}
+
+	n = r.uvarint()
+	pe.Data.Result = make(model.Matrix, 0, r.bound(n))
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		s := &model.SampleStream{Metric: metric()}
+
+		ns := r.uvarint()
+		timestamps := r.timestamps(ns)
+		s.Values = make([]model.SamplePair, len(timestamps))
+		for j, ts := range timestamps {
+			s.Values[j].Timestamp = ts
+		}
+
+		if ns > 0 {
+			values := r.bytes(r.uvarint())
+			if r.err == nil {
+				r.err = decodeXORValues(values, s.Values)
+			}
+		}
+
+		pe.Data.Result = append(pe.Data.Result, s)
+	}
+
+	pe.Data.Histograms = nil
+	if version != matrixCodecVersionNoHistograms && version != matrixCodecVersionNoExtents {
+		if n = r.uvarint(); n > 0 {
+			pe.Data.Histograms = make(HistogramMatrix, 0, r.bound(n))
+		}
+		for i := uint64(0); i < n && r.err == nil; i++ {
+			s := &HistogramStream{Metric: metric()}
+
+			timestamps := r.timestamps(r.uvarint())
+			s.Histograms = make([]HistogramPair, len(timestamps))
+			for j, ts := range timestamps {
+				s.Histograms[j] = HistogramPair{Timestamp: ts, Histogram: json.RawMessage(r.string())}
+			}
+
+			pe.Data.Histograms = append(pe.Data.Histograms, s)
+		}
+	}
+
+	if r.err != nil {
+		return fmt.Errorf("corrupt binary matrix: %v", r.err)
+	}
+
+	return nil
+}
+
+// jsonCacheMatrix is a matrix as it is stored in the cache with the JSON serialization, which unlike the API response
+// includes its extents. Records written before extents were tracked have none, and are treated as having been
+// fetched for the whole range of their data
+type jsonCacheMatrix struct {
+	PrometheusMatrixEnvelope
+	Extents ExtentList `json:"extents"`
+}
+
+// encodeCacheMatrix serializes a matrix for storage in the cache in the configured format
+func (t *TricksterHandler) encodeCacheMatrix(pe PrometheusMatrixEnvelope) ([]byte, error) {
+	var body []byte
+	if t.Config.Caching.Serialization == csJSON {
+		var err error
+		if body, err = json.Marshal(jsonCacheMatrix{PrometheusMatrixEnvelope: pe, Extents: pe.cachedExtents()}); err != nil {
+			return nil, err
+		}
+	} else {
+		body = encodeMatrix(pe)
+	}
+
+	return t.encodeCacheRecord(body)
+}
+
+// decodeCacheMatrix deserializes a cached matrix. Records are sniffed for their format rather than relying on the
+// current configuration, because the serialization or compression settings may have changed since they were written
+func decodeCacheMatrix(data []byte, pe *PrometheusMatrixEnvelope) error {
+	data = decodeCacheRecord(data)
+	if len(data) == 0 {
+		return fmt.Errorf("empty cache record")
+	}
+
+	if data[0] == matrixCodecMagic {
+		return decodeMatrix(data, pe)
+	}
+
+	cm := jsonCacheMatrix{}
+	if err := json.Unmarshal(data, &cm); err != nil {
+		return err
+	}
+	*pe = cm.PrometheusMatrixEnvelope
+	pe.Extents = cm.Extents
+
+	return nil
+}
+
+// encodeXORValues compresses the values of a series into a bitstream, where each value is stored as its XOR
+// with the previous value. Identical values take a single bit, and similar values only their differing bits.
+func encodeXORValues(values []model.SamplePair) []byte {
+	w := &bitWriter{}
+
+	prev := math.Float64bits(float64(values[0].Value))
+	w.writeBits(prev, 64)
+
+	var leading, trailing uint8 = 0xff, 0
+	for _, v := range values[1:] {
+		cur := math.Float64bits(float64(v.Value))
+		xor := cur ^ prev
+		prev = cur
+
+		if xor == 0 {
+			w.writeBit(false)
+			continue
+		}
+		w.writeBit(true)
+
+		l := uint8(bits.LeadingZeros64(xor))
+		t := uint8(bits.TrailingZeros64(xor))
+		if l > 31 {
+			// the leading zero count is stored in 5 bits
+			l = 31
+		}
+
+		if leading != 0xff && l >= leading && t >= trailing {
+			// the meaningful bits fit within the previous window
+			w.writeBit(false)
+			w.writeBits(xor>>trailing, int(64-leading-trailing))
+			continue
+		}
+
+		leading, trailing = l, t
+		sigbits := 64 - l - t
+		w.writeBit(true)
+		w.writeBits(uint64(l), 5)
+		// 64 significant bits is stored as 0, since it can't fit in 6 bits and 0 can't otherwise occur
+		w.writeBits(uint64(sigbits&0x3f), 6)
+		w.writeBits(xor>>t, int(sigbits))
+	}
+
+	return w.buf
+}
+
+// decodeXORValues decompresses a bitstream written by encodeXORValues into the values of the provided samples
+func decodeXORValues(data []byte, values []model.SamplePair) error {
+	r := &bitReader{buf: data}
+
+	prev := r.readBits(64)
+	values[0].Value = model.SampleValue(math.Float64frombits(prev))
+
+	var leading, trailing uint8
+	for i := 1; i < len(values); i++ {
+		if r.readBit() {
+			if r.readBit() {
+				leading = uint8(r.readBits(5))
+				sigbits := uint8(r.readBits(6))
+				if sigbits == 0 {
+					sigbits = 64
+				}
+				trailing = 64 - leading - sigbits
+			}
+			prev ^= r.readBits(int(64-leading-trailing)) << trailing
+		}
+		values[i].Value = model.SampleValue(math.Float64frombits(prev))
+	}
+
+	if r.overflow {
+		return fmt.Errorf("truncated values")
+	}
+
+	return nil
+}
+
+// appendUvarint appends a uvarint to buf
+func appendUvarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+// appendVarint appends a varint to buf
+func appendVarint(buf []byte, v int64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutVarint(b[:], v)]...)
+}
+
+// appendString appends a length-prefixed string to buf
+func appendString(buf []byte, s string) []byte {
+	buf = appendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// byteReader reads the uvarints and strings of a binary matrix, recording the first error encountered
+type byteReader struct {
+	buf []byte
+	err error
+}
+
+func (r *byteReader) fail() {
+	if r.err == nil {
+		r.err = fmt.Errorf("unexpected end of data")
+	}
+}
+
+func (r *byteReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *byteReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *byteReader) bytes(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.buf)) {
+		r.fail()
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *byteReader) string() string {
+	return string(r.bytes(r.uvarint()))
+}
+
+// bound caps a decoded element count by the remaining data, so that corrupt counts can't cause huge allocations
+func (r *byteReader) bound(n uint64) int {
+	if n > uint64(len(r.buf)) {
+		return len(r.buf)
+	}
+	return int(n)
+}
+
+// timestamps reads n timestamps written by appendTimestamps
+func (r *byteReader) timestamps(n uint64) []model.Time {
+	timestamps := make([]model.Time, 0, r.bound(n))
+	var prev, delta int64
+	for j := uint64(0); j < n && r.err == nil; j++ {
+		switch j {
+		case 0:
+			prev = r.varint()
+		default:
+			delta += r.varint()
+			prev += delta
+		}
+		timestamps = append(timestamps, model.Time(prev))
+	}
+	return timestamps
+}
+
+// bitWriter appends individual bits to a byte slice, most significant bit first
+type bitWriter struct {
+	buf   []byte
+	count uint8 // the number of bits free in the last byte
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.count == 0 {
+		w.buf = append(w.buf, 0)
+		w.count = 8
+	}
+	w.count--
+	if bit {
+		w.buf[len(w.buf)-1] |= 1 << w.count
+	}
+}
+
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.writeBit(v&(1<<uint(i)) != 0)
+	}
+}
+
+// bitReader reads individual bits written by a bitWriter
+type bitReader struct {
+	buf      []byte
+	pos      int
+	overflow bool
+}
+
+func (r *bitReader) readBit() bool {
+	if r.pos >= len(r.buf)*8 {
+		r.overflow = true
+		return false
+	}
+	bit := r.buf[r.pos/8]&(0x80>>uint(r.pos%8)) != 0
+	r.pos++
+	return bit
+}
+
+func (r *bitReader) readBits(n int) uint64 {
+	var v uint64
+	for i := 0; i < n; i++ {
+		v <<= 1
+		if r.readBit() {
+			v |= 1
+		}
+	}
+	return v
+}
@@ -0,0 +1,262 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+)
+
+// newTestCodecMatrix returns a matrix exercising irregular timestamps and special float values
+func newTestCodecMatrix() PrometheusMatrixEnvelope {
+	values := []float64{1, 1, 1.5, -2, 0, math.NaN(), math.Inf(1), math.Inf(-1), 1e-300, 123456789.123, 123456789.124, 3}
+	s1 := &model.SampleStream{Metric: model.Metric{"__name__": "up", "job": "prometheus", "instance": "localhost:9090"}}
+	s2 := &model.SampleStream{Metric: model.Metric{"__name__": "up", "job": "node", "instance": "localhost:9090"}}
+	ts := int64(1435781430000)
+	for i, v := range values {
+		ts += 15000 + int64(i%3)*1000
+		s1.Values = append(s1.Values, model.SamplePair{Timestamp: model.Time(ts), Value: model.SampleValue(v)})
+		s2.Values = append(s2.Values, model.SamplePair{Timestamp: model.Time(ts), Value: model.SampleValue(float64(i))})
+	}
+	s3 := &model.SampleStream{Metric: model.Metric{"__name__": "empty"}, Values: []model.SamplePair{}}
+
+	return PrometheusMatrixEnvelope{
+		Status:   rvSuccess,
+		Data:     PrometheusMatrixData{ResultType: rvMatrix, Result: model.Matrix{s1, s2, s3}},
+		Warnings: []string{"a warning"},
+	}
+}
+
+// matricesEqual compares matrices, treating NaN values as equal
+func matricesEqual(pe1, pe2 PrometheusMatrixEnvelope) error {
+	if pe1.Status != pe2.Status || pe1.Data.ResultType != pe2.Data.ResultType || fmt.Sprint(pe1.Warnings) != fmt.Sprint(pe2.Warnings) {
+		return fmt.Errorf("envelopes differ: %+v != %+v", pe1, pe2)
+	}
+	if len(pe1.Data.Result) != len(pe2.Data.Result) {
+		return fmt.Errorf("wanted %d series got %d", len(pe1.Data.Result), len(pe2.Data.Result))
+	}
+	for i := range pe1.Data.Result {
+		s1, s2 := pe1.Data.Result[i], pe2.Data.Result[i]
+		if !s1.Metric.Equal(s2.Metric) {
+			return fmt.Errorf("series %d: wanted metric %v got %v", i, s1.Metric, s2.Metric)
+		}
+		if len(s1.Values) != len(s2.Values) {
+			return fmt.Errorf("series %d: wanted %d values got %d", i, len(s1.Values), len(s2.Values))
+		}
+		for j := range s1.Values {
+			v1, v2 := s1.Values[j], s2.Values[j]
+			if v1.Timestamp != v2.Timestamp || math.Float64bits(float64(v1.Value)) != math.Float64bits(float64(v2.Value)) {
+				return fmt.Errorf("series %d value %d: wanted %v got %v", i, j, v1, v2)
+			}
+		}
+	}
+	return nil
+}
+
+func TestEncodeDecodeMatrix(t *testing.T) {
+	pe := newTestCodecMatrix()
+
+	data := encodeMatrix(pe)
+	if data[0] != matrixCodecMagic || data[1] != matrixCodecVersion {
+		t.Fatalf("unexpected header %v", data[:2])
+	}
+
+	pe2 := PrometheusMatrixEnvelope{}
+	if err := decodeMatrix(data, &pe2); err != nil {
+		t.Fatal(err)
+	}
+	if err := matricesEqual(pe, pe2); err != nil {
+		t.Error(err)
+	}
+
+	// it should be smaller than the JSON encoding
+	pe.Data.Result[0].Values[5].Value = 0 // NaN can't be marshaled to JSON
+	j, _ := json.Marshal(pe)
+	if len(data) >= len(j) {
+		t.Errorf("expected binary encoding (%d bytes) to be smaller than JSON (%d bytes)", len(data), len(j))
+	}
+}
+
+func TestDecodeMatrix_corrupt(t *testing.T) {
+	data := encodeMatrix(newTestCodecMatrix())
+
+	// it should return an error, rather than panic, for any truncation of the data
+	for i := 0; i < len(data); i++ {
+		pe := PrometheusMatrixEnvelope{}
+		if err := decodeMatrix(data[:i], &pe); err == nil {
+			t.Errorf("expected an error decoding %d of %d bytes", i, len(data))
+		}
+	}
+
+	// it should reject other versions
+	data[1] = matrixCodecVersion + 1
+	if err := decodeMatrix(data, &PrometheusMatrixEnvelope{}); err == nil {
+		t.Error("expected an error for an unsupported version")
+	}
+}
+
+func TestDecodeCacheMatrix(t *testing.T) {
+	pe := PrometheusMatrixEnvelope{}
+	if err := json.Unmarshal([]byte(exampleRangeResponse), &pe); err != nil {
+		t.Fatal(err)
+	}
+
+	binaryData := encodeMatrix(pe)
+
+	tests := map[string][]byte{
+		"json":          []byte(exampleRangeResponse),
+		"snappy json":   snappy.Encode(nil, []byte(exampleRangeResponse)),
+		"binary":        binaryData,
+		"snappy binary": snappy.Encode(nil, binaryData),
+	}
+
+	// it should decode records in any format, regardless of configuration
+	for name, data := range tests {
+		pe2 := PrometheusMatrixEnvelope{}
+		if err := decodeCacheMatrix(data, &pe2); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if err := matricesEqual(pe, pe2); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	if err := decodeCacheMatrix(nil, &PrometheusMatrixEnvelope{}); err == nil {
+		t.Error("expected an error for an empty record")
+	}
+}
+
+func TestEncodeDecodeMatrix_extents(t *testing.T) {
+	pe := PrometheusMatrixEnvelope{}
+	if err := json.Unmarshal([]byte(exampleRangeResponse), &pe); err != nil {
+		t.Fatal(err)
+	}
+	pe.Extents = ExtentList{{Start: 1435781400000, End: 1435781430000}, {Start: 1435781460000, End: 1435781490000}}
+
+	// it should round trip the extents
+	pe2 := PrometheusMatrixEnvelope{}
+	if err := decodeMatrix(encodeMatrix(pe), &pe2); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pe.Extents, pe2.Extents) {
+		t.Errorf("wanted extents %v got %v.", pe.Extents, pe2.Extents)
+	}
+
+	// it should store the extents of the data for a matrix without any
+	pe.Extents = nil
+	if err := decodeMatrix(encodeMatrix(pe), &pe2); err != nil {
+		t.Fatal(err)
+	}
+	if want := (ExtentList{{Start: 1435781430000, End: 1435781460000}}); !reflect.DeepEqual(pe2.Extents, want) {
+		t.Errorf("wanted extents %v got %v.", want, pe2.Extents)
+	}
+
+	// it should decode the previous version, which has no extents. Its layout is the same as the current
+	// version's without the extents count, which here follows the status, result type and empty warnings
+	data := encodeMatrix(PrometheusMatrixEnvelope{Status: pe.Status, Data: pe.Data, Extents: ExtentList{}})
+	i := 2 + 1 + len(pe.Status) + 1 + len(pe.Data.ResultType) + 1
+	data = append(append([]byte{}, data[:i]...), data[i+1:]...)
+	data[1] = matrixCodecVersionNoExtents
+	pe2 = PrometheusMatrixEnvelope{}
+	if err := decodeMatrix(data, &pe2); err != nil {
+		t.Fatal(err)
+	}
+	if err := matricesEqual(pe, pe2); err != nil {
+		t.Error(err)
+	}
+	if pe2.Extents != nil {
+		t.Errorf("wanted no extents got %v.", pe2.Extents)
+	}
+}
+
+func TestTricksterHandler_encodeCacheMatrix(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	pe := PrometheusMatrixEnvelope{}
+	if err := json.Unmarshal([]byte(exampleRangeResponse), &pe); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, serialization := range []string{csBinary, csJSON} {
+		for _, compression := range []CompressionCodec{ccSnappy, ccNone} {
+			tr.Config.Caching.Serialization = serialization
+			tr.Config.Caching.Compression = compression
+
+			data, err := tr.encodeCacheMatrix(pe)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pe2 := PrometheusMatrixEnvelope{}
+			if err := decodeCacheMatrix(data, &pe2); err != nil {
+				t.Fatalf("%s/%s: %v", serialization, compression, err)
+			}
+			if err := matricesEqual(pe, pe2); err != nil {
+				t.Errorf("%s/%s: %v", serialization, compression, err)
+			}
+			if want := pe.cachedExtents(); !reflect.DeepEqual(pe2.Extents, want) {
+				t.Errorf("%s/%s: wanted extents %v got %v.", serialization, compression, want, pe2.Extents)
+			}
+		}
+	}
+}
+
+// newBenchmarkMatrix returns a matrix the size of a typical dashboard panel: 50 series of 24 hours at a 15s step
+func newBenchmarkMatrix() PrometheusMatrixEnvelope {
+	pe := PrometheusMatrixEnvelope{Status: rvSuccess, Data: PrometheusMatrixData{ResultType: rvMatrix}}
+	for i := 0; i < 50; i++ {
+		s := &model.SampleStream{Metric: model.Metric{"__name__": "http_requests_total", "job": "api", "instance": model.LabelValue(fmt.Sprintf("host-%d:9090", i))}}
+		for j := 0; j < 5760; j++ {
+			s.Values = append(s.Values, model.SamplePair{Timestamp: model.Time(1435781430000 + int64(j)*15000), Value: model.SampleValue(float64(j*10 + i%7))})
+		}
+		pe.Data.Result = append(pe.Data.Result, s)
+	}
+	return pe
+}
+
+func BenchmarkMatrixCodec_binary(b *testing.B) {
+	pe := newBenchmarkMatrix()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pe2 := PrometheusMatrixEnvelope{}
+		if err := decodeMatrix(encodeMatrix(pe), &pe2); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMatrixCodec_json(b *testing.B) {
+	pe := newBenchmarkMatrix()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data, err := json.Marshal(pe)
+		if err != nil {
+			b.Fatal(err)
+		}
+		pe2 := PrometheusMatrixEnvelope{}
+		if err := json.Unmarshal(data, &pe2); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -30,7 +30,7 @@ type MemoryCache struct {
 // CacheObject represents a Cached object as stored in the Memory Cache
 type CacheObject struct {
 	Key        string
-	Value      string
+	Value      []byte
 	Expiration int64
 }
 
@@ -43,20 +43,20 @@ func (c *MemoryCache) Connect() error {
 }
 
 // Store places an object in the cache using the specified key and ttl
-func (c *MemoryCache) Store(cacheKey string, data string, ttl int64) error {
+func (c *MemoryCache) Store(cacheKey string, data []byte, ttl int64) error {
 	level.Debug(c.T.Logger).Log("event", "memorycache cache store", "key", cacheKey)
 	c.client.Store(cacheKey, CacheObject{Key: cacheKey, Value: data, Expiration: time.Now().Unix() + ttl})
 	return nil
 }
 
 // Retrieve looks for an object in cache and returns it (or an error if not found)
-func (c *MemoryCache) Retrieve(cacheKey string) (string, error) {
+func (c *MemoryCache) Retrieve(cacheKey string) ([]byte, error) {
 	record, ok := c.client.Load(cacheKey)
 	if ok {
 		level.Debug(c.T.Logger).Log("event", "memorycache cache retrieve", "key", cacheKey)
 		return record.(CacheObject).Value, nil
 	}
-	return "", fmt.Errorf("Value  for key [%s] not in cache", cacheKey)
+	return nil, fmt.Errorf("Value  for key [%s] not in cache", cacheKey)
 }
 
 // Reap continually iterates through the cache to find expired elements and removes them
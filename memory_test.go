@@ -48,7 +48,7 @@ func TestMemoryCache_Store(t *testing.T) {
 	}
 
 	// it should store a value
-	err = mc.Store("cacheKey", "data", 60000)
+	err = mc.Store("cacheKey", []byte("data"), 60000)
 	if err != nil {
 		t.Error(err)
 	}
@@ -62,18 +62,18 @@ func TestMemoryCache_Retrieve(t *testing.T) {
 		t.Error(err)
 	}
 
-	err = mc.Store("cacheKey", "data", 60000)
+	err = mc.Store("cacheKey", []byte("data"), 60000)
 	if err != nil {
 		t.Error(err)
 	}
 
 	// it should retrieve a value
-	var data string
+	var data []byte
 	data, err = mc.Retrieve("cacheKey")
 	if err != nil {
 		t.Error(err)
 	}
-	if data != "data" {
+	if string(data) != "data" {
 		t.Errorf("wanted \"%s\". got \"%s\"", "data", data)
 	}
 }
@@ -87,7 +87,7 @@ func TestMemoryCache_ReapOnce(t *testing.T) {
 	}
 
 	// fake an expired entry
-	mc.Store("cacheKey", "data", -1000)
+	mc.Store("cacheKey", []byte("data"), -1000)
 
 	// fake a response channel to reap
 	ch := make(chan *ClientRequestContext, 100)
@@ -105,3 +105,11 @@ func TestMemoryCache_Close(t *testing.T) {
 	mc := setupMemoryCache()
 	mc.Close()
 }
+
+func BenchmarkMemoryCache(b *testing.B) {
+	mc := setupMemoryCache()
+	if err := mc.Connect(); err != nil {
+		b.Fatal(err)
+	}
+	benchmarkCache(b, &mc)
+}
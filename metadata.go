@@ -0,0 +1,164 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Prometheus metadata endpoints, which are also the names used for them in configurations and metrics
+	mdLabels      = "labels"
+	mdLabelValues = "label_values"
+	mdSeries      = "series"
+
+	defaultMetadataTTLSecs         = 60
+	defaultMetadataGranularitySecs = 60
+)
+
+// promMetadataHandler returns a handler for calls to the metadata endpoint, which caches responses
+// for the endpoint's TTL. The start and end parameters are widened to the origin's metadata granularity
+// so that repeated requests for a moving time range (e.g., dashboard variable dropdowns) share a cache key
+func (t *TricksterHandler) promMetadataHandler(endpoint string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if o := t.getOrigin(r); o.OriginType == otFanout {
+			t.promFanoutMetadataHandler(w, r, o, endpoint)
+			return
+		}
+
+		path := r.URL.Path
+		vars := mux.Vars(r)
+
+		// clear out the origin moniker from the front of the API path
+		if originName, ok := vars["originMoniker"]; ok {
+			if strings.HasPrefix(path, "/"+originName) {
+				path = strings.Replace(path, "/"+originName, "", 1)
+			}
+		}
+
+		o := t.getProxyOrigin(r)
+		originURL := strings.TrimSuffix(o.OriginURL, "/") + strings.Replace(path, "//", "/", 1)
+
+		// Get the params from the User request so we can inspect them and pass on to prometheus
+		if err := r.ParseForm(); err != nil {
+			level.Error(t.Logger).Log(lfEvent, "error parsing form", lfDetail, err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		params := r.Form
+
+		if err := roundMetadataTimes(params, metadataGranularity(o)); err != nil {
+			writePrometheusError(w, http.StatusBadRequest, etBadData, err.Error())
+			return
+		}
+
+		body, resp, err := t.fetchPromMetadata(o, endpoint, originURL, params, r)
+		if err != nil {
+			level.Error(t.Logger).Log(lfEvent, "error fetching data from origin Prometheus", lfDetail, err.Error())
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		writeResponse(w, body, resp)
+	}
+}
+
+// fetchPromMetadata returns the cached response for the metadata request if found, otherwise
+// it proxies the request to the Prometheus origin and caches successful responses for the endpoint's TTL.
+// A request with a Cache-Control: no-cache header skips the cached response, as query_range requests do
+func (t *TricksterHandler) fetchPromMetadata(o PrometheusOriginConfig, endpoint, originURL string, params url.Values, r *http.Request) ([]byte, *http.Response, error) {
+	ttl := metadataTTL(o, endpoint)
+
+	// metadata requests are keyed on all of their (rounded) params, e.g., the match[] series selectors
+	cacheKey := deriveCacheKey(o, originURL+"?"+params.Encode(), r.Header, nil)
+
+	resp := &http.Response{}
+
+	cacheResult := crKeyMiss
+	if noCacheRequested(o, r) {
+		cacheResult = crPurge
+	} else if ttl > 0 {
+		if cachedBody, err := t.Cacher.Retrieve(cacheKey); err == nil {
+			resp.StatusCode = http.StatusOK
+			t.Metrics.CacheRequestStatus.WithLabelValues(originURL, otPrometheus, endpoint, crHit, strconv.Itoa(resp.StatusCode)).Inc()
+			return decodeCacheRecord(cachedBody), resp, nil
+		}
+	}
+
+	body, resp, duration, err := t.getURL(r.Context(), o, r.Method, originURL, params, getProxyableClientHeaders(o, r))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t.Metrics.ProxyRequestDuration.WithLabelValues(originURL, otPrometheus, endpoint, cacheResult, strconv.Itoa(resp.StatusCode)).Observe(duration.Seconds())
+
+	// only successful responses are cached, so that errors (e.g., a bad match[] selector) aren't served after they are fixed
+	if ttl > 0 && resp.StatusCode == http.StatusOK {
+		if record, err := t.encodeCacheRecord(body); err == nil {
+			t.Cacher.Store(cacheKey, record, ttl)
+		} else {
+			level.Error(t.Logger).Log(lfEvent, "error encoding cache record", lfDetail, err.Error())
+		}
+	}
+
+	t.Metrics.CacheRequestStatus.WithLabelValues(originURL, otPrometheus, endpoint, cacheResult, strconv.Itoa(resp.StatusCode)).Inc()
+
+	return body, resp, nil
+}
+
+// roundMetadataTimes widens the start and end params, when present, outward to multiples of granularity seconds
+func roundMetadataTimes(params url.Values, granularity int64) error {
+	for _, name := range []string{upStart, upEnd} {
+		value, ok := params[name]
+		if !ok || len(value) == 0 {
+			continue
+		}
+
+		ts, err := parseTime(value[0])
+		if err != nil {
+			return err
+		}
+
+		s := ts.Unix()
+		if name == upStart {
+			s -= s % granularity
+		} else if s%granularity != 0 || ts.Nanosecond() != 0 {
+			s += granularity - s%granularity
+		}
+		params.Set(name, strconv.FormatInt(s, 10))
+	}
+	return nil
+}
+
+// metadataTTL returns how long responses from the origin's metadata endpoint are cached. 0 disables caching
+func metadataTTL(o PrometheusOriginConfig, endpoint string) int64 {
+	if ttl, ok := o.MetadataTTLSecs[endpoint]; ok {
+		return ttl
+	}
+	return defaultMetadataTTLSecs
+}
+
+// metadataGranularity returns the number of seconds the start and end params of the origin's metadata requests are rounded to
+func metadataGranularity(o PrometheusOriginConfig) int64 {
+	if o.MetadataGranularitySecs > 0 {
+		return o.MetadataGranularitySecs
+	}
+	return defaultMetadataGranularitySecs
+}
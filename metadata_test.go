@@ -0,0 +1,189 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+const exampleLabelValuesResponse = `{"status":"success","data":["node","prometheus"]}`
+
+func TestRoundMetadataTimes(t *testing.T) {
+	tests := []struct {
+		start, end         string
+		wantStart, wantEnd string
+	}{
+		{"1435781445", "1435781475", "1435781400", "1435781520"},
+		{"1435781400", "1435781460", "1435781400", "1435781460"},
+		{"1435781400.5", "1435781460.5", "1435781400", "1435781520"},
+		{"2015-07-01T20:10:45Z", "2015-07-01T20:11:15Z", "1435781400", "1435781520"},
+	}
+
+	for _, test := range tests {
+		params := url.Values{upStart: []string{test.start}, upEnd: []string{test.end}}
+		if err := roundMetadataTimes(params, 60); err != nil {
+			t.Fatal(err)
+		}
+		if params.Get(upStart) != test.wantStart || params.Get(upEnd) != test.wantEnd {
+			t.Errorf("wanted %s-%s got %s-%s.", test.wantStart, test.wantEnd, params.Get(upStart), params.Get(upEnd))
+		}
+	}
+
+	// it should leave absent params absent
+	params := url.Values{}
+	if err := roundMetadataTimes(params, 60); err != nil {
+		t.Fatal(err)
+	}
+	if len(params) != 0 {
+		t.Errorf("wanted no params got %v.", params)
+	}
+
+	// it should reject invalid times
+	if err := roundMetadataTimes(url.Values{upStart: []string{"yesterday"}}, 60); err == nil {
+		t.Errorf("expected error for invalid start")
+	}
+}
+
+func TestTricksterHandler_promMetadataHandler(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es, requests := newRecordingTestServer(exampleLabelValuesResponse)
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	handler := tr.promMetadataHandler(mdLabelValues)
+	path := es.URL + prometheusAPIv1Path + "label/job/values"
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", path+"?start=1435781445&end=1435781475", nil))
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("wanted 200 got %d.", w.Result().StatusCode)
+	}
+
+	// it should send the rounded times to the origin
+	if req := <-requests; req.RawQuery != "end=1435781520&start=1435781400" {
+		t.Errorf("wanted rounded times got %q.", req.RawQuery)
+	}
+
+	// it should serve a request within the same granularity from the cache
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", path+"?start=1435781450&end=1435781480", nil))
+	body, _ := ioutil.ReadAll(w.Result().Body)
+	if string(body) != exampleLabelValuesResponse {
+		t.Errorf("wanted %s got %s.", exampleLabelValuesResponse, body)
+	}
+	if len(requests) != 0 {
+		t.Errorf("wanted the request served from cache got %d origin requests.", len(requests))
+	}
+
+	// it should not share cached responses between label names
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", es.URL+prometheusAPIv1Path+"label/instance/values?start=1435781445&end=1435781475", nil))
+	if len(requests) != 1 {
+		t.Errorf("wanted 1 origin request got %d.", len(requests))
+	}
+	<-requests
+
+	// it should reject invalid times
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", path+"?start=yesterday", nil))
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("wanted 400 got %d.", w.Result().StatusCode)
+	}
+}
+
+func TestTricksterHandler_promMetadataHandler_ttl(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es, requests := newRecordingTestServer(exampleLabelValuesResponse)
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	o := tr.Config.Origins["default"]
+	o.MetadataTTLSecs = map[string]int64{mdSeries: 0}
+	tr.Config.Origins["default"] = o
+
+	if ttl := metadataTTL(o, mdLabels); ttl != defaultMetadataTTLSecs {
+		t.Errorf("wanted default ttl %d got %d.", defaultMetadataTTLSecs, ttl)
+	}
+
+	// it should not cache endpoints with a ttl of 0
+	for i := 0; i < 2; i++ {
+		tr.promMetadataHandler(mdSeries)(httptest.NewRecorder(), httptest.NewRequest("GET", es.URL+prometheusAPIv1Path+"series?match[]=up", nil))
+	}
+	if len(requests) != 2 {
+		t.Errorf("wanted 2 origin requests got %d.", len(requests))
+	}
+}
+
+func TestTricksterHandler_promMetadataHandler_error(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	requests := 0
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	// it should pass errors through without caching them
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		tr.promMetadataHandler(mdSeries)(w, httptest.NewRequest("GET", es.URL+prometheusAPIv1Path+"series?match[]={", nil))
+		if w.Result().StatusCode != http.StatusBadRequest {
+			t.Errorf("wanted 400 got %d.", w.Result().StatusCode)
+		}
+	}
+	if requests != 2 {
+		t.Errorf("wanted 2 origin requests got %d.", requests)
+	}
+}
+
+func TestTricksterHandler_promMetadataHandler_noCache(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es, requests := newRecordingTestServer(exampleLabelValuesResponse)
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	o := tr.Config.Origins["default"]
+	o.IgnoreNoCacheHeader = false
+	tr.Config.Origins["default"] = o
+
+	handler := tr.promMetadataHandler(mdLabels)
+	request := func() {
+		r := httptest.NewRequest("GET", es.URL+prometheusAPIv1Path+"labels", nil)
+		r.Header.Set(hnCacheControl, hvNoCache)
+		handler(httptest.NewRecorder(), r)
+	}
+
+	// it should bypass the cache for requests with a no-cache header
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", es.URL+prometheusAPIv1Path+"labels", nil))
+	request()
+	if len(requests) != 2 {
+		t.Errorf("wanted 2 origin requests got %d.", len(requests))
+	}
+
+	// it should serve them from the cache when the origin ignores the header
+	o.IgnoreNoCacheHeader = true
+	tr.Config.Origins["default"] = o
+	request()
+	if len(requests) != 2 {
+		t.Errorf("wanted 2 origin requests got %d.", len(requests))
+	}
+}
@@ -28,9 +28,17 @@ import (
 
 // ApplicationMetrics enumerates the metrics collected and reported by the trickster application.
 type ApplicationMetrics struct {
-	CacheRequestStatus   *prometheus.CounterVec
-	CacheRequestElements *prometheus.CounterVec
-	ProxyRequestDuration *prometheus.HistogramVec
+	CacheRequestStatus     *prometheus.CounterVec
+	CacheRequestElements   *prometheus.CounterVec
+	ProxyRequestDuration   *prometheus.HistogramVec
+	UpstreamHealth         *prometheus.GaugeVec
+	UpstreamFailures       *prometheus.CounterVec
+	CircuitBreakerState    *prometheus.GaugeVec
+	RateLimit              *prometheus.GaugeVec
+	RateLimitRejections    *prometheus.CounterVec
+	OriginRequestsInFlight *prometheus.GaugeVec
+	CacheRawBytes          *prometheus.CounterVec
+	CacheStoredBytes       *prometheus.CounterVec
 }
 
 // Unregister removes registered metrics from the Prometheus metrics instrumentation.
@@ -38,6 +46,14 @@ func (metrics ApplicationMetrics) Unregister() {
 	prometheus.Unregister(metrics.CacheRequestStatus)
 	prometheus.Unregister(metrics.CacheRequestElements)
 	prometheus.Unregister(metrics.ProxyRequestDuration)
+	prometheus.Unregister(metrics.UpstreamHealth)
+	prometheus.Unregister(metrics.UpstreamFailures)
+	prometheus.Unregister(metrics.CircuitBreakerState)
+	prometheus.Unregister(metrics.RateLimit)
+	prometheus.Unregister(metrics.RateLimitRejections)
+	prometheus.Unregister(metrics.OriginRequestsInFlight)
+	prometheus.Unregister(metrics.CacheRawBytes)
+	prometheus.Unregister(metrics.CacheStoredBytes)
 }
 
 // ListenAndServe Starts the HTTP Server for Prometheus Scraping
@@ -82,11 +98,75 @@ func NewApplicationMetrics() *ApplicationMetrics {
 			},
 			[]string{"origin", "origin_type", "method", "status", "http_status"},
 		),
+		UpstreamHealth: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "trickster_upstream_healthy",
+				Help: "Health of each upstream of a multi-upstream origin (1 = healthy, 0 = ejected)",
+			},
+			[]string{"origin", "upstream"},
+		),
+		UpstreamFailures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "trickster_upstream_failures_total",
+				Help: "Count of failed requests to each upstream of a multi-upstream origin",
+			},
+			[]string{"origin", "upstream"},
+		),
+		CircuitBreakerState: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "trickster_circuit_breaker_state",
+				Help: "State of each origin's circuit breaker (0 = closed, 1 = open, 2 = half-open)",
+			},
+			[]string{"origin"},
+		),
+		RateLimit: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "trickster_rate_limit",
+				Help: "Configured rate and concurrency limits of each origin",
+			},
+			[]string{"origin", "limit"},
+		),
+		RateLimitRejections: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "trickster_rate_limited_requests_total",
+				Help: "Count of requests rejected for exceeding an origin or client rate limit",
+			},
+			[]string{"origin", "scope"},
+		),
+		OriginRequestsInFlight: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "trickster_origin_requests_in_flight",
+				Help: "Number of requests in flight to each origin with a concurrency limit",
+			},
+			[]string{"origin"},
+		),
+		CacheRawBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "trickster_cache_raw_bytes_total",
+				Help: "Count of bytes written to the cache before compression",
+			},
+			[]string{"codec"},
+		),
+		CacheStoredBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "trickster_cache_stored_bytes_total",
+				Help: "Count of bytes written to the cache after compression",
+			},
+			[]string{"codec"},
+		),
 	}
 
 	prometheus.MustRegister(metrics.CacheRequestStatus)
 	prometheus.MustRegister(metrics.CacheRequestElements)
 	prometheus.MustRegister(metrics.ProxyRequestDuration)
+	prometheus.MustRegister(metrics.UpstreamHealth)
+	prometheus.MustRegister(metrics.UpstreamFailures)
+	prometheus.MustRegister(metrics.CircuitBreakerState)
+	prometheus.MustRegister(metrics.RateLimit)
+	prometheus.MustRegister(metrics.RateLimitRejections)
+	prometheus.MustRegister(metrics.OriginRequestsInFlight)
+	prometheus.MustRegister(metrics.CacheRawBytes)
+	prometheus.MustRegister(metrics.CacheStoredBytes)
 
 	return &metrics
 }
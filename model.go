@@ -14,8 +14,11 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/url"
+	"sort"
 	"sync"
 
 	"github.com/prometheus/common/model"
@@ -23,44 +26,265 @@ import (
 
 // PrometheusVectorEnvelope represents a Vector response object from the Prometheus HTTP API
 type PrometheusVectorEnvelope struct {
-	Status string               `json:"status"`
-	Data   PrometheusVectorData `json:"data"`
+	Status    string               `json:"status"`
+	Data      PrometheusVectorData `json:"data"`
+	ErrorType string               `json:"errorType,omitempty"`
+	Error     string               `json:"error,omitempty"`
+	Warnings  []string             `json:"warnings,omitempty"`
 }
 
-// PrometheusVectorData represents the Data body of a Vector response object from the Prometheus HTTP API
+// PrometheusMetadataEnvelope represents a response object from the metadata endpoints of the Prometheus HTTP API,
+// whose data is a list of label names, label values or series label sets
+type PrometheusMetadataEnvelope struct {
+	Status   string          `json:"status"`
+	Data     json.RawMessage `json:"data"`
+	Warnings []string        `json:"warnings,omitempty"`
+}
+
+// PrometheusErrorEnvelope represents an error response object from the Prometheus HTTP API
+type PrometheusErrorEnvelope struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+}
+
+// PrometheusVectorData represents the Data body of an instant query response object from the Prometheus HTTP API.
+// The result is in Result and Histograms for the vector result type, or in Scalar or String for the scalar and string
+// result types
 type PrometheusVectorData struct {
-	ResultType string       `json:"resultType"`
-	Result     model.Vector `json:"result"`
+	ResultType string        `json:"resultType"`
+	Result     model.Vector  `json:"result"`
+	Scalar     *model.Scalar `json:"-"`
+	String     *model.String `json:"-"`
+	// Histograms are the native histogram samples of a vector result, which are in the result with the float samples
+	Histograms HistogramVector `json:"-"`
+	// Stats are the query statistics returned by the origin when requested with the stats parameter
+	Stats json.RawMessage `json:"stats,omitempty"`
+}
+
+// prometheusData is the Data body of a Prometheus HTTP API response, with the result left undecoded
+type prometheusData struct {
+	ResultType string          `json:"resultType"`
+	Result     json.RawMessage `json:"result"`
+	Stats      json.RawMessage `json:"stats,omitempty"`
+}
+
+// UnmarshalJSON decodes the result of an instant query according to its result type
+func (d *PrometheusVectorData) UnmarshalJSON(b []byte) error {
+	raw := prometheusData{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	*d = PrometheusVectorData{ResultType: raw.ResultType, Stats: raw.Stats}
+	if len(raw.Result) == 0 {
+		return nil
+	}
+
+	switch raw.ResultType {
+	case rvScalar:
+		d.Scalar = &model.Scalar{}
+		return json.Unmarshal(raw.Result, d.Scalar)
+	case rvString:
+		d.String = &model.String{}
+		return json.Unmarshal(raw.Result, d.String)
+	}
+
+	var samples []struct {
+		Metric    model.Metric      `json:"metric"`
+		Value     *model.SamplePair `json:"value"`
+		Histogram *HistogramPair    `json:"histogram"`
+	}
+	if err := json.Unmarshal(raw.Result, &samples); err != nil || samples == nil {
+		return err
+	}
+
+	d.Result = make(model.Vector, 0, len(samples))
+	for _, s := range samples {
+		switch {
+		case s.Histogram != nil:
+			d.Histograms = append(d.Histograms, &HistogramSample{Metric: s.Metric, Histogram: *s.Histogram})
+		case s.Value != nil:
+			d.Result = append(d.Result, &model.Sample{Metric: s.Metric, Value: s.Value.Value, Timestamp: s.Value.Timestamp})
+		default:
+			d.Result = append(d.Result, &model.Sample{Metric: s.Metric})
+		}
+	}
+
+	return nil
+}
+
+// MarshalJSON encodes the result of an instant query according to its result type
+func (d PrometheusVectorData) MarshalJSON() ([]byte, error) {
+	var result interface{} = d.Result
+	switch {
+	case d.ResultType == rvScalar && d.Scalar != nil:
+		result = d.Scalar
+	case d.ResultType == rvString && d.String != nil:
+		result = d.String
+	case len(d.Histograms) > 0:
+		samples := make([]interface{}, 0, len(d.Result)+len(d.Histograms))
+		for _, s := range d.Result {
+			samples = append(samples, s)
+		}
+		for _, s := range d.Histograms {
+			samples = append(samples, s)
+		}
+		result = samples
+	}
+
+	return json.Marshal(struct {
+		ResultType string          `json:"resultType"`
+		Result     interface{}     `json:"result"`
+		Stats      json.RawMessage `json:"stats,omitempty"`
+	}{d.ResultType, result, d.Stats})
+}
+
+// samples returns the result of an instant query as a vector. A scalar is returned as a single sample without labels,
+// which is how Prometheus returns a scalar expression from a range query. A string has no samples
+func (d PrometheusVectorData) samples() model.Vector {
+	switch d.ResultType {
+	case rvScalar:
+		if d.Scalar == nil {
+			return nil
+		}
+		return model.Vector{&model.Sample{Metric: model.Metric{}, Value: d.Scalar.Value, Timestamp: d.Scalar.Timestamp}}
+	case rvString:
+		return nil
+	default:
+		return d.Result
+	}
 }
 
 // PrometheusMatrixEnvelope represents a Matrix response object from the Prometheus HTTP API
 type PrometheusMatrixEnvelope struct {
-	Status string               `json:"status"`
-	Data   PrometheusMatrixData `json:"data"`
+	Status    string               `json:"status"`
+	Data      PrometheusMatrixData `json:"data"`
+	ErrorType string               `json:"errorType,omitempty"`
+	Error     string               `json:"error,omitempty"`
+	Warnings  []string             `json:"warnings,omitempty"`
+	// Extents are the time ranges of a cached matrix that were fetched from the origin. They are not part of the API response
+	Extents ExtentList `json:"-"`
 }
 
 // PrometheusMatrixData represents the Data body of a Matrix response object from the Prometheus HTTP API
 type PrometheusMatrixData struct {
 	ResultType string       `json:"resultType"`
 	Result     model.Matrix `json:"result"`
+	// Histograms are the native histogram samples of the result, which are in the result with the float samples
+	Histograms HistogramMatrix `json:"-"`
+	// Stats are the query statistics returned by the origin when requested with the stats parameter. They describe
+	// a single origin request, so they are not cached
+	Stats json.RawMessage `json:"stats,omitempty"`
+}
+
+// UnmarshalJSON decodes the result of a range query. Prometheus returns scalar expressions over a range as a matrix
+// with a single series without labels, so a scalar result is decoded that way. Strings can't be queried over a range
+func (d *PrometheusMatrixData) UnmarshalJSON(b []byte) error {
+	raw := prometheusData{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	*d = PrometheusMatrixData{ResultType: raw.ResultType, Stats: raw.Stats}
+	if len(raw.Result) == 0 {
+		return nil
+	}
+
+	switch raw.ResultType {
+	case rvScalar:
+		s := model.Scalar{}
+		if err := json.Unmarshal(raw.Result, &s); err != nil {
+			return err
+		}
+		d.ResultType = rvMatrix
+		d.Result = model.Matrix{&model.SampleStream{Metric: model.Metric{}, Values: []model.SamplePair{{Timestamp: s.Timestamp, Value: s.Value}}}}
+		return nil
+	case rvString:
+		return fmt.Errorf("unsupported result type %q for a range query", raw.ResultType)
+	}
+
+	var series []matrixSeries
+	if err := json.Unmarshal(raw.Result, &series); err != nil || series == nil {
+		return err
+	}
+
+	d.Result = make(model.Matrix, 0, len(series))
+	for _, s := range series {
+		switch {
+		case s.Values != nil:
+			d.Result = append(d.Result, &model.SampleStream{Metric: s.Metric, Values: *s.Values})
+		case len(s.Histograms) == 0:
+			d.Result = append(d.Result, &model.SampleStream{Metric: s.Metric})
+		}
+		if len(s.Histograms) > 0 {
+			d.Histograms = append(d.Histograms, &HistogramStream{Metric: s.Metric, Histograms: s.Histograms})
+		}
+	}
+
+	return nil
+}
+
+// matrixSeries is a series of a range query result as it appears in the Prometheus HTTP API, with its float and
+// native histogram samples
+type matrixSeries struct {
+	Metric     model.Metric        `json:"metric"`
+	Values     *[]model.SamplePair `json:"values,omitempty"`
+	Histograms []HistogramPair     `json:"histograms,omitempty"`
+}
+
+// MarshalJSON encodes the result of a range query, with the float and native histogram samples of each series together
+func (d PrometheusMatrixData) MarshalJSON() ([]byte, error) {
+	var result interface{} = d.Result
+	if len(d.Histograms) > 0 {
+		histograms := make(map[model.Fingerprint]*HistogramStream, len(d.Histograms))
+		for _, s := range d.Histograms {
+			histograms[s.Metric.Fingerprint()] = s
+		}
+
+		series := make([]matrixSeries, 0, len(d.Result)+len(d.Histograms))
+		for _, s := range d.Result {
+			values := s.Values
+			ms := matrixSeries{Metric: s.Metric, Values: &values}
+			if h, ok := histograms[s.Metric.Fingerprint()]; ok {
+				ms.Histograms = h.Histograms
+				delete(histograms, s.Metric.Fingerprint())
+			}
+			series = append(series, ms)
+		}
+		for _, s := range d.Histograms {
+			if _, ok := histograms[s.Metric.Fingerprint()]; ok {
+				series = append(series, matrixSeries{Metric: s.Metric, Histograms: s.Histograms})
+			}
+		}
+		// order the joined series by their labels, as Prometheus does
+		sort.SliceStable(series, func(i, j int) bool { return series[i].Metric.Before(series[j].Metric) })
+		result = series
+	}
+
+	return json.Marshal(struct {
+		ResultType string          `json:"resultType"`
+		Result     interface{}     `json:"result"`
+		Stats      json.RawMessage `json:"stats,omitempty"`
+	}{d.ResultType, result, d.Stats})
 }
 
 // ClientRequestContext contains the objects needed to fulfull a client request
 type ClientRequestContext struct {
-	Request            *http.Request
-	Writer             http.ResponseWriter
-	CacheKey           string
-	CacheLookupResult  string
-	Matrix             PrometheusMatrixEnvelope
-	Origin             PrometheusOriginConfig
-	RequestParams      url.Values
-	RequestExtents     MatrixExtents
-	OriginUpperExtents MatrixExtents
-	OriginLowerExtents MatrixExtents
-	StepParam          string
-	StepMS             int64
-	Time               int64
-	WaitGroup          sync.WaitGroup
+	Request           *http.Request
+	Writer            http.ResponseWriter
+	CacheKey          string
+	CacheLookupResult string
+	Matrix            PrometheusMatrixEnvelope
+	Origin            PrometheusOriginConfig
+	RequestParams     url.Values
+	RequestExtents    MatrixExtents
+	OriginExtents     ExtentList
+	StepParam         string
+	StepMS            int64
+	ShiftMS           int64
+	Time              int64
+	WaitGroup         sync.WaitGroup
 }
 
 // MatrixExtents describes the start and end epoch times (in ms) for a given range of data
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"reflect"
 	"strconv"
 	"testing"
@@ -219,3 +220,92 @@ func TestPrometheusMatrixEnvelope_CropToRange(t *testing.T) {
 		})
 	}
 }
+
+func TestPrometheusEnvelopes_roundTrip(t *testing.T) {
+	fixtures := []struct {
+		body string
+		pe   interface{}
+	}{
+		{`{"status":"success","data":{"resultType":"matrix","result":[],"stats":{"timings":{"evalTotalTime":0.5}}},"warnings":["w"]}`, &PrometheusMatrixEnvelope{}},
+		{`{"status":"success","data":{"resultType":"vector","result":[],"stats":{"samples":{"totalQueryableSamples":3}}},"warnings":["w"]}`, &PrometheusVectorEnvelope{}},
+		{`{"status":"error","data":{"resultType":"","result":null},"errorType":"execution","error":"query timed out"}`, &PrometheusMatrixEnvelope{}},
+		{`{"status":"error","data":{"resultType":"","result":null},"errorType":"bad_data","error":"parse error"}`, &PrometheusVectorEnvelope{}},
+	}
+
+	for _, f := range fixtures {
+		if err := json.Unmarshal([]byte(f.body), f.pe); err != nil {
+			t.Fatal(err)
+		}
+		out, err := json.Marshal(f.pe)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// it should marshal the same fields it unmarshaled
+		var want, got map[string]interface{}
+		json.Unmarshal([]byte(f.body), &want)
+		json.Unmarshal(out, &got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("wanted %s got %s.", f.body, out)
+		}
+	}
+}
+
+func TestPrometheusVectorData_resultTypes(t *testing.T) {
+	fixtures := []struct {
+		body string
+		want PrometheusVectorData
+	}{
+		{`{"resultType":"vector","result":[{"metric":{"job":"a"},"value":[1435781460.781,"1"]}]}`,
+			PrometheusVectorData{ResultType: rvVector, Result: model.Vector{{Metric: model.Metric{"job": "a"}, Value: 1, Timestamp: 1435781460781}}}},
+		{`{"resultType":"scalar","result":[1435781460.781,"1435781460.781"]}`,
+			PrometheusVectorData{ResultType: rvScalar, Scalar: &model.Scalar{Value: 1435781460.781, Timestamp: 1435781460781}}},
+		{`{"resultType":"string","result":[1435781460.781,"hello"]}`,
+			PrometheusVectorData{ResultType: rvString, String: &model.String{Value: "hello", Timestamp: 1435781460781}}},
+	}
+
+	for _, f := range fixtures {
+		d := PrometheusVectorData{}
+		if err := json.Unmarshal([]byte(f.body), &d); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(d, f.want) {
+			t.Errorf("wanted %+v got %+v.", f.want, d)
+		}
+
+		// it should marshal the result in the same form
+		out, err := json.Marshal(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != f.body {
+			t.Errorf("wanted %s got %s.", f.body, out)
+		}
+	}
+
+	// a scalar is a single sample without labels, and a string has no samples
+	d := PrometheusVectorData{ResultType: rvScalar, Scalar: &model.Scalar{Value: 2, Timestamp: 1000}}
+	if v := d.samples(); len(v) != 1 || len(v[0].Metric) != 0 || v[0].Value != 2 || v[0].Timestamp != 1000 {
+		t.Errorf("wanted a single unlabeled sample got %v.", v)
+	}
+	if v := (PrometheusVectorData{ResultType: rvString, String: &model.String{Value: "a"}}).samples(); len(v) != 0 {
+		t.Errorf("wanted no samples got %v.", v)
+	}
+}
+
+func TestPrometheusMatrixData_resultTypes(t *testing.T) {
+	// it should decode a scalar as a single series without labels
+	d := PrometheusMatrixData{}
+	if err := json.Unmarshal([]byte(`{"resultType":"scalar","result":[1435781460,"2"]}`), &d); err != nil {
+		t.Fatal(err)
+	}
+	want := PrometheusMatrixData{ResultType: rvMatrix, Result: model.Matrix{{Metric: model.Metric{}, Values: []model.SamplePair{{Timestamp: 1435781460000, Value: 2}}}}}
+	if !reflect.DeepEqual(d, want) {
+		t.Errorf("wanted %+v got %+v.", want, d)
+	}
+
+	// it should reject a string
+	if err := json.Unmarshal([]byte(`{"resultType":"string","result":[1435781460,"a"]}`), &d); err == nil {
+		t.Errorf("expected error for string result")
+	}
+}
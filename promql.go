@@ -0,0 +1,131 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/prometheus/promql"
+)
+
+// evalTimeFunctions are the PromQL functions that return a value based on the evaluation time when called without arguments
+var evalTimeFunctions = map[string]bool{
+	"time":          true,
+	"minute":        true,
+	"hour":          true,
+	"day_of_week":   true,
+	"day_of_month":  true,
+	"days_in_month": true,
+	"month":         true,
+	"year":          true,
+}
+
+// normalizeQuery returns the canonical form of a PromQL query as printed by the Prometheus parser, so that
+// queries differing only in whitespace, label matcher order and the like share a cache key.
+// Queries that fail to parse are returned unchanged.
+func normalizeQuery(query string) string {
+	expr, err := promql.ParseExpr(query)
+	if err != nil {
+		return query
+	}
+	return expr.String()
+}
+
+// splitOffset returns a PromQL query with its offset removed, and the offset, when every selector in the query has
+// the same offset. The results of such a query are those of the query without the offset evaluated that much earlier,
+// with the timestamps shifted forward by the offset. Queries that fail to parse, have no offset, mix offsets or depend
+// on the evaluation time (e.g., time()) are returned unchanged with an offset of 0.
+func splitOffset(query string) (string, time.Duration) {
+	expr, err := promql.ParseExpr(query)
+	if err != nil {
+		return query, 0
+	}
+
+	var offset time.Duration
+	seen, uniform := false, true
+	promql.Inspect(expr, func(node promql.Node, _ []promql.Node) error {
+		var o time.Duration
+		switch n := node.(type) {
+		case *promql.VectorSelector:
+			o, n.Offset = n.Offset, 0
+		case *promql.MatrixSelector:
+			o, n.Offset = n.Offset, 0
+		case *promql.Call:
+			if len(n.Args) == 0 && evalTimeFunctions[n.Func.Name] {
+				uniform = false
+			}
+			return nil
+		case *promql.AggregateExpr:
+			// aggregation parameters (e.g., topk's k) aren't walked, so only literals are allowed
+			if !isLiteral(n.Param) {
+				uniform = false
+			}
+			return nil
+		default:
+			return nil
+		}
+
+		if !seen {
+			offset, seen = o, true
+		} else if o != offset {
+			uniform = false
+		}
+		return nil
+	})
+
+	if !uniform || offset <= 0 {
+		return query, 0
+	}
+	return expr.String(), offset
+}
+
+// downsampleable returns true if a query's value at each step of a range query depends only on the time of the step,
+// and not on the step itself, so that the results for a coarser step are the points of the results for a finer step
+// that fall on the coarser step's boundaries. Queries that fail to parse or that contain expressions not known to be
+// evaluated independently at each step are not downsampleable
+func downsampleable(query string) bool {
+	expr, err := promql.ParseExpr(query)
+	if err != nil {
+		return false
+	}
+
+	ok := true
+	var inspect func(node promql.Node, _ []promql.Node) error
+	inspect = func(node promql.Node, _ []promql.Node) error {
+		switch n := node.(type) {
+		case nil, promql.Expressions, *promql.VectorSelector, *promql.MatrixSelector, *promql.NumberLiteral,
+			*promql.StringLiteral, *promql.ParenExpr, *promql.UnaryExpr, *promql.BinaryExpr, *promql.Call:
+		case *promql.AggregateExpr:
+			// aggregation parameters (e.g., topk's k) aren't walked with the rest of the expression
+			if n.Param != nil {
+				promql.Inspect(n.Param, inspect)
+			}
+		default:
+			ok = false
+		}
+		return nil
+	}
+	promql.Inspect(expr, inspect)
+
+	return ok
+}
+
+// isLiteral returns true if the expression is absent or a number or string literal
+func isLiteral(expr promql.Expr) bool {
+	switch expr.(type) {
+	case nil, *promql.NumberLiteral, *promql.StringLiteral:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestNormalizeQuery(t *testing.T) {
+	fixtures := []struct {
+		input  string
+		output string
+	}{
+		{"rate( x [5m] )", "rate(x[5m])"},
+		{`up{job="node",instance="a"}`, `up{instance="a",job="node"}`},
+		{"sum(up) by (job)", "sum by(job) (up)"},
+		// queries that fail to parse are unchanged
+		{"rate(x[5m]", "rate(x[5m]"},
+	}
+
+	for _, f := range fixtures {
+		if out := normalizeQuery(f.input); out != f.output {
+			t.Errorf("wanted %q got %q.", f.output, out)
+		}
+	}
+}
+
+func TestDeriveCacheKey_normalizeQueries(t *testing.T) {
+	a := url.Values{upQuery: []string{`rate(up{job="node",instance="a"}[5m])`}}
+	b := url.Values{upQuery: []string{`rate( up{instance="a", job="node"} [5m] )`}}
+
+	// it should key the queries separately by default
+	o := PrometheusOriginConfig{}
+	if deriveCacheKey(o, "prefix", nil, a) == deriveCacheKey(o, "prefix", nil, b) {
+		t.Errorf("expected different cache keys without normalization")
+	}
+
+	// it should key the queries together when normalizing
+	o.NormalizeQueries = true
+	if deriveCacheKey(o, "prefix", nil, a) != deriveCacheKey(o, "prefix", nil, b) {
+		t.Errorf("expected the same cache key with normalization")
+	}
+}
+
+func TestSplitOffset(t *testing.T) {
+	fixtures := []struct {
+		input  string
+		query  string
+		offset time.Duration
+	}{
+		{"up offset 1w", "up", 7 * 24 * time.Hour},
+		{`sum(rate(x{job="a"}[5m] offset 1h)) by (job)`, `sum by(job) (rate(x{job="a"}[5m]))`, time.Hour},
+		{"x offset 1h / y offset 1h", "x / y", time.Hour},
+		{"x offset 1h + 1", "x + 1", time.Hour},
+		{"hour(timestamp(x offset 1h))", "hour(timestamp(x))", time.Hour},
+		{"topk(5, x offset 1h)", "topk(5, x)", time.Hour},
+		// queries without a single offset, that depend on the evaluation time or that fail to parse are unchanged
+		{"up", "up", 0},
+		{"x offset 1h / y", "x offset 1h / y", 0},
+		{"x offset 1h / y offset 2h", "x offset 1h / y offset 2h", 0},
+		{"time() - x offset 1h", "time() - x offset 1h", 0},
+		{"hour() == 3 and x offset 1h", "hour() == 3 and x offset 1h", 0},
+		{"quantile(scalar(bar), foo offset 1w)", "quantile(scalar(bar), foo offset 1w)", 0},
+		{"rate(x[5m] offset 1h", "rate(x[5m] offset 1h", 0},
+	}
+
+	for _, f := range fixtures {
+		query, offset := splitOffset(f.input)
+		if query != f.query || offset != f.offset {
+			t.Errorf("%s: wanted %q, %v got %q, %v.", f.input, f.query, f.offset, query, offset)
+		}
+	}
+}
+
+func TestDownsampleable(t *testing.T) {
+	fixtures := []struct {
+		query string
+		want  bool
+	}{
+		{"up", true},
+		{`sum(rate(http_requests_total{job="api"}[5m])) by (code)`, true},
+		{"topk(scalar(count(up)), up offset 1h)", true},
+		{"time() - process_start_time_seconds", true},
+		{"rate(x[5m]", false},
+	}
+
+	for _, f := range fixtures {
+		if got := downsampleable(f.query); got != f.want {
+			t.Errorf("%s: wanted %t got %t.", f.query, f.want, got)
+		}
+	}
+}
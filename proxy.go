@@ -0,0 +1,185 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	stdlog "log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/gorilla/mux"
+)
+
+// fullProxyFlushInterval is how often a response streamed through the full proxy is flushed to the client
+const fullProxyFlushInterval = 100 * time.Millisecond
+
+// passthroughHeaders are the client request headers describing the request body and the encodings the client
+// accepts, which are always passed through to the origin, so that the origin's compressed responses are streamed as-is
+var passthroughHeaders = []string{hnContentType, "Content-Length", "Content-Encoding", "Accept-Encoding"}
+
+// promFullProxyHandler handles calls to non-api paths for single-origin configurations and multi-origin via param or hostname
+// can't support multi-origin full proxy for path-based proxying. Responses are streamed to the client as they are received.
+func (t *TricksterHandler) promFullProxyHandler(w http.ResponseWriter, r *http.Request) {
+	level.Debug(t.Logger).Log(lfEvent, "promFullProxyHandler", "path", r.URL.Path, "method", r.Method)
+
+	p := r.URL.Path
+	vars := mux.Vars(r)
+
+	// clear out the origin moniker from the front of the API path
+	if originName, ok := vars["originMoniker"]; ok {
+		if strings.HasPrefix(p, "/"+originName) {
+			p = strings.Replace(p, "/"+originName, "", 1)
+		}
+	}
+	p = strings.Replace(p, "//", "/", 1)
+
+	origin := t.getProxyOrigin(r)
+
+	if isAdminPath(p) && !origin.EnableAdminAPI {
+		level.Warn(t.Logger).Log(lfEvent, "rejected request to the Prometheus admin API", "path", r.URL.Path, "remoteAddr", r.RemoteAddr)
+		writePrometheusError(w, http.StatusForbidden, etForbidden, "the Prometheus admin API is not enabled for this origin")
+		return
+	}
+
+	// the slot is acquired before the circuit breaker is checked, so a half-open breaker's probe can't be lost while
+	// waiting for one
+	rl := t.getRateLimiter(origin)
+	if err := rl.acquire(r.Context()); err != nil {
+		level.Error(t.Logger).Log(lfEvent, "error fetching data from origin Prometheus", lfDetail, err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer rl.release()
+
+	// Streamed responses can't be retried, so origins with multiple upstreams use the first candidate
+	var pool *UpstreamPool
+	var upstream *Upstream
+	target := strings.TrimSuffix(origin.OriginURL, "/") + p
+	if len(origin.OriginURLs) > 0 {
+		pool = t.getUpstreamPool(origin)
+		upstream = pool.candidates()[0]
+		target = upstreamURI(origin, upstream, target)
+	}
+
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		level.Error(t.Logger).Log(lfEvent, "error fetching data from origin Prometheus", lfDetail, err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	cb := t.getCircuitBreaker(origin)
+	if !cb.allow() {
+		level.Error(t.Logger).Log(lfEvent, "error fetching data from origin Prometheus", lfDetail, errCircuitOpen.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	record := func(resp *http.Response, err error) {
+		cb.record(err == nil && resp.StatusCode < http.StatusInternalServerError)
+		if pool != nil {
+			t.recordUpstreamResult(pool, upstreamResult{upstream: upstream, resp: resp, err: err})
+		}
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = targetURL.Scheme
+			req.URL.Host = targetURL.Host
+			req.URL.Path = targetURL.Path
+			req.URL.RawPath = ""
+			req.Host = targetURL.Host
+			req.Header = t.fullProxyRequestHeaders(origin, r)
+		},
+		Transport:     t.getProxyTransport(origin),
+		FlushInterval: fullProxyFlushInterval,
+		ErrorLog:      stdlog.New(log.NewStdlibAdapter(level.Error(t.Logger)), "", 0),
+		ModifyResponse: func(resp *http.Response) error {
+			record(resp, nil)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			if req.Context().Err() != nil {
+				// the client went away, which says nothing about the origin
+				cb.abandon()
+			} else {
+				record(nil, err)
+			}
+			level.Error(t.Logger).Log(lfEvent, "error fetching data from origin Prometheus", lfDetail, err.Error())
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	proxy.ServeHTTP(w, r)
+}
+
+// fullProxyRequestHeaders returns the headers to send to the origin for a full proxy request. X-Forwarded-For is
+// left as the client sent it, since the reverse proxy appends the client's address to it
+func (t *TricksterHandler) fullProxyRequestHeaders(o PrometheusOriginConfig, r *http.Request) http.Header {
+	headers := t.originRequestHeaders(o, getProxyableClientHeaders(o, r))
+
+	for _, name := range passthroughHeaders {
+		if values, ok := r.Header[name]; ok {
+			headers[name] = values
+		}
+	}
+
+	if prior, ok := r.Header[hnXForwardedFor]; ok {
+		headers[hnXForwardedFor] = prior
+	} else {
+		delete(headers, hnXForwardedFor)
+	}
+
+	return headers
+}
+
+// getProxyTransport returns the transport for full proxy requests to the origin. TimeoutSecs bounds connecting to the
+// origin and waiting for its response headers, but not streaming the response body, which can take any amount of time
+func (t *TricksterHandler) getProxyTransport(o PrometheusOriginConfig) *http.Transport {
+	t.ProxyTransportsMtx.Lock()
+	defer t.ProxyTransportsMtx.Unlock()
+
+	if t.ProxyTransports == nil {
+		t.ProxyTransports = make(map[string]*http.Transport)
+	}
+
+	if tr, ok := t.ProxyTransports[o.OriginURL]; ok {
+		return tr
+	}
+
+	timeout := time.Duration(o.TimeoutSecs) * time.Second
+	tr := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext,
+		ResponseHeaderTimeout: timeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConns:          100,
+	}
+	t.ProxyTransports[o.OriginURL] = tr
+
+	return tr
+}
+
+// isAdminPath returns true if the path is part of the Prometheus admin API, including under a route prefix
+func isAdminPath(p string) bool {
+	return strings.Contains(path.Clean(p)+"/", prometheusAPIv1Path+mnAdmin)
+}
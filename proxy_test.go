@@ -0,0 +1,248 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTricksterHandler_promFullProxyHandler_streaming(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	release := make(chan bool)
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "first")
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprintln(w, "second")
+	}))
+	defer es.Close()
+	defer close(release)
+	tr.setTestOrigin(es.URL)
+
+	ts := httptest.NewServer(http.HandlerFunc(tr.promFullProxyHandler))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/federate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// it should stream the first part of the response before the origin has finished sending it
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "first\n" {
+		t.Errorf("wanted %q got %q.", "first\n", line)
+	}
+}
+
+func TestTricksterHandler_promFullProxyHandler_headers(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	var originHeaders http.Header
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originHeaders = r.Header
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "hop")
+		w.Header().Set("X-End", "end")
+		fmt.Fprint(w, "{}")
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	r := httptest.NewRequest("GET", es.URL+"/api/v1/series?match[]=up", nil)
+	r.Header.Set(hnXForwardedFor, "10.0.0.1")
+	r.Header.Set("X-Not-Forwarded", "true")
+	w := httptest.NewRecorder()
+	tr.promFullProxyHandler(w, r)
+
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("wanted 200 got %d.", w.Result().StatusCode)
+	}
+
+	// it should append the client to X-Forwarded-For once, and only forward the allowed headers
+	if v := originHeaders.Get(hnXForwardedFor); v != "10.0.0.1, 192.0.2.1" {
+		t.Errorf("wanted %s %q got %q.", hnXForwardedFor, "10.0.0.1, 192.0.2.1", v)
+	}
+	if v := originHeaders.Get(hnVia); v != "1.1 trickster" {
+		t.Errorf("wanted %s %q got %q.", hnVia, "1.1 trickster", v)
+	}
+	if v := originHeaders.Get("X-Not-Forwarded"); v != "" {
+		t.Errorf("expected X-Not-Forwarded not to be forwarded, got %q.", v)
+	}
+
+	// it should drop hop-by-hop response headers
+	if v := w.Result().Header.Get("X-Hop"); v != "" {
+		t.Errorf("expected X-Hop not to be returned, got %q.", v)
+	}
+	if v := w.Result().Header.Get("X-End"); v != "end" {
+		t.Errorf("wanted X-End %q got %q.", "end", v)
+	}
+}
+
+func TestTricksterHandler_promFullProxyHandler_admin(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es, requests := newRecordingTestServer("{}")
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	// it should reject admin API requests unless they are enabled
+	for _, p := range []string{"/api/v1/admin/tsdb/delete_series", "/prometheus/api/v1/admin/tsdb/snapshot", "/api/v1//admin/tsdb/clean_tombstones"} {
+		w := httptest.NewRecorder()
+		tr.promFullProxyHandler(w, httptest.NewRequest(http.MethodPost, es.URL+p, nil))
+		if w.Result().StatusCode != http.StatusForbidden {
+			t.Errorf("wanted 403 for %s got %d.", p, w.Result().StatusCode)
+		}
+	}
+	if len(requests) != 0 {
+		t.Errorf("expected no requests to the origin, got %d.", len(requests))
+	}
+
+	o := tr.Config.Origins["default"]
+	o.EnableAdminAPI = true
+	tr.Config.Origins["default"] = o
+
+	w := httptest.NewRecorder()
+	tr.promFullProxyHandler(w, httptest.NewRequest(http.MethodPost, es.URL+"/api/v1/admin/tsdb/delete_series", nil))
+	if w.Result().StatusCode != http.StatusOK {
+		t.Errorf("wanted 200 got %d.", w.Result().StatusCode)
+	}
+	if req := <-requests; req.Method != http.MethodPost {
+		t.Errorf("wanted %s got %s.", http.MethodPost, req.Method)
+	}
+}
+
+func TestTricksterHandler_promFullProxyHandler_unreachable(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	// it should respond with a bad gateway
+	w := httptest.NewRecorder()
+	tr.promFullProxyHandler(w, httptest.NewRequest("GET", nonexistantOrigin+"/federate", nil))
+	if w.Result().StatusCode != http.StatusBadGateway {
+		t.Errorf("wanted 502 got %d.", w.Result().StatusCode)
+	}
+}
+
+func TestTricksterHandler_promFullProxyHandler_canceled(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es := newTestServer("ok")
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	o := tr.Config.Origins["default"]
+	o.CircuitBreakerFailures = 1
+	tr.Config.Origins["default"] = o
+
+	// a request canceled by its client should not count as an origin failure
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := httptest.NewRecorder()
+	tr.promFullProxyHandler(w, httptest.NewRequest("GET", es.URL+"/federate", nil).WithContext(ctx))
+	if w.Result().StatusCode != http.StatusBadGateway {
+		t.Errorf("wanted 502 got %d.", w.Result().StatusCode)
+	}
+
+	w = httptest.NewRecorder()
+	tr.promFullProxyHandler(w, httptest.NewRequest("GET", es.URL+"/federate", nil))
+	if w.Result().StatusCode != http.StatusOK {
+		t.Errorf("wanted 200 got %d.", w.Result().StatusCode)
+	}
+}
+
+func TestTricksterHandler_promFullProxyHandler_compression(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			fmt.Fprint(w, "{}")
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		fmt.Fprint(gz, "{}")
+		gz.Close()
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	r := httptest.NewRequest("GET", es.URL+"/api/v1/series?match[]=up", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	tr.promFullProxyHandler(w, r)
+
+	// it should forward the client's Accept-Encoding and return the origin's compressed response as-is
+	if v := w.Result().Header.Get("Content-Encoding"); v != "gzip" {
+		t.Fatalf("wanted Content-Encoding %q got %q.", "gzip", v)
+	}
+	gz, err := gzip.NewReader(w.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(gz); string(body) != "{}" {
+		t.Errorf("wanted %q got %q.", "{}", body)
+	}
+}
+
+func TestTricksterHandler_promFullProxyHandler_timeout(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(1500 * time.Millisecond)
+			return
+		}
+		fmt.Fprintln(w, "first")
+		w.(http.Flusher).Flush()
+		time.Sleep(1500 * time.Millisecond)
+		fmt.Fprintln(w, "second")
+	}))
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	o := tr.Config.Origins["default"]
+	o.TimeoutSecs = 1
+	tr.Config.Origins["default"] = o
+
+	// it should stream a response body that takes longer than the timeout
+	w := httptest.NewRecorder()
+	tr.promFullProxyHandler(w, httptest.NewRequest("GET", es.URL+"/federate", nil))
+	if w.Body.String() != "first\nsecond\n" {
+		t.Errorf("wanted the full body got %q.", w.Body.String())
+	}
+
+	// it should time out waiting for the response headers
+	w = httptest.NewRecorder()
+	tr.promFullProxyHandler(w, httptest.NewRequest("GET", es.URL+"/slow", nil))
+	if w.Result().StatusCode != http.StatusBadGateway {
+		t.Errorf("wanted 502 got %d.", w.Result().StatusCode)
+	}
+}
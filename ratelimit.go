@@ -0,0 +1,307 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	// Client rate limit keys
+	rlkIP            = "ip"
+	rlkAuthorization = "authorization"
+
+	// Rate limit scopes, as reported in metrics
+	rlsOrigin = "origin"
+	rlsClient = "client"
+
+	// clientBucketPruneInterval is how often idle per-client buckets are removed
+	clientBucketPruneInterval = time.Minute
+)
+
+// tokenBucket is a token bucket rate limiter that refills at rate tokens per second, up to burst tokens
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	mtx    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// take removes a token from the bucket if one is available. Otherwise, it returns how long until one will be
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// refund returns a token taken from the bucket
+func (b *tokenBucket) refund() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+// full returns true if the bucket has refilled completely, meaning it has been idle long enough to be discarded
+func (b *tokenBucket) full(now time.Time) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// refill adds the tokens accrued since the last refill. It must be called with the bucket's mutex held.
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+}
+
+// RateLimiter enforces the request rate and concurrency limits of an origin
+type RateLimiter struct {
+	Origin string
+
+	t *TricksterHandler
+
+	// bucket limits the requests to the origin from all clients combined
+	bucket *tokenBucket
+
+	// clients holds a bucket per client when per-client limits are configured
+	clientRate  float64
+	clientBurst int
+	clientKey   string
+	clientsMtx  sync.Mutex
+	clients     map[string]*tokenBucket
+	lastPrune   time.Time
+
+	// slots bounds the number of concurrent requests to the origin
+	slots chan struct{}
+}
+
+// rateLimiterKey returns the key identifying an origin's RateLimiter. Fanout origins have no OriginURL, so they are keyed by their members
+func rateLimiterKey(o PrometheusOriginConfig) string {
+	if o.OriginType == otFanout {
+		return otFanout + ":" + strings.Join(o.FanoutOrigins, ",")
+	}
+	return o.OriginURL
+}
+
+// getRateLimiter returns the RateLimiter for the provided origin, or nil if the origin has no limits configured
+func (t *TricksterHandler) getRateLimiter(o PrometheusOriginConfig) *RateLimiter {
+	if o.RateLimitRPS <= 0 && o.ClientRateLimitRPS <= 0 && o.MaxConcurrentOriginRequests <= 0 {
+		return nil
+	}
+
+	key := rateLimiterKey(o)
+
+	t.RateLimitersMtx.Lock()
+	defer t.RateLimitersMtx.Unlock()
+
+	if t.RateLimiters == nil {
+		t.RateLimiters = make(map[string]*RateLimiter)
+	}
+
+	if rl, ok := t.RateLimiters[key]; ok {
+		return rl
+	}
+
+	now := time.Now()
+	rl := &RateLimiter{Origin: key, t: t, lastPrune: now}
+
+	if o.RateLimitRPS > 0 {
+		rl.bucket = newTokenBucket(o.RateLimitRPS, o.RateLimitBurst, now)
+		rl.setLimitMetric("rps", rl.bucket.rate)
+		rl.setLimitMetric("burst", rl.bucket.burst)
+	}
+
+	if o.ClientRateLimitRPS > 0 {
+		rl.clientRate = o.ClientRateLimitRPS
+		rl.clientBurst = o.ClientRateLimitBurst
+		rl.clientKey = strings.ToLower(o.ClientRateLimitKey)
+		rl.clients = make(map[string]*tokenBucket)
+		b := newTokenBucket(rl.clientRate, rl.clientBurst, now)
+		rl.setLimitMetric("client_rps", b.rate)
+		rl.setLimitMetric("client_burst", b.burst)
+	}
+
+	if o.MaxConcurrentOriginRequests > 0 {
+		rl.slots = make(chan struct{}, o.MaxConcurrentOriginRequests)
+		rl.setLimitMetric("max_concurrent_origin_requests", float64(o.MaxConcurrentOriginRequests))
+	}
+
+	t.RateLimiters[key] = rl
+
+	return rl
+}
+
+// allow takes a token from the client's bucket and then from the origin's bucket. If either is empty, it returns false
+// along with how long the client should wait before retrying and the scope of the limit that rejected the request.
+// A request rejected by the origin's bucket doesn't count against the client's limit
+func (rl *RateLimiter) allow(r *http.Request, now time.Time) (bool, time.Duration, string) {
+	if rl == nil {
+		return true, 0, ""
+	}
+
+	// Check the client limit first, so that a client over its own limit does not drain the origin's bucket
+	var client *tokenBucket
+	if rl.clients != nil {
+		client = rl.clientBucket(r, now)
+		if ok, wait := client.take(now); !ok {
+			return false, wait, rlsClient
+		}
+	}
+
+	if rl.bucket != nil {
+		if ok, wait := rl.bucket.take(now); !ok {
+			if client != nil {
+				client.refund()
+			}
+			return false, wait, rlsOrigin
+		}
+	}
+
+	return true, 0, ""
+}
+
+// clientBucket returns the bucket for the client making the request, creating it if needed
+func (rl *RateLimiter) clientBucket(r *http.Request, now time.Time) *tokenBucket {
+	client := rl.clientID(r)
+
+	rl.clientsMtx.Lock()
+	defer rl.clientsMtx.Unlock()
+
+	// Discard the buckets of clients that have been idle long enough to refill completely
+	if now.Sub(rl.lastPrune) >= clientBucketPruneInterval {
+		for k, b := range rl.clients {
+			if b.full(now) {
+				delete(rl.clients, k)
+			}
+		}
+		rl.lastPrune = now
+	}
+
+	b, ok := rl.clients[client]
+	if !ok {
+		b = newTokenBucket(rl.clientRate, rl.clientBurst, now)
+		rl.clients[client] = b
+	}
+
+	return b
+}
+
+// clientID identifies the client making the request by its Authorization header or its IP address, as configured.
+// Clients without an Authorization header are identified by IP address.
+func (rl *RateLimiter) clientID(r *http.Request) string {
+	if rl.clientKey == rlkAuthorization {
+		if authorization := r.Header.Get(hnAuthorization); authorization != "" {
+			return rlkAuthorization + ":" + authorization
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return rlkIP + ":" + host
+}
+
+// acquire waits for a free slot to send a request to the origin, when concurrency is limited. If ctx is done first,
+// it returns ctx's error without taking a slot, and release must not be called
+func (rl *RateLimiter) acquire(ctx context.Context) error {
+	if rl == nil || rl.slots == nil {
+		return nil
+	}
+	select {
+	case rl.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if rl.t.Metrics != nil {
+		rl.t.Metrics.OriginRequestsInFlight.WithLabelValues(rl.Origin).Inc()
+	}
+	return nil
+}
+
+// release frees the slot taken by acquire
+func (rl *RateLimiter) release() {
+	if rl == nil || rl.slots == nil {
+		return
+	}
+	<-rl.slots
+	if rl.t.Metrics != nil {
+		rl.t.Metrics.OriginRequestsInFlight.WithLabelValues(rl.Origin).Dec()
+	}
+}
+
+// setLimitMetric reports a configured limit of the origin
+func (rl *RateLimiter) setLimitMetric(limit string, value float64) {
+	if rl.t.Metrics == nil {
+		return
+	}
+	rl.t.Metrics.RateLimit.WithLabelValues(rl.Origin, limit).Set(value)
+}
+
+// withRateLimits wraps a handler so that requests exceeding the rate limits of their origin are rejected with a 429
+func (t *TricksterHandler) withRateLimits(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		o := t.getOrigin(r)
+		rl := t.getRateLimiter(o)
+		if ok, wait, scope := rl.allow(r, time.Now()); !ok {
+			level.Debug(t.Logger).Log(lfEvent, "request rate limited", "origin", rl.Origin, "scope", scope, "remoteAddr", r.RemoteAddr)
+			t.Metrics.RateLimitRejections.WithLabelValues(rl.Origin, scope).Inc()
+			writeRateLimitedResponse(w, wait, scope)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// writeRateLimitedResponse responds with a 429 and a Prometheus error envelope, telling the client when to retry
+func writeRateLimitedResponse(w http.ResponseWriter, wait time.Duration, scope string) {
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+
+	w.Header().Set(hnRetryAfter, strconv.Itoa(retryAfter))
+	writePrometheusError(w, http.StatusTooManyRequests, etTooManyRequests,
+		"trickster "+scope+" rate limit exceeded, retry after "+strconv.Itoa(retryAfter)+"s")
+}
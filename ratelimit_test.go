@@ -0,0 +1,223 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, 2, now)
+
+	// it should allow a burst, and then reject until a token is refilled
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.take(now); !ok {
+			t.Fatalf("expected request %d of the burst to be allowed", i)
+		}
+	}
+	ok, wait := b.take(now)
+	if ok {
+		t.Fatal("expected request after the burst to be rejected")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("wanted a wait of 500ms got %v", wait)
+	}
+
+	if ok, _ := b.take(now.Add(wait)); !ok {
+		t.Error("expected request to be allowed after the wait")
+	}
+
+	// it should not accrue more than the burst
+	if !b.full(now.Add(time.Hour)) {
+		t.Error("expected bucket to be full")
+	}
+	b.take(now.Add(time.Hour))
+	b.take(now.Add(time.Hour))
+	if ok, _ := b.take(now.Add(time.Hour)); ok {
+		t.Error("expected bucket to hold no more than the burst")
+	}
+}
+
+func TestTricksterHandler_withRateLimits(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es := newTestServer(exampleResponse)
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	o := tr.Config.Origins["default"]
+	o.RateLimitRPS = 0.1
+	o.RateLimitBurst = 1
+	tr.Config.Origins["default"] = o
+
+	handler := tr.withRateLimits(tr.promQueryHandler)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", es.URL+exampleQuery, nil))
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("wanted 200 got %d.", w.Result().StatusCode)
+	}
+
+	// it should reject the second request with a 429, a Retry-After header and a Prometheus error
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", es.URL+exampleQuery, nil))
+	if w.Result().StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("wanted 429 got %d.", w.Result().StatusCode)
+	}
+	if ra := w.Result().Header.Get(hnRetryAfter); ra != "10" {
+		t.Errorf("wanted Retry-After 10 got %q.", ra)
+	}
+
+	pe := PrometheusErrorEnvelope{}
+	if err := json.Unmarshal(w.Body.Bytes(), &pe); err != nil {
+		t.Fatal(err)
+	}
+	if pe.Status != rvError || pe.ErrorType != etTooManyRequests {
+		t.Errorf("unexpected error response %+v", pe)
+	}
+}
+
+func TestTricksterHandler_withRateLimits_perClient(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es := newTestServer(exampleResponse)
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	o := tr.Config.Origins["default"]
+	o.ClientRateLimitRPS = 0.1
+	o.ClientRateLimitBurst = 1
+	o.ClientRateLimitKey = rlkAuthorization
+	tr.Config.Origins["default"] = o
+
+	handler := tr.withRateLimits(tr.promQueryHandler)
+
+	tests := []struct {
+		authorization string
+		status        int
+	}{
+		{"Bearer a", http.StatusOK},
+		{"Bearer b", http.StatusOK},
+		{"Bearer a", http.StatusTooManyRequests},
+	}
+
+	for i, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", es.URL+exampleQuery, nil)
+		r.Header.Set(hnAuthorization, test.authorization)
+		handler(w, r)
+		if w.Result().StatusCode != test.status {
+			t.Errorf("request %d: wanted %d got %d.", i, test.status, w.Result().StatusCode)
+		}
+	}
+}
+
+func TestTricksterHandler_getURL_maxConcurrentOriginRequests(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	var inFlight, maxInFlight int64
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&inFlight, 1)
+		for {
+			m := atomic.LoadInt64(&maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt64(&maxInFlight, m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt64(&inFlight, -1)
+	}))
+	defer es.Close()
+
+	o := PrometheusOriginConfig{OriginURL: es.URL, MaxConcurrentOriginRequests: 2}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, _, err := tr.getURL(context.Background(), o, "GET", es.URL, url.Values{}, nil); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// it should never send more than the configured number of requests at once
+	if maxInFlight > 2 {
+		t.Errorf("wanted at most 2 concurrent requests got %d.", maxInFlight)
+	}
+}
+
+func TestRateLimiter_allow_refundsClient(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	o := tr.Config.Origins["default"]
+	o.RateLimitRPS = 0.1
+	o.RateLimitBurst = 1
+	o.ClientRateLimitRPS = 0.1
+	o.ClientRateLimitBurst = 1
+	rl := tr.getRateLimiter(o)
+
+	now := time.Now()
+	a := httptest.NewRequest("GET", "/", nil)
+	a.RemoteAddr = "10.0.0.1:1234"
+	b := httptest.NewRequest("GET", "/", nil)
+	b.RemoteAddr = "10.0.0.2:1234"
+
+	if ok, _, _ := rl.allow(a, now); !ok {
+		t.Fatal("expected the first request to be allowed")
+	}
+
+	// it should not count a request rejected by the origin limit against the client's limit
+	if ok, _, scope := rl.allow(b, now); ok || scope != rlsOrigin {
+		t.Fatalf("wanted the origin limit to reject the request got %t %s", ok, scope)
+	}
+	rl.bucket.refund()
+	if ok, _, scope := rl.allow(b, now); !ok {
+		t.Errorf("expected the client's request to be allowed once the origin had capacity, got %s", scope)
+	}
+}
+
+func TestRateLimiter_acquire_canceled(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	o := tr.Config.Origins["default"]
+	o.MaxConcurrentOriginRequests = 1
+	rl := tr.getRateLimiter(o)
+
+	if err := rl.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer rl.release()
+
+	// it should stop waiting for a slot when the request's context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := rl.acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("wanted %v got %v", context.DeadlineExceeded, err)
+	}
+}
@@ -44,15 +44,15 @@ func (r *RedisCache) Connect() error {
 }
 
 // Store places the the data into the Redis Cache using the provided Key and TTL
-func (r *RedisCache) Store(cacheKey string, data string, ttl int64) error {
+func (r *RedisCache) Store(cacheKey string, data []byte, ttl int64) error {
 	level.Debug(r.T.Logger).Log("event", "redis cache store", "key", cacheKey)
 	return r.client.Set(cacheKey, data, time.Second*time.Duration(ttl)).Err()
 }
 
 // Retrieve gets data from the Redis Cache using the provided Key
-func (r *RedisCache) Retrieve(cacheKey string) (string, error) {
+func (r *RedisCache) Retrieve(cacheKey string) ([]byte, error) {
 	level.Debug(r.T.Logger).Log("event", "redis cache retrieve", "key", cacheKey)
-	return r.client.Get(cacheKey).Result()
+	return r.client.Get(cacheKey).Bytes()
 }
 
 // Reap continually iterates through the cache to find expired elements and removes them
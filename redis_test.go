@@ -59,7 +59,7 @@ func TestRedisCache_Store(t *testing.T) {
 	}
 
 	// it should store a value
-	err = rc.Store("cacheKey", "data", 60000)
+	err = rc.Store("cacheKey", []byte("data"), 60000)
 	if err != nil {
 		t.Error(err)
 	}
@@ -73,7 +73,7 @@ func TestRedisCache_Retrieve(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	err = rc.Store("cacheKey", "data", 60000)
+	err = rc.Store("cacheKey", []byte("data"), 60000)
 	if err != nil {
 		t.Error(err)
 	}
@@ -83,7 +83,7 @@ func TestRedisCache_Retrieve(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	if data != "data" {
+	if string(data) != "data" {
 		t.Errorf("wanted \"%s\". got \"%s\"", "data", data)
 	}
 }
@@ -124,3 +124,12 @@ func TestRedisCache_Close(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func BenchmarkRedisCache(b *testing.B) {
+	rc, close := setupRedisCache()
+	defer close()
+	if err := rc.Connect(); err != nil {
+		b.Fatal(err)
+	}
+	benchmarkCache(b, &rc)
+}
@@ -0,0 +1,70 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// applyTimeShift determines how far the results of a query_range request are shifted forward from those of the
+// cached query: by the timeShift URL parameter (e.g., from a Grafana panel's time shift), plus the query's offset
+// when the origin has offset-aware caching enabled. The timeShift parameter is removed and the offset is stripped
+// from the query, so the request is keyed, cached and fetched as the unshifted query over the shifted time range.
+// A shift that isn't a multiple of the step would move the results off of the step boundaries of the cached query,
+// so those requests are cached and fetched as-is, as they would be by an origin without timeShift support
+func applyTimeShift(ctx *ClientRequestContext) error {
+	if ts, ok := ctx.RequestParams[upTimeShift]; ok && len(ts) > 0 {
+		d, err := parseDuration(ts[0])
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("failed to parse parameter %q with value %q", upTimeShift, ts[0]))
+		}
+		if d < 0 {
+			return fmt.Errorf("%s parameter %v < 0, cannot shift into the future", upTimeShift, d)
+		}
+		if shiftMS := int64(d / time.Millisecond); shiftMS%ctx.StepMS == 0 {
+			ctx.ShiftMS = shiftMS
+		}
+		delete(ctx.RequestParams, upTimeShift)
+	}
+
+	if q, ok := ctx.RequestParams[upQuery]; ok && len(q) > 0 && ctx.Origin.OffsetAwareCaching {
+		if query, offset := splitOffset(q[0]); offset > 0 && int64(offset/time.Millisecond)%ctx.StepMS == 0 {
+			ctx.RequestParams.Set(upQuery, query)
+			ctx.ShiftMS += int64(offset / time.Millisecond)
+		}
+	}
+
+	return nil
+}
+
+// shiftTimestamps moves every point in the matrix forward by shiftMS. The values are copied, so that any
+// matrix sharing them, such as the cached matrix, is not modified
+func (pe *PrometheusMatrixEnvelope) shiftTimestamps(shiftMS int64) {
+	if shiftMS == 0 {
+		return
+	}
+
+	for _, s := range pe.Data.Result {
+		values := make([]model.SamplePair, len(s.Values))
+		for i, v := range s.Values {
+			values[i] = model.SamplePair{Timestamp: v.Timestamp + model.Time(shiftMS), Value: v.Value}
+		}
+		s.Values = values
+	}
+	pe.Data.Histograms = pe.Data.Histograms.shift(shiftMS)
+}
@@ -0,0 +1,167 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// newSelectorTestServer returns a stand-in for Prometheus that evaluates range queries of a single vector selector,
+// with or without an offset, as a series whose value at each step is the time (in seconds) of the sample selected
+func newSelectorTestServer() (*httptest.Server, chan url.Values) {
+	requests := make(chan url.Values, 10)
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		requests <- r.Form
+
+		expr, err := promql.ParseExpr(r.FormValue(upQuery))
+		vs, ok := expr.(*promql.VectorSelector)
+		if err != nil || !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		start, _ := strconv.ParseInt(r.FormValue(upStart), 10, 64)
+		end, _ := strconv.ParseInt(r.FormValue(upEnd), 10, 64)
+		step, err := parseDuration(r.FormValue(upStep))
+		if err != nil || step < time.Second {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		s := &model.SampleStream{Metric: model.Metric{model.MetricNameLabel: model.LabelValue(vs.Name)}}
+		for ts := start; ts <= end; ts += int64(step.Seconds()) {
+			s.Values = append(s.Values, model.SamplePair{Timestamp: model.Time(ts * 1000), Value: model.SampleValue(ts - int64(vs.Offset.Seconds()))})
+		}
+		json.NewEncoder(w).Encode(PrometheusMatrixEnvelope{Status: rvSuccess, Data: PrometheusMatrixData{ResultType: rvMatrix, Result: model.Matrix{s}}})
+	}))
+	return es, requests
+}
+
+func TestTricksterHandler_promQueryRangeHandler_offset(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es, requests := newSelectorTestServer()
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	// keep the 2015 test times from being aged out of the cache
+	o := tr.Config.Origins["default"]
+	o.MaxValueAgeSecs = time.Now().Unix()
+	o.FastForwardDisable = true
+	o.OffsetAwareCaching = true
+	tr.Config.Origins["default"] = o
+
+	query := func(q string, start int64, extra string) model.Matrix {
+		path := "/api/v1/query_range?step=15&query=" + url.QueryEscape(q) +
+			"&start=" + strconv.FormatInt(start, 10) + "&end=" + strconv.FormatInt(start+300, 10) + extra
+
+		// the origin's own response, without Trickster
+		resp, err := http.Get(es.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		<-requests
+		want := PrometheusMatrixEnvelope{}
+		if err := json.NewDecoder(resp.Body).Decode(&want); err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		tr.promQueryRangeHandler(w, httptest.NewRequest("GET", es.URL+path, nil))
+		got := PrometheusMatrixEnvelope{}
+		if err := json.NewDecoder(w.Result().Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if extra == "" && !reflect.DeepEqual(got.Data.Result, want.Data.Result) {
+			t.Errorf("%s: wanted %v got %v.", q, want.Data.Result, got.Data.Result)
+		}
+		return got.Data.Result
+	}
+
+	const start = 1435781400
+
+	// it should fetch an offset query as the query without the offset, over the shifted time range
+	query("up offset 1h", start+3600, "")
+	if r := <-requests; r.Get(upQuery) != "up" || r.Get(upStart) != strconv.Itoa(start) {
+		t.Errorf("wanted up from %d got %s from %s.", start, r.Get(upQuery), r.Get(upStart))
+	}
+
+	// it should serve the query without the offset from the same cache
+	query("up", start, "")
+	if len(requests) != 0 {
+		t.Errorf("wanted the request served from cache got %d origin requests.", len(requests))
+	}
+
+	// it should serve time-shifted requests from the same cache
+	shifted := query("up", start+3600, "&timeShift=1h")
+	if len(requests) != 0 {
+		t.Errorf("wanted the request served from cache got %d origin requests.", len(requests))
+	}
+	if len(shifted) != 1 || len(shifted[0].Values) != 21 || shifted[0].Values[0].Timestamp != model.Time((start+3600)*1000) ||
+		shifted[0].Values[0].Value != start {
+		t.Errorf("wanted values from %d shifted to %d got %v.", start, start+3600, shifted)
+	}
+
+	// it should pass an offset that isn't a multiple of the step through to the origin
+	query("up offset 3610s", start+3600, "")
+	if r := <-requests; r.Get(upQuery) != "up offset 3610s" {
+		t.Errorf("wanted the query unchanged got %s.", r.Get(upQuery))
+	}
+
+	// it should not shift by a time shift that isn't a multiple of the step
+	unshifted := query("up", start+3600, "&timeShift=3610s")
+	if r := <-requests; r.Get(upStart) != strconv.Itoa(start+3600) {
+		t.Errorf("wanted the range from %d got %s.", start+3600, r.Get(upStart))
+	}
+	if len(unshifted) != 1 || unshifted[0].Values[0].Timestamp != model.Time((start+3600)*1000) || unshifted[0].Values[0].Value != start+3600 {
+		t.Errorf("wanted unshifted values from %d got %v.", start+3600, unshifted)
+	}
+}
+
+func TestTricksterHandler_promQueryRangeHandler_offsetDisabled(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+	es, requests := newSelectorTestServer()
+	defer es.Close()
+	tr.setTestOrigin(es.URL)
+
+	o := tr.Config.Origins["default"]
+	o.FastForwardDisable = true
+	tr.Config.Origins["default"] = o
+
+	// it should pass the offset through to the origin by default
+	tr.promQueryRangeHandler(httptest.NewRecorder(), httptest.NewRequest("GET", es.URL+"/api/v1/query_range?step=15&query="+
+		url.QueryEscape("up offset 1h")+"&start=1435785000&end=1435785300", nil))
+	if r := <-requests; r.Get(upQuery) != "up offset 1h" || r.Get(upStart) != "1435785000" {
+		t.Errorf("wanted the request unchanged got %v.", r)
+	}
+
+	// it should reject an invalid timeShift
+	w := httptest.NewRecorder()
+	tr.promQueryRangeHandler(w, httptest.NewRequest("GET", es.URL+"/api/v1/query_range?step=15&query=up&start=1435785000&end=1435785300&timeShift=-1h", nil))
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("wanted 400 got %d.", w.Result().StatusCode)
+	}
+}
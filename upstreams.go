@@ -0,0 +1,347 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	// Load balancing strategies for origins with multiple upstreams
+	lbFirstHealthy = "first_healthy"
+	lbRoundRobin   = "round_robin"
+	lbHedged       = "hedged"
+
+	defaultHealthCheckIntervalSecs = 10
+	defaultMaxUpstreamFailures     = 3
+	defaultHedgeDelayMS            = 250
+)
+
+// UpstreamPool is the set of upstream replicas serving a single origin
+type UpstreamPool struct {
+	Origin    PrometheusOriginConfig
+	Upstreams []*Upstream
+	next      uint64
+	done      chan struct{}
+}
+
+// Upstream tracks the health of a single upstream replica of an origin
+type Upstream struct {
+	URL      string
+	mtx      sync.Mutex
+	healthy  bool
+	failures int
+}
+
+// upstreamResult is the outcome of a single request to an upstream
+type upstreamResult struct {
+	upstream *Upstream
+	body     []byte
+	resp     *http.Response
+	err      error
+}
+
+// isHealthy returns true if the upstream has not been ejected from its pool
+func (u *Upstream) isHealthy() bool {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	return u.healthy
+}
+
+// getUpstreamPool returns the UpstreamPool for the provided origin, creating it and starting its active health checks
+// if it was not created by startUpstreamPools
+func (t *TricksterHandler) getUpstreamPool(o PrometheusOriginConfig) *UpstreamPool {
+	key := o.OriginURL + "|" + strings.Join(o.OriginURLs, "|")
+
+	t.UpstreamPoolsMtx.Lock()
+	defer t.UpstreamPoolsMtx.Unlock()
+
+	if t.UpstreamPools == nil {
+		t.UpstreamPools = make(map[string]*UpstreamPool)
+	}
+
+	if p, ok := t.UpstreamPools[key]; ok {
+		return p
+	}
+
+	p := &UpstreamPool{Origin: o, Upstreams: make([]*Upstream, 0, len(o.OriginURLs)), done: make(chan struct{})}
+	for _, u := range o.OriginURLs {
+		p.Upstreams = append(p.Upstreams, &Upstream{URL: u, healthy: true})
+		t.setUpstreamHealthMetric(o, u, true)
+	}
+	t.UpstreamPools[key] = p
+
+	go t.healthCheckUpstreams(p)
+
+	return p
+}
+
+// startUpstreamPools creates the UpstreamPool of every configured origin with multiple upstreams, so their active
+// health checks run from startup rather than from each origin's first request
+func (t *TricksterHandler) startUpstreamPools() {
+	for _, o := range t.Config.Origins {
+		if len(o.OriginURLs) > 0 {
+			t.getUpstreamPool(o)
+		}
+	}
+}
+
+// closeUpstreamPools stops the active health checks of every UpstreamPool and discards the pools
+func (t *TricksterHandler) closeUpstreamPools() {
+	t.UpstreamPoolsMtx.Lock()
+	defer t.UpstreamPoolsMtx.Unlock()
+
+	for _, p := range t.UpstreamPools {
+		close(p.done)
+	}
+	t.UpstreamPools = nil
+}
+
+// candidates returns the pool's upstreams in the order they should be tried for the next request.
+// Ejected upstreams are placed at the end so they are only used when every other upstream has failed.
+func (p *UpstreamPool) candidates() []*Upstream {
+	n := len(p.Upstreams)
+	offset := 0
+	if p.Origin.LoadBalancing == lbRoundRobin {
+		offset = int((atomic.AddUint64(&p.next, 1) - 1) % uint64(n))
+	}
+
+	healthy := make([]*Upstream, 0, n)
+	ejected := make([]*Upstream, 0)
+	for i := 0; i < n; i++ {
+		u := p.Upstreams[(i+offset)%n]
+		if u.isHealthy() {
+			healthy = append(healthy, u)
+		} else {
+			ejected = append(ejected, u)
+		}
+	}
+
+	return append(healthy, ejected...)
+}
+
+// upstreamURI rewrites the provided origin uri to target the provided upstream
+func upstreamURI(o PrometheusOriginConfig, u *Upstream, uri string) string {
+	return strings.TrimSuffix(u.URL, "/") + strings.TrimPrefix(uri, strings.TrimSuffix(o.OriginURL, "/"))
+}
+
+// doOriginRequest makes an HTTP request against the provided origin. When the origin has multiple upstreams,
+// the request is sent to them according to the origin's load balancing strategy, failing over on error until the
+// request's context is done
+func (t *TricksterHandler) doOriginRequest(ctx context.Context, o PrometheusOriginConfig, method string, uri string, headers http.Header, body []byte) ([]byte, *http.Response, error) {
+	client := &http.Client{Timeout: time.Duration(o.TimeoutSecs * time.Second.Nanoseconds())}
+
+	if len(o.OriginURLs) == 0 || !strings.HasPrefix(uri, strings.TrimSuffix(o.OriginURL, "/")) {
+		return fetchUpstream(ctx, client, method, uri, headers, body)
+	}
+
+	p := t.getUpstreamPool(o)
+	if o.LoadBalancing == lbHedged {
+		return t.doHedgedRequest(ctx, p, client, method, uri, headers, body)
+	}
+
+	var res upstreamResult
+	for _, u := range p.candidates() {
+		res.upstream = u
+		res.body, res.resp, res.err = fetchUpstream(ctx, client, method, upstreamURI(o, u, uri), headers, body)
+		if ctx.Err() != nil {
+			// the client went away, which says nothing about the upstream
+			break
+		}
+		if t.recordUpstreamResult(p, res) {
+			break
+		}
+		level.Warn(t.Logger).Log(lfEvent, "upstream request failed, failing over", "upstream", u.URL)
+	}
+
+	return res.body, res.resp, res.err
+}
+
+// doHedgedRequest sends the request to the first candidate upstream, and then to each subsequent candidate
+// every HedgeDelayMS until one of them responds successfully or the request's context is done. The first successful
+// response wins.
+func (t *TricksterHandler) doHedgedRequest(ctx context.Context, p *UpstreamPool, client *http.Client, method string, uri string, headers http.Header, body []byte) ([]byte, *http.Response, error) {
+	candidates := p.candidates()
+
+	delay := p.Origin.HedgeDelayMS
+	if delay <= 0 {
+		delay = defaultHedgeDelayMS
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan upstreamResult, len(candidates))
+	send := func(u *Upstream) {
+		res := upstreamResult{upstream: u}
+		res.body, res.resp, res.err = fetchUpstream(ctx, client, method, upstreamURI(p.Origin, u, uri), headers, body)
+		results <- res
+	}
+
+	go send(candidates[0])
+	launched := 1
+
+	timer := time.NewTimer(time.Duration(delay) * time.Millisecond)
+	defer timer.Stop()
+
+	var last upstreamResult
+	for received := 0; received < len(candidates); {
+		select {
+		case <-timer.C:
+			if launched < len(candidates) {
+				go send(candidates[launched])
+				launched++
+				timer.Reset(time.Duration(delay) * time.Millisecond)
+			}
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case res := <-results:
+			received++
+			if t.recordUpstreamResult(p, res) {
+				return res.body, res.resp, res.err
+			}
+			last = res
+			if received == launched && launched < len(candidates) {
+				// everything in flight has failed, so don't wait for the timer to hedge
+				go send(candidates[launched])
+				launched++
+				timer.Reset(time.Duration(delay) * time.Millisecond)
+			}
+		}
+	}
+
+	return last.body, last.resp, last.err
+}
+
+// recordUpstreamResult updates the passive health state of the upstream that served the result,
+// and returns true if the result is usable. Transport errors and 5xx responses count as failures.
+func (t *TricksterHandler) recordUpstreamResult(p *UpstreamPool, res upstreamResult) bool {
+	ok := res.err == nil && res.resp.StatusCode < http.StatusInternalServerError
+
+	maxFailures := p.Origin.MaxUpstreamFailures
+	if maxFailures <= 0 {
+		maxFailures = defaultMaxUpstreamFailures
+	}
+
+	u := res.upstream
+	u.mtx.Lock()
+	if ok {
+		u.failures = 0
+	} else {
+		u.failures++
+		if u.healthy && u.failures >= maxFailures {
+			u.healthy = false
+			level.Warn(t.Logger).Log(lfEvent, "ejecting upstream after consecutive failures", "upstream", u.URL, "failures", u.failures)
+			t.setUpstreamHealthMetric(p.Origin, u.URL, false)
+		}
+	}
+	u.mtx.Unlock()
+
+	if !ok && t.Metrics != nil {
+		t.Metrics.UpstreamFailures.WithLabelValues(p.Origin.OriginURL, u.URL).Inc()
+	}
+
+	return ok
+}
+
+// healthCheckUpstreams continually probes each upstream in the pool using the same labels request as the
+// /health endpoint, restoring ejected upstreams that pass and ejecting those that fail, until the pool is closed
+func (t *TricksterHandler) healthCheckUpstreams(p *UpstreamPool) {
+	interval := p.Origin.HealthCheckIntervalSecs
+	if interval <= 0 {
+		interval = defaultHealthCheckIntervalSecs
+	}
+
+	client := &http.Client{Timeout: time.Duration(interval) * time.Second}
+	headers := t.originRequestHeaders(p.Origin, nil)
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		for _, u := range p.Upstreams {
+			_, resp, err := fetchUpstream(context.Background(), client, http.MethodGet, strings.TrimSuffix(u.URL, "/")+prometheusAPIv1Path+mnLabels, headers, nil)
+			healthy := err == nil && resp.StatusCode == http.StatusOK
+
+			u.mtx.Lock()
+			if healthy != u.healthy {
+				level.Info(t.Logger).Log(lfEvent, "upstream health changed", "upstream", u.URL, "healthy", healthy)
+				t.setUpstreamHealthMetric(p.Origin, u.URL, healthy)
+			}
+			u.healthy = healthy
+			if healthy {
+				u.failures = 0
+			}
+			u.mtx.Unlock()
+		}
+	}
+}
+
+// setUpstreamHealthMetric reports the health of an upstream as 1 (healthy) or 0 (ejected)
+func (t *TricksterHandler) setUpstreamHealthMetric(o PrometheusOriginConfig, upstream string, healthy bool) {
+	if t.Metrics == nil {
+		return
+	}
+	v := 0.0
+	if healthy {
+		v = 1
+	}
+	t.Metrics.UpstreamHealth.WithLabelValues(o.OriginURL, upstream).Set(v)
+}
+
+// fetchUpstream makes a single HTTP request with the provided headers and body to the provided URL and returns the response body
+func fetchUpstream(ctx context.Context, client *http.Client, method string, uri string, headers http.Header, reqBody []byte) ([]byte, *http.Response, error) {
+	var bodyReader io.Reader
+	if reqBody != nil {
+		// each attempt gets its own reader, since a request may be sent to several upstreams
+		bodyReader = bytes.NewReader(reqBody)
+	}
+	req, err := http.NewRequest(method, uri, bodyReader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing URL %q: %v", uri, err)
+	}
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error downloading URL %q: %v", uri, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading body from HTTP response for URL %q: %v", uri, err)
+	}
+
+	return body, resp, nil
+}
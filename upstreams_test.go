@@ -0,0 +1,197 @@
+/**
+* Copyright 2018 Comcast Cable Communications Management, LLC
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+* http://www.apache.org/licenses/LICENSE-2.0
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newCountingTestServer(status int, body string, delay time.Duration, hits *int64) *httptest.Server {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(hits, 1)
+		time.Sleep(delay)
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}
+	return httptest.NewServer(http.HandlerFunc(handler))
+}
+
+func TestTricksterHandler_getURL_failover(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	var deadHits, liveHits int64
+	dead := newCountingTestServer(http.StatusServiceUnavailable, "", 0, &deadHits)
+	defer dead.Close()
+	live := newCountingTestServer(http.StatusOK, "{}", 0, &liveHits)
+	defer live.Close()
+
+	o := PrometheusOriginConfig{OriginURLs: []string{dead.URL, live.URL}, MaxUpstreamFailures: 1}
+	o = withPrimaryUpstream(o)
+
+	// it should fail over to the live upstream
+	b, resp, _, err := tr.getURL(context.Background(), o, "GET", o.OriginURL+prometheusAPIv1Path+mnQuery, url.Values{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(b) != "{}" {
+		t.Errorf("wanted 200 {} got %d %s", resp.StatusCode, b)
+	}
+
+	// it should eject the failing upstream so subsequent requests go straight to the live one
+	p := tr.getUpstreamPool(o)
+	if p.Upstreams[0].isHealthy() {
+		t.Errorf("expected upstream %s to be ejected", dead.URL)
+	}
+	tr.getURL(context.Background(), o, "GET", o.OriginURL+prometheusAPIv1Path+mnQuery, url.Values{}, nil)
+	if deadHits != 1 || liveHits != 2 {
+		t.Errorf("wanted 1 dead and 2 live hits, got %d and %d", deadHits, liveHits)
+	}
+}
+
+func TestTricksterHandler_getURL_upstreamsCanceled(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	var slowHits, liveHits int64
+	slow := newCountingTestServer(http.StatusOK, "{}", 500*time.Millisecond, &slowHits)
+	defer slow.Close()
+	live := newCountingTestServer(http.StatusOK, "{}", 0, &liveHits)
+	defer live.Close()
+
+	for _, lb := range []string{lbFirstHealthy, lbHedged} {
+		o := withPrimaryUpstream(PrometheusOriginConfig{OriginURLs: []string{slow.URL, live.URL}, LoadBalancing: lb, HedgeDelayMS: 1000, MaxUpstreamFailures: 1})
+
+		// it should give up when the client goes away, without failing over or ejecting the upstream
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		if _, _, _, err := tr.getURL(ctx, o, "GET", o.OriginURL+prometheusAPIv1Path+mnQuery, url.Values{}, nil); err == nil {
+			t.Errorf("%s: expected an error", lb)
+		}
+		cancel()
+		if !tr.getUpstreamPool(o).Upstreams[0].isHealthy() {
+			t.Errorf("%s: expected upstream %s to stay healthy", lb, slow.URL)
+		}
+		if n := atomic.LoadInt64(&liveHits); n != 0 {
+			t.Errorf("%s: wanted no requests to %s got %d", lb, live.URL, n)
+		}
+	}
+}
+
+func TestTricksterHandler_startUpstreamPools(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	tr.Config.Origins["multi"] = withPrimaryUpstream(PrometheusOriginConfig{OriginURLs: []string{"http://a", "http://b"}})
+
+	// it should create the pools of the origins with multiple upstreams
+	tr.startUpstreamPools()
+	if len(tr.UpstreamPools) != 1 {
+		t.Errorf("wanted 1 pool got %d", len(tr.UpstreamPools))
+	}
+}
+
+func TestTricksterHandler_getURL_roundRobin(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	var hits1, hits2 int64
+	s1 := newCountingTestServer(http.StatusOK, "{}", 0, &hits1)
+	defer s1.Close()
+	s2 := newCountingTestServer(http.StatusOK, "{}", 0, &hits2)
+	defer s2.Close()
+
+	o := withPrimaryUpstream(PrometheusOriginConfig{OriginURLs: []string{s1.URL, s2.URL}, LoadBalancing: lbRoundRobin})
+
+	for i := 0; i < 4; i++ {
+		if _, _, _, err := tr.getURL(context.Background(), o, "GET", o.OriginURL+prometheusAPIv1Path+mnQuery, url.Values{}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// it should spread the requests evenly
+	if hits1 != 2 || hits2 != 2 {
+		t.Errorf("wanted 2 hits per upstream, got %d and %d", hits1, hits2)
+	}
+}
+
+func TestTricksterHandler_getURL_hedged(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	var slowHits, fastHits int64
+	slow := newCountingTestServer(http.StatusOK, "slow", 500*time.Millisecond, &slowHits)
+	defer slow.Close()
+	fast := newCountingTestServer(http.StatusOK, "fast", 0, &fastHits)
+	defer fast.Close()
+
+	o := withPrimaryUpstream(PrometheusOriginConfig{OriginURLs: []string{slow.URL, fast.URL}, LoadBalancing: lbHedged, HedgeDelayMS: 10})
+
+	// it should return the response of the upstream that answers first
+	start := time.Now()
+	b, _, _, err := tr.getURL(context.Background(), o, "GET", o.OriginURL+prometheusAPIv1Path+mnQuery, url.Values{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "fast" {
+		t.Errorf("wanted \"fast\" got %q", b)
+	}
+	if time.Since(start) >= 500*time.Millisecond {
+		t.Errorf("hedged request waited on the slow upstream")
+	}
+}
+
+func TestUpstreamPool_candidates(t *testing.T) {
+	p := &UpstreamPool{
+		Origin: PrometheusOriginConfig{LoadBalancing: lbFirstHealthy},
+		Upstreams: []*Upstream{
+			{URL: "http://a", healthy: false},
+			{URL: "http://b", healthy: true},
+		},
+	}
+
+	// it should try healthy upstreams before ejected ones
+	c := p.candidates()
+	if c[0].URL != "http://b" || c[1].URL != "http://a" {
+		t.Errorf("unexpected candidate order %s, %s", c[0].URL, c[1].URL)
+	}
+}
+
+func TestTricksterHandler_closeUpstreamPools(t *testing.T) {
+	tr, closeFn := newTestTricksterHandler(t)
+	defer closeFn(t)
+
+	var hits int64
+	s := newCountingTestServer(http.StatusOK, "{}", 0, &hits)
+	defer s.Close()
+
+	o := withPrimaryUpstream(PrometheusOriginConfig{OriginURLs: []string{s.URL}, HealthCheckIntervalSecs: 1})
+	tr.getUpstreamPool(o)
+
+	// it should stop the health checks of the pools it closes
+	tr.closeUpstreamPools()
+	if tr.UpstreamPools != nil {
+		t.Errorf("expected the pools to be discarded, got %v", tr.UpstreamPools)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if n := atomic.LoadInt64(&hits); n != 0 {
+		t.Errorf("wanted no health checks after closing got %d", n)
+	}
+}